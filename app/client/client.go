@@ -0,0 +1,250 @@
+// Package client is a small Go client for the heartbeat REST API.
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Client talks to a single heartbeat node, writes are only accepted by the
+// leader, so `addr` should usually point to it.
+type Client struct {
+	addr   string
+	scheme string
+	http   *http.Client
+	// traceParent is sent as the W3C `traceparent` header of every request.
+	traceParent string
+	// token is the ACL token sent with every request.
+	token string
+}
+
+// New creates a client for the node listening at the `host:port` address.
+func New(addr string) *Client {
+	return &Client{
+		addr:   addr,
+		scheme: "http",
+		http:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// NewTLS creates a client for a node serving its API over HTTPS, the
+// configuration holds the CA to trust and the client's certificate if the
+// node verifies them.
+func NewTLS(addr string, config *tls.Config) *Client {
+	return &Client{
+		addr:   addr,
+		scheme: "https",
+		http: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: config},
+		},
+	}
+}
+
+// WithToken returns a copy of the client sending the ACL token with its
+// requests.
+func (c *Client) WithToken(token string) *Client {
+	cp := *c
+	cp.token = token
+	return &cp
+}
+
+// Registration identifies an instance of a service.
+type Registration struct {
+	ServiceName string `json:"service"`
+	Host        string `json:"host"`
+	Port        uint16 `json:"port"`
+	// Persistent keeps the service listed once it has no instances left.
+	Persistent bool `json:"persistent,omitempty"`
+	// Tags label the instance, they can be used to filter it through DNS.
+	Tags []string `json:"tags,omitempty"`
+	// Meta holds key/value metadata of the instance.
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// KVEntry mirrors the entries returned by the `/kv/` endpoint.
+type KVEntry struct {
+	Key            string `json:"key"`
+	Value          string `json:"value"`
+	CreateIndex    uint64 `json:"create_index"`
+	ModifyIndex    uint64 `json:"modify_index"`
+	TTLMs          uint64 `json:"ttl_ms,omitempty"`
+	RemainingTTLMs uint64 `json:"remaining_ttl_ms,omitempty"`
+	Session        string `json:"session,omitempty"`
+	LockIndex      uint64 `json:"lock_index,omitempty"`
+}
+
+// SessionRequest describes the session to create, a session is bound to the
+// instance identified by `Service`, `Host` and `Port` and/or has its own `TTL`
+// (e.g. `15s`).
+type SessionRequest struct {
+	Service string `json:"service,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Port    uint16 `json:"port,omitempty"`
+	TTL     string `json:"ttl,omitempty"`
+}
+
+// Session is a session as returned by the server.
+type Session struct {
+	ID      string `json:"id"`
+	Service string `json:"service,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Port    uint16 `json:"port,omitempty"`
+	TTLMs   uint64 `json:"ttl_ms,omitempty"`
+}
+
+// Heartbeat registers the instance, or renews its lease if it's already
+// registered.
+func (c *Client) Heartbeat(reg Registration) error {
+	return c.do(http.MethodPost, "/heartbeat", reg, nil)
+}
+
+// HeartbeatBatch registers, or renews the lease of, all the instances with a
+// single request.
+func (c *Client) HeartbeatBatch(regs []Registration) error {
+	return c.do(http.MethodPost, "/heartbeat/batch", regs, nil)
+}
+
+// Get returns the entry for the key, or nil if the key does not exist.
+func (c *Client) Get(key string) (*KVEntry, error) {
+	var e KVEntry
+	err := c.do(http.MethodGet, "/kv/"+key, nil, &e)
+	if err == errNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// CreateSession creates a new session and returns its identifier.
+func (c *Client) CreateSession(req SessionRequest) (string, error) {
+	var sess Session
+	if err := c.do(http.MethodPut, "/session/create", req, &sess); err != nil {
+		return "", err
+	}
+	return sess.ID, nil
+}
+
+// RenewSession resets the TTL of the session.
+func (c *Client) RenewSession(id string) error {
+	return c.do(http.MethodPut, "/session/renew/"+id, nil, nil)
+}
+
+// DestroySession invalidates the session, releasing all the locks it holds.
+func (c *Client) DestroySession(id string) error {
+	return c.do(http.MethodPut, "/session/destroy/"+id, nil, nil)
+}
+
+// Acquire tries to take the lock on the key for the session, writing the
+// value if it succeeds. It does not block if the lock is held by another
+// session.
+func (c *Client) Acquire(key, value, session string) (bool, error) {
+	var ok bool
+	err := c.do(http.MethodPut, "/kv/"+key+"?acquire="+url.QueryEscape(session), rawValue(value), &ok)
+	return ok, err
+}
+
+// Release gives up the lock on the key if it's held by the session.
+func (c *Client) Release(key, session string) (bool, error) {
+	var ok bool
+	err := c.do(http.MethodPut, "/kv/"+key+"?release="+url.QueryEscape(session), nil, &ok)
+	return ok, err
+}
+
+// Member is a node of the cluster along with the addresses it can be reached
+// at.
+type Member struct {
+	ID       string `json:"id"`
+	RaftAddr string `json:"raft_addr"`
+	HttpAddr string `json:"http_addr"`
+}
+
+// TransferLeadership asks the leader to hand the leadership over to the member
+// with the given ID, or to the most up to date one if it's empty, and returns
+// the new leader. A follower redirects the request to the leader.
+func (c *Client) TransferLeadership(id string) (*Member, error) {
+	var leader Member
+	if err := c.do(http.MethodPost, "/cluster/transfer-leadership?id="+url.QueryEscape(id), nil, &leader); err != nil {
+		return nil, err
+	}
+	return &leader, nil
+}
+
+// MemberStatus is a member of the cluster along with its suffrage.
+type MemberStatus struct {
+	Member
+	Voter  bool `json:"voter"`
+	Leader bool `json:"leader"`
+}
+
+// Members lists the members of the cluster as known by the node.
+func (c *Client) Members() ([]MemberStatus, error) {
+	var members []MemberStatus
+	err := c.do(http.MethodGet, "/cluster/members", nil, &members)
+	return members, err
+}
+
+// Promote makes the non-voting member with the given ID a voter.
+func (c *Client) Promote(id string) error {
+	return c.do(http.MethodPost, "/cluster/promote?id="+url.QueryEscape(id), nil, nil)
+}
+
+// Demote makes the voting member with the given ID a non-voter, the leader
+// can't be demoted.
+func (c *Client) Demote(id string) error {
+	return c.do(http.MethodPost, "/cluster/demote?id="+url.QueryEscape(id), nil, nil)
+}
+
+var errNotFound = fmt.Errorf("not found")
+
+// rawValue is sent as is instead of being JSON encoded.
+type rawValue string
+
+func (c *Client) do(method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	switch v := in.(type) {
+	case nil:
+	case rawValue:
+		body.WriteString(string(v))
+	default:
+		if err := json.NewEncoder(&body).Encode(v); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("%s://%s%s", c.scheme, c.addr, path), &body)
+	if err != nil {
+		return err
+	}
+	if c.traceParent != "" {
+		req.Header.Set("traceparent", c.traceParent)
+	}
+	if c.token != "" {
+		req.Header.Set("X-Heartbeat-Token", c.token)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s %s failed with status %d: %s", method, path, res.StatusCode, msg)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
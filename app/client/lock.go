@@ -0,0 +1,129 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// LockRetryInterval is how often a blocked lock or a running election checks
+// the state of the key again.
+var LockRetryInterval = time.Second
+
+// Lock blocks until the lock on the key is acquired for the session, or until
+// `stopCh` is closed in which case an error is returned.
+func (c *Client) Lock(key, value, session string, stopCh <-chan struct{}) error {
+	for {
+		ok, err := c.Acquire(key, value, session)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-stopCh:
+			return fmt.Errorf("Gave up acquiring the lock on '%s'", key)
+		case <-time.After(LockRetryInterval):
+		}
+	}
+}
+
+// Unlock releases the lock on the key held by the session.
+func (c *Client) Unlock(key, session string) error {
+	ok, err := c.Release(key, session)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("The lock on '%s' is not held by session '%s'", key, session)
+	}
+	return nil
+}
+
+// LeaderKey is the key used to elect a leader among the instances of a
+// service.
+func LeaderKey(service string) string {
+	return fmt.Sprintf("service/%s/leader", service)
+}
+
+// ElectLeader campaigns for the leadership of the instance's service.
+//
+// The instance must be heartbeating, the lock is held through a session bound
+// to it, so leadership is lost as soon as the instance gets evicted from the
+// registry. The returned channel receives `true` when the instance becomes the
+// leader and `false` when it loses the leadership, it's closed once `stopCh` is
+// closed and the leadership given up.
+func (c *Client) ElectLeader(reg Registration, stopCh <-chan struct{}) <-chan bool {
+	ch := make(chan bool, 1)
+	go c.campaign(reg, stopCh, ch)
+	return ch
+}
+
+func (c *Client) campaign(reg Registration, stopCh <-chan struct{}, ch chan<- bool) {
+	key := LeaderKey(reg.ServiceName)
+	value := fmt.Sprintf("%s:%d", reg.Host, reg.Port)
+	session := ""
+	leading := false
+
+	setLeading := func(l bool) {
+		if l != leading {
+			leading = l
+			ch <- l
+		}
+	}
+
+	for {
+		if session == "" {
+			id, err := c.CreateSession(SessionRequest{
+				Service: reg.ServiceName,
+				Host:    reg.Host,
+				Port:    reg.Port,
+			})
+			if err != nil {
+				log.Printf("Could not create an election session for '%s': %s", key, err)
+			} else {
+				session = id
+			}
+		}
+
+		if session != "" {
+			e, err := c.Get(key)
+			switch {
+			case err != nil:
+				log.Printf("Could not read the election key '%s': %s", key, err)
+			case e != nil && e.Session == session:
+				setLeading(true)
+			case e == nil || e.Session == "":
+				// The lock is free, either nobody ran for it yet or the previous
+				// leader's session got invalidated.
+				ok, err := c.Acquire(key, value, session)
+				if err != nil {
+					// Most likely our own session was invalidated, start over
+					// with a new one. It's destroyed first in case it's still
+					// alive, or it would keep the locks it might hold.
+					log.Printf("Could not acquire the election key '%s': %s", key, err)
+					if err := c.DestroySession(session); err != nil {
+						log.Printf("Could not destroy the election session '%s': %s", session, err)
+					} else {
+						session = ""
+					}
+				}
+				setLeading(ok)
+			default:
+				setLeading(false)
+			}
+		}
+
+		select {
+		case <-stopCh:
+			if session != "" {
+				c.DestroySession(session)
+			}
+			setLeading(false)
+			close(ch)
+			return
+		case <-time.After(LockRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestElectLeaderDestroysFailedSession(t *testing.T) {
+	prev := LockRetryInterval
+	LockRetryInterval = 10 * time.Millisecond
+	defer func() { LockRetryInterval = prev }()
+
+	var mu sync.Mutex
+	created, destroyed := 0, []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case req.URL.Path == "/session/create":
+			created++
+			fmt.Fprintf(res, `{"id":"s%d"}`, created)
+		case strings.HasPrefix(req.URL.Path, "/session/destroy/"):
+			destroyed = append(destroyed, strings.TrimPrefix(req.URL.Path, "/session/destroy/"))
+		case req.Method == http.MethodGet:
+			res.WriteHeader(http.StatusNotFound)
+		case req.URL.Query().Get("acquire") == "s1":
+			// The first session fails to acquire the lock.
+			res.WriteHeader(http.StatusInternalServerError)
+		default:
+			res.Write([]byte("true"))
+		}
+	}))
+	defer srv.Close()
+
+	c := New(strings.TrimPrefix(srv.URL, "http://"))
+	stopCh := make(chan struct{})
+	ch := c.ElectLeader(Registration{ServiceName: "web", Host: "10.0.0.1", Port: 80}, stopCh)
+	select {
+	case leading := <-ch:
+		if !leading {
+			t.Fatalf("Expected to become the leader")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the leadership")
+	}
+	mu.Lock()
+	if len(destroyed) != 1 || destroyed[0] != "s1" {
+		t.Errorf("Expected the session that failed to acquire the lock to be destroyed, got %v", destroyed)
+	}
+	mu.Unlock()
+
+	close(stopCh)
+	for range ch {
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(destroyed) != 2 || destroyed[1] != "s2" {
+		t.Errorf("Expected the session to be destroyed when giving up, got %v", destroyed)
+	}
+}
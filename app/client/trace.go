@@ -0,0 +1,26 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// WithTraceParent returns a copy of the client sending the W3C `traceparent`
+// with its requests, the spans recorded by the server for them become part of
+// the caller's trace.
+func (c *Client) WithTraceParent(traceParent string) *Client {
+	cp := *c
+	cp.traceParent = traceParent
+	return &cp
+}
+
+// NewTraceParent starts a new sampled trace, and returns the `traceparent` of
+// its root span.
+func NewTraceParent() string {
+	traceID := make([]byte, 16)
+	spanID := make([]byte, 8)
+	rand.Read(traceID)
+	rand.Read(spanID)
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(traceID), hex.EncodeToString(spanID))
+}
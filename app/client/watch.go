@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// WatchWait is how long each blocking query issued by a watch waits for a
+// change on the server side.
+var WatchWait = 5 * time.Minute
+
+// WatchRetryInterval is how long a watch waits before querying again after a
+// failed request.
+var WatchRetryInterval = 2 * time.Second
+
+// WatchEvent holds the state of the watched key(s) after the change at
+// `Index`, `Entries` is empty if the watched key does not exist.
+type WatchEvent struct {
+	Index   uint64
+	Entries []KVEntry
+}
+
+// Watch delivers the current state of the key, and then a new event every time
+// it changes, until `stopCh` is closed. If `prefix` is set, every key starting
+// with `key` is watched instead.
+//
+// Consumers that fall behind only get the latest state, which is usually what
+// hot-reloading configuration needs.
+func (c *Client) Watch(key string, prefix bool, stopCh <-chan struct{}) <-chan WatchEvent {
+	ch := make(chan WatchEvent, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stopCh:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	go func() {
+		defer close(ch)
+		defer cancel()
+
+		var index uint64
+		first := true
+		for {
+			ev, err := c.blockingQuery(ctx, key, prefix, index, first)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("Watch on '%s' failed, will retry in %s: %s", key, WatchRetryInterval, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(WatchRetryInterval):
+				}
+				continue
+			}
+
+			// The index going backwards means the node's state got replaced
+			// (e.g. restored from a snapshot), start over from the current state.
+			if ev.Index < index {
+				index, first = 0, true
+				continue
+			}
+			if !first && ev.Index == index {
+				// The wait elapsed without any change.
+				continue
+			}
+			index, first = ev.Index, false
+
+			// Drop a pending event the consumer did not read yet, it's stale.
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- *ev
+		}
+	}()
+	return ch
+}
+
+func (c *Client) blockingQuery(ctx context.Context, key string, prefix bool, index uint64, first bool) (*WatchEvent, error) {
+	q := url.Values{}
+	if prefix {
+		q.Set("recurse", "")
+	}
+	if !first {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", WatchWait.String())
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s://%s/kv/%s?%s", c.scheme, c.addr, key, q.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Heartbeat-Token", c.token)
+	}
+	// The shared client has a timeout shorter than the wait.
+	res, err := (&http.Client{Transport: c.http.Transport}).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	ev := &WatchEvent{Entries: make([]KVEntry, 0)}
+	if ev.Index, err = strconv.ParseUint(res.Header.Get("X-Heartbeat-Index"), 10, 64); err != nil {
+		return nil, fmt.Errorf("Invalid index header: %s", err)
+	}
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+	case res.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("Watch query failed with status %d", res.StatusCode)
+	case prefix:
+		err = json.NewDecoder(res.Body).Decode(&ev.Entries)
+	default:
+		var e KVEntry
+		if err = json.NewDecoder(res.Body).Decode(&e); err == nil {
+			ev.Entries = append(ev.Entries, e)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
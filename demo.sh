@@ -8,10 +8,10 @@
 
 CWD=$(pwd)
 cd $CWD/server
-go run main.go --port=9000 --rport=9999 --sdir="/tmp/heartbeat/node-1" & 
+go run main.go --id=node-1 --advertise=127.0.0.1 --port=9000 --rport=9999 --sdir="/tmp/heartbeat/node-1" & 
 
 # Wait for the leader to start
 sleep 5
-go run main.go --leader="127.0.0.1:9000" --port=9001 --rport=9998 --sdir="/tmp/heartbeat/node-2" & 
-go run main.go --leader="127.0.0.1:9000" --port=9002 --rport=9997 --sdir="/tmp/heartbeat/node-3" & 
+go run main.go --id=node-2 --advertise=127.0.0.1 --leader="127.0.0.1:9000" --port=9001 --rport=9998 --sdir="/tmp/heartbeat/node-2" & 
+go run main.go --id=node-3 --advertise=127.0.0.1 --leader="127.0.0.1:9000" --port=9002 --rport=9997 --sdir="/tmp/heartbeat/node-3" & 
 
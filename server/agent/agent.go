@@ -0,0 +1,332 @@
+// Package agent implements the node-local agent mode of the heartbeat server.
+//
+// An agent runs next to the applications of a host, they register with it
+// instead of talking to the cluster, and the agent renews all their leases with
+// a single batch heartbeat. It also keeps a copy of the registry so that
+// discovery keeps working while the cluster is unreachable.
+package agent
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chermehdi/heartbeat/server/node"
+	"github.com/hashicorp/go-hclog"
+)
+
+// Agent keeps track of the local instances and heartbeats on their behalf.
+type Agent struct {
+	addr     string
+	servers  []string
+	interval time.Duration
+
+	mu        sync.Mutex
+	instances map[string]*localInstance
+	// current is the index in `servers` of the server the agent talks to, it
+	// moves to the next one whenever a request fails.
+	current int
+
+	cmu        sync.Mutex
+	cache      []byte
+	cachedAt   time.Time
+	lastFailed bool
+
+	client   *http.Client
+	scheme   string
+	token    string
+	listener net.Listener
+	logger   hclog.Logger
+}
+
+// NewAgent creates an agent listening on `addr` that heartbeats every
+// `interval` to one of the cluster's `servers` (HTTP `host:port` addresses).
+func NewAgent(addr string, servers []string, interval time.Duration) *Agent {
+	return &Agent{
+		addr:      addr,
+		servers:   servers,
+		interval:  interval,
+		instances: make(map[string]*localInstance),
+		client:    &http.Client{Timeout: interval},
+		scheme:    "http",
+		logger:    node.ComponentLogger("agent"),
+	}
+}
+
+// UseTLS makes the agent talk to the servers over HTTPS, it must be called
+// before `Start`.
+func (a *Agent) UseTLS(config *tls.Config) {
+	a.client.Transport = &http.Transport{TLSClientConfig: config}
+	a.scheme = "https"
+}
+
+// UseToken makes the agent send the ACL token with its requests to the
+// servers, the token needs to write the services of the local instances and to
+// read the registry. It must be called before `Start`.
+func (a *Agent) UseToken(token string) {
+	a.token = token
+}
+
+// Start starts the agent's HTTP server and its heartbeat loop, both run in
+// their own goroutine.
+func (a *Agent) Start() error {
+	if len(a.servers) == 0 {
+		return fmt.Errorf("The agent needs the address of at least one server")
+	}
+	a.logger.Info("Starting the agent", "addr", a.addr, "servers", a.servers, "interval", a.interval)
+
+	listener, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		return err
+	}
+	a.listener = listener
+	go func() {
+		if err := http.Serve(listener, a); err != nil {
+			a.logger.Error("Unexpected error happened", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	go a.loop()
+	return nil
+}
+
+// Shutdown stops accepting local requests.
+func (a *Agent) Shutdown() {
+	a.listener.Close()
+}
+
+func (a *Agent) loop() {
+	for {
+		a.heartbeat()
+		a.refreshServices()
+		time.Sleep(a.interval)
+	}
+}
+
+// heartbeat renews the leases of every local instance that is still alive with
+// a single batch heartbeat.
+func (a *Agent) heartbeat() {
+	a.mu.Lock()
+	regs := make([]node.InstanceRegistration, 0, len(a.instances))
+	now := time.Now()
+	for k, inst := range a.instances {
+		if inst.expired(now) {
+			a.logger.Info("Instance stopped heartbeating, dropping it", "instance", k)
+			delete(a.instances, k)
+			continue
+		}
+		if inst.healthy() {
+			regs = append(regs, inst.reg)
+		}
+	}
+	a.mu.Unlock()
+
+	if len(regs) == 0 {
+		return
+	}
+	for start := 0; start < len(regs); start += node.MaxHeartbeatBatch {
+		end := start + node.MaxHeartbeatBatch
+		if end > len(regs) {
+			end = len(regs)
+		}
+		b, err := json.Marshal(regs[start:end])
+		if err != nil {
+			a.logger.Error("Could not encode the batch heartbeat", "error", err)
+			return
+		}
+		if _, err := a.post("/heartbeat/batch", b); err != nil {
+			a.logger.Warn("Batch heartbeat failed", "instances", end-start, "error", err)
+		}
+	}
+}
+
+// refreshServices updates the local copy of the registry, reading it from any
+// server as stale data is fine for a cache.
+func (a *Agent) refreshServices() {
+	body, err := a.get("/services?stale")
+	a.cmu.Lock()
+	defer a.cmu.Unlock()
+	if err != nil {
+		if !a.lastFailed {
+			a.logger.Warn("Could not refresh the services, serving the cached copy", "error", err)
+		}
+		a.lastFailed = true
+		return
+	}
+	a.cache = body
+	a.cachedAt = time.Now()
+	a.lastFailed = false
+}
+
+func (a *Agent) post(path string, body []byte) ([]byte, error) {
+	return a.do(func(server string) (*http.Response, error) {
+		return a.send(http.MethodPost, server, path, body)
+	})
+}
+
+func (a *Agent) get(path string) ([]byte, error) {
+	return a.do(func(server string) (*http.Response, error) {
+		return a.send(http.MethodGet, server, path, nil)
+	})
+}
+
+func (a *Agent) send(method, server, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("%s://%s%s", a.scheme, server, path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if a.token != "" {
+		req.Header.Set("X-Heartbeat-Token", a.token)
+	}
+	return a.client.Do(req)
+}
+
+// do sends the request to the current server, trying the other ones in turn if
+// it fails.
+func (a *Agent) do(send func(string) (*http.Response, error)) ([]byte, error) {
+	var lastErr error
+	for i := 0; i < len(a.servers); i++ {
+		a.mu.Lock()
+		server := a.servers[a.current]
+		a.mu.Unlock()
+
+		res, err := send(server)
+		if err == nil {
+			var buf bytes.Buffer
+			_, err = buf.ReadFrom(res.Body)
+			res.Body.Close()
+			if err == nil && res.StatusCode == http.StatusOK {
+				return buf.Bytes(), nil
+			}
+			if err == nil {
+				err = fmt.Errorf("server '%s' answered with status %d: %s", server, res.StatusCode, buf.String())
+			}
+		}
+		lastErr = err
+
+		a.mu.Lock()
+		a.current = (a.current + 1) % len(a.servers)
+		a.mu.Unlock()
+	}
+	return nil, lastErr
+}
+
+// ServeHTTP serves the local API:
+//   - `POST /register` and `POST /deregister` with a `Registration`.
+//   - `POST /heartbeat` with an `InstanceRegistration`, for instances that
+//     prefer heartbeating to the agent over a health check.
+//   - `GET /services`, answered from the cached copy of the registry.
+func (a *Agent) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/register":
+		a.handleRegister(req, res)
+	case "/deregister":
+		a.handleDeregister(req, res)
+	case "/heartbeat":
+		a.handleHeartbeat(req, res)
+	case "/services":
+		a.handleServices(req, res)
+	default:
+		res.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (a *Agent) handleRegister(req *http.Request, res http.ResponseWriter) {
+	var r Registration
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		a.logger.Warn("Could not parse registration request", "error", err)
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	inst, err := newLocalInstance(r)
+	if err != nil {
+		a.logger.Warn("Invalid registration", "service", r.ServiceName, "error", err)
+		res.WriteHeader(http.StatusBadRequest)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	k := instanceKey(r.InstanceRegistration)
+	a.mu.Lock()
+	if prev, has := a.instances[k]; has {
+		prev.stop()
+	}
+	a.instances[k] = inst
+	a.mu.Unlock()
+
+	a.logger.Info("Registered local instance", "instance", k)
+	inst.start(a.logger)
+	res.WriteHeader(http.StatusOK)
+}
+
+func (a *Agent) handleDeregister(req *http.Request, res http.ResponseWriter) {
+	var r node.InstanceRegistration
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	k := instanceKey(r)
+	a.mu.Lock()
+	if inst, has := a.instances[k]; has {
+		inst.stop()
+		delete(a.instances, k)
+	}
+	a.mu.Unlock()
+
+	// The instance is evicted by the cluster once its lease expires.
+	a.logger.Info("Deregistered local instance", "instance", k)
+	res.WriteHeader(http.StatusOK)
+}
+
+func (a *Agent) handleHeartbeat(req *http.Request, res http.ResponseWriter) {
+	var r node.InstanceRegistration
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	k := instanceKey(r)
+	a.mu.Lock()
+	inst, has := a.instances[k]
+	if !has {
+		inst = newHeartbeatInstance(r)
+		a.instances[k] = inst
+		a.logger.Info("Registered local instance on its first heartbeat", "instance", k)
+	}
+	inst.beat()
+	a.mu.Unlock()
+	res.WriteHeader(http.StatusOK)
+}
+
+// handleServices answers from the cached registry, `X-Cache-Age` tells how old
+// the copy is in milliseconds and `X-Cache-Stale` is set when the last refresh
+// failed.
+func (a *Agent) handleServices(req *http.Request, res http.ResponseWriter) {
+	a.cmu.Lock()
+	body, cachedAt, stale := a.cache, a.cachedAt, a.lastFailed
+	a.cmu.Unlock()
+
+	if body == nil {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		res.Write([]byte("The registry was not fetched from the cluster yet"))
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("X-Cache-Age", strconv.FormatInt(time.Since(cachedAt).Milliseconds(), 10))
+	res.Header().Set("X-Cache-Stale", strconv.FormatBool(stale))
+	res.Write(body)
+}
+
+func instanceKey(r node.InstanceRegistration) string {
+	return fmt.Sprintf("%s/%s:%d", r.ServiceName, r.Host, r.Port)
+}
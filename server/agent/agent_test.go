@@ -0,0 +1,309 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chermehdi/heartbeat/server/node"
+)
+
+func TestNewLocalInstance(t *testing.T) {
+	tests := []struct {
+		name  string
+		check Check
+		valid bool
+	}{
+		{"http", Check{HTTP: "http://127.0.0.1:8080/health"}, true},
+		{"tcp with interval and timeout", Check{TCP: "127.0.0.1:8080", Interval: "1s", Timeout: "500ms"}, true},
+		{"no check", Check{}, false},
+		{"both checks", Check{HTTP: "http://127.0.0.1:8080/health", TCP: "127.0.0.1:8080"}, false},
+		{"invalid interval", Check{TCP: "127.0.0.1:8080", Interval: "often"}, false},
+		{"negative interval", Check{TCP: "127.0.0.1:8080", Interval: "-1s"}, false},
+		{"invalid timeout", Check{TCP: "127.0.0.1:8080", Timeout: "0s"}, false},
+	}
+	for _, tt := range tests {
+		_, err := newLocalInstance(Registration{Check: tt.check})
+		if tt.valid && err != nil {
+			t.Errorf("%s: expected the check to be accepted, got %s", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: expected the check to be rejected", tt.name)
+		}
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/ok":
+			res.WriteHeader(http.StatusNoContent)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			res.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer listener.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	closed.Close()
+
+	tests := []struct {
+		name    string
+		check   Check
+		passing bool
+	}{
+		{"http 2xx", Check{HTTP: srv.URL + "/ok"}, true},
+		{"http 5xx", Check{HTTP: srv.URL + "/fail"}, false},
+		{"http timeout", Check{HTTP: srv.URL + "/slow", Timeout: "50ms"}, false},
+		{"http unreachable", Check{HTTP: "http://" + closed.Addr().String()}, false},
+		{"tcp accepting", Check{TCP: listener.Addr().String()}, true},
+		{"tcp refused", Check{TCP: closed.Addr().String()}, false},
+	}
+	for _, tt := range tests {
+		inst, err := newLocalInstance(Registration{Check: tt.check})
+		if err != nil {
+			t.Fatalf("%s: could not create the instance: %s", tt.name, err)
+		}
+		if err := inst.runCheck(); (err == nil) != tt.passing {
+			t.Errorf("%s: expected the check to pass: %v, got %v", tt.name, tt.passing, err)
+		}
+	}
+}
+
+func TestHealthCheckedInstance(t *testing.T) {
+	var mu sync.Mutex
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		res.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	inst, err := newLocalInstance(Registration{Check: Check{HTTP: srv.URL, Interval: "10ms"}})
+	if err != nil {
+		t.Fatalf("Could not create the instance: %s", err)
+	}
+	inst.start(node.ComponentLogger("agent"))
+	defer inst.stop()
+
+	waitFor := func(healthy bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); inst.healthy() != healthy; time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the instance to be healthy: %v", healthy)
+			}
+		}
+	}
+	waitFor(true)
+	mu.Lock()
+	status = http.StatusServiceUnavailable
+	mu.Unlock()
+	waitFor(false)
+	if inst.expired(time.Now().Add(time.Hour)) {
+		t.Errorf("Expected a health checked instance never to expire")
+	}
+}
+
+// testServer records the batch heartbeats it receives, and answers `/services`
+// with `services` unless `failing` is set.
+type testServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	batches  [][]node.InstanceRegistration
+	failing  bool
+	services string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{services: `{"services":[]}`}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.failing {
+			res.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch req.URL.Path {
+		case "/heartbeat/batch":
+			var regs []node.InstanceRegistration
+			if err := json.NewDecoder(req.Body).Decode(&regs); err != nil {
+				res.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			s.batches = append(s.batches, regs)
+		case "/services":
+			res.Write([]byte(s.services))
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) addr() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+func (s *testServer) received() [][]node.InstanceRegistration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches
+}
+
+func TestHeartbeatBatches(t *testing.T) {
+	prev := node.MaxHeartbeatBatch
+	node.MaxHeartbeatBatch = 2
+	defer func() { node.MaxHeartbeatBatch = prev }()
+
+	srv := newTestServer(t)
+	a := NewAgent("", []string{srv.addr()}, time.Second)
+	for port := uint16(1); port <= 5; port++ {
+		inst := newHeartbeatInstance(node.InstanceRegistration{ServiceName: "web", Host: "10.0.0.1", Port: port})
+		inst.beat()
+		a.instances[instanceKey(inst.reg)] = inst
+	}
+	failing := &localInstance{reg: node.InstanceRegistration{ServiceName: "web", Host: "10.0.0.1", Port: 6}}
+	a.instances[instanceKey(failing.reg)] = failing
+	expired := newHeartbeatInstance(node.InstanceRegistration{ServiceName: "web", Host: "10.0.0.1", Port: 7})
+	expired.lastBeat = time.Now().Add(-2 * LocalHeartbeatTTL)
+	a.instances[instanceKey(expired.reg)] = expired
+
+	a.heartbeat()
+
+	batches := srv.received()
+	sizes := make([]int, 0, len(batches))
+	ports := map[uint16]bool{}
+	for _, b := range batches {
+		sizes = append(sizes, len(b))
+		for _, r := range b {
+			ports[r.Port] = true
+		}
+	}
+	if fmt.Sprint(sizes) != "[2 2 1]" {
+		t.Errorf("Expected batches of at most 2 instances, got %v", sizes)
+	}
+	for port := uint16(1); port <= 7; port++ {
+		if ports[port] != (port <= 5) {
+			t.Errorf("Expected port %d to heartbeat: %v", port, port <= 5)
+		}
+	}
+	if _, has := a.instances[instanceKey(expired.reg)]; has {
+		t.Errorf("Expected the instance that stopped heartbeating to be dropped")
+	}
+	if _, has := a.instances[instanceKey(failing.reg)]; !has {
+		t.Errorf("Expected the failing instance to be kept")
+	}
+
+	// Nothing is sent when no instance is healthy.
+	a = NewAgent("", []string{srv.addr()}, time.Second)
+	a.instances[instanceKey(failing.reg)] = failing
+	a.heartbeat()
+	if len(srv.received()) != len(batches) {
+		t.Errorf("Expected no batch without a healthy instance")
+	}
+}
+
+func TestServerFailover(t *testing.T) {
+	down, up := newTestServer(t), newTestServer(t)
+	down.mu.Lock()
+	down.failing = true
+	down.mu.Unlock()
+	a := NewAgent("", []string{down.addr(), up.addr()}, time.Second)
+	inst := newHeartbeatInstance(node.InstanceRegistration{ServiceName: "web", Host: "10.0.0.1", Port: 80})
+	inst.beat()
+	a.instances[instanceKey(inst.reg)] = inst
+
+	a.heartbeat()
+	if len(up.received()) != 1 || a.current != 1 {
+		t.Fatalf("Expected the batch to be sent to the second server, got %d batches and server %d", len(up.received()), a.current)
+	}
+	// The agent sticks to the server that answered.
+	a.heartbeat()
+	if len(up.received()) != 2 || a.current != 1 {
+		t.Errorf("Expected the agent to keep using the second server, got server %d", a.current)
+	}
+}
+
+func TestServicesCache(t *testing.T) {
+	srv := newTestServer(t)
+	a := NewAgent("", []string{srv.addr()}, time.Second)
+	get := func() *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		a.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/services", nil))
+		return res
+	}
+
+	if res := get(); res.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the services to be unavailable before the first refresh, got %d", res.Code)
+	}
+
+	srv.mu.Lock()
+	srv.services = `{"services":[{"name":"web"}]}`
+	srv.mu.Unlock()
+	a.refreshServices()
+	res := get()
+	if res.Code != http.StatusOK || res.Body.String() != srv.services || res.Header().Get("X-Cache-Stale") != "false" {
+		t.Errorf("Expected the fresh copy, got %d %v: %s", res.Code, res.Header(), res.Body)
+	}
+
+	// The cached copy is still served while the cluster is unreachable.
+	srv.mu.Lock()
+	srv.failing = true
+	srv.mu.Unlock()
+	a.refreshServices()
+	res = get()
+	if res.Code != http.StatusOK || res.Body.String() != srv.services || res.Header().Get("X-Cache-Stale") != "true" {
+		t.Errorf("Expected the stale copy, got %d %v: %s", res.Code, res.Header(), res.Body)
+	}
+}
+
+func TestLocalAPI(t *testing.T) {
+	a := NewAgent("", []string{"127.0.0.1:1"}, time.Second)
+	post := func(path, body string) int {
+		res := httptest.NewRecorder()
+		a.ServeHTTP(res, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return res.Code
+	}
+
+	tests := []struct {
+		path      string
+		body      string
+		code      int
+		instances int
+	}{
+		{"/register", `{"service":"web","host":"10.0.0.1","port":80,"check":{"tcp":"127.0.0.1:1","interval":"1h"}}`, http.StatusOK, 1},
+		{"/register", `{"service":"web","host":"10.0.0.1","port":81,"check":{}}`, http.StatusBadRequest, 1},
+		{"/heartbeat", `{"service":"api","host":"10.0.0.1","port":90}`, http.StatusOK, 2},
+		{"/heartbeat", `{"service":"api","host":"10.0.0.1","port":90}`, http.StatusOK, 2},
+		{"/deregister", `{"service":"web","host":"10.0.0.1","port":80}`, http.StatusOK, 1},
+		{"/heartbeat", `not json`, http.StatusBadRequest, 1},
+	}
+	for _, tt := range tests {
+		if code := post(tt.path, tt.body); code != tt.code {
+			t.Errorf("%s %s: expected %d, got %d", tt.path, tt.body, tt.code, code)
+		}
+		a.mu.Lock()
+		instances := len(a.instances)
+		a.mu.Unlock()
+		if instances != tt.instances {
+			t.Errorf("%s %s: expected %d instances, got %d", tt.path, tt.body, tt.instances, instances)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/chermehdi/heartbeat/server/node"
+	"github.com/hashicorp/go-hclog"
+)
+
+// LocalHeartbeatTTL is how long an instance that heartbeats to the agent is
+// kept without heartbeating again.
+var LocalHeartbeatTTL = 10 * time.Second
+
+// Registration is the message received by the agent's `/register` endpoint, the
+// agent heartbeats for the instance for as long as its health check passes.
+type Registration struct {
+	node.InstanceRegistration
+	Check Check `json:"check"`
+}
+
+// Check describes how the agent verifies that a local instance is healthy,
+// exactly one of `HTTP` (a URL that must answer with a 2xx status) or `TCP` (a
+// `host:port` that must accept connections) is expected.
+type Check struct {
+	HTTP     string `json:"http,omitempty"`
+	TCP      string `json:"tcp,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`
+}
+
+// localInstance is an instance running on the agent's host, it's either
+// health checked by the agent or heartbeats to it.
+type localInstance struct {
+	reg node.InstanceRegistration
+
+	check    Check
+	interval time.Duration
+	timeout  time.Duration
+	stopCh   chan struct{}
+
+	mu       sync.Mutex
+	passing  bool
+	lastBeat time.Time
+	ttl      time.Duration
+}
+
+func newLocalInstance(r Registration) (*localInstance, error) {
+	if (r.Check.HTTP == "") == (r.Check.TCP == "") {
+		return nil, fmt.Errorf("exactly one of the 'http' and 'tcp' checks must be set")
+	}
+	inst := &localInstance{
+		reg:      r.InstanceRegistration,
+		check:    r.Check,
+		interval: 5 * time.Second,
+		timeout:  2 * time.Second,
+		stopCh:   make(chan struct{}),
+	}
+	var err error
+	if r.Check.Interval != "" {
+		if inst.interval, err = time.ParseDuration(r.Check.Interval); err != nil || inst.interval <= 0 {
+			return nil, fmt.Errorf("invalid check interval '%s'", r.Check.Interval)
+		}
+	}
+	if r.Check.Timeout != "" {
+		if inst.timeout, err = time.ParseDuration(r.Check.Timeout); err != nil || inst.timeout <= 0 {
+			return nil, fmt.Errorf("invalid check timeout '%s'", r.Check.Timeout)
+		}
+	}
+	return inst, nil
+}
+
+func newHeartbeatInstance(r node.InstanceRegistration) *localInstance {
+	return &localInstance{
+		reg:     r,
+		passing: true,
+		ttl:     LocalHeartbeatTTL,
+	}
+}
+
+// start runs the health check until the instance is deregistered.
+func (i *localInstance) start(logger hclog.Logger) {
+	go func() {
+		for {
+			err := i.runCheck()
+			i.mu.Lock()
+			if (err == nil) != i.passing {
+				if err != nil {
+					logger.Warn("Health check is failing", "service", i.reg.ServiceName, "host", i.reg.Host, "port", i.reg.Port, "error", err)
+				} else {
+					logger.Info("Health check is passing", "service", i.reg.ServiceName, "host", i.reg.Host, "port", i.reg.Port)
+				}
+			}
+			i.passing = err == nil
+			i.mu.Unlock()
+
+			select {
+			case <-i.stopCh:
+				return
+			case <-time.After(i.interval):
+			}
+		}
+	}()
+}
+
+func (i *localInstance) stop() {
+	if i.stopCh != nil {
+		close(i.stopCh)
+	}
+}
+
+func (i *localInstance) runCheck() error {
+	if i.check.TCP != "" {
+		conn, err := net.DialTimeout("tcp", i.check.TCP, i.timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	client := http.Client{Timeout: i.timeout}
+	res, err := client.Get(i.check.HTTP)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (i *localInstance) beat() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.lastBeat = time.Now()
+}
+
+// healthy reports whether the agent should renew the instance's lease.
+func (i *localInstance) healthy() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.passing
+}
+
+// expired reports whether an instance heartbeating to the agent stopped doing
+// so, health checked instances never expire.
+func (i *localInstance) expired(now time.Time) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.ttl > 0 && now.Sub(i.lastBeat) > i.ttl
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// secretSettings are redacted by -print_config.
+var secretSettings = map[string]bool{"join_secret": true, "token": true}
+
+// invocationFlags are options of a single run of the binary rather than
+// settings of the node, they can't be set in the config file.
+var invocationFlags = map[string]bool{"config": true, "print_config": true, "transfer_leadership": true, "transfer_to": true, "promote": true, "demote": true}
+
+// configErrors collects the problems found in the configuration, so that they
+// are all reported at once.
+type configErrors []string
+
+func (e *configErrors) add(format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, args...))
+}
+
+func (e configErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Invalid configuration:\n  %s", strings.Join(e, "\n  "))
+}
+
+// envName is the environment variable overriding a setting, e.g.
+// HEARTBEAT_MIN_HEARTBEAT for min_heartbeat.
+func envName(setting string) string {
+	return "HEARTBEAT_" + strings.ToUpper(setting)
+}
+
+// loadConfig sets the settings of fs that were not given on the command line
+// from the environment, then from the config file at path if there's one. The
+// command line takes precedence over the environment, which takes precedence
+// over the file. The invocation flags are only read from the command line.
+func loadConfig(fs *flag.FlagSet, path string) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var errs configErrors
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || invocationFlags[f.Name] {
+			return
+		}
+		env := envName(f.Name)
+		if v, ok := os.LookupEnv(env); ok {
+			if err := f.Value.Set(v); err != nil {
+				errs.add("Invalid value '%s' for %s in %s: %s", v, f.Name, env, err)
+			}
+			set[f.Name] = true
+		}
+	})
+	if path == "" {
+		return errs.err()
+	}
+
+	values, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil {
+			errs.add("Unknown setting '%s' in %s", name, path)
+			continue
+		}
+		if invocationFlags[name] {
+			errs.add("The setting '%s' can't be set in %s", name, path)
+			continue
+		}
+		if set[name] {
+			continue
+		}
+		v, err := settingValue(values[name])
+		if err == nil {
+			err = f.Value.Set(v)
+		}
+		if err != nil {
+			errs.add("Invalid value for %s in %s: %s", name, path, err)
+		}
+	}
+	return errs.err()
+}
+
+// readConfigFile reads the settings of a JSON config file, an object keyed by
+// the names of the command line flags.
+func readConfigFile(path string) (map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the config file: %s", err)
+	}
+	defer f.Close()
+
+	var values map[string]interface{}
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err := dec.Decode(&values); err != nil {
+		return nil, fmt.Errorf("Could not parse the config file %s: %s", path, err)
+	}
+	return values, nil
+}
+
+// settingValue turns the JSON value of a setting into the text a flag parses,
+// lists of strings are joined with commas.
+func settingValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("expected a list of strings")
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("expected a string, a number, a boolean or a list of strings")
+}
+
+// validateConfig checks the effective configuration.
+func validateConfig() error {
+	var errs configErrors
+
+	checkPort := func(name string, port int, optional bool) {
+		if (optional && port == 0) || (port > 0 && port < 65536) {
+			return
+		}
+		errs.add("%s must be a port between 1 and 65535, got %d", name, port)
+	}
+	checkPort("port", *port, false)
+	if !*agentMode {
+		checkPort("rport", *rport, false)
+		checkPort("grpc_port", *grpcPort, true)
+		checkPort("dns_port", *dnsPort, true)
+		ports := map[int]string{}
+		for _, p := range []struct {
+			name string
+			port int
+		}{{"port", *port}, {"rport", *rport}, {"grpc_port", *grpcPort}, {"dns_port", *dnsPort}} {
+			if other, ok := ports[p.port]; ok && p.port != 0 {
+				errs.add("%s and %s can't both be %d", other, p.name, p.port)
+			}
+			ports[p.port] = p.name
+		}
+	}
+
+	if ip := net.ParseIP(*advertise); ip != nil && ip.IsUnspecified() {
+		errs.add("advertise must be an address the other nodes can reach, got '%s'", *advertise)
+	}
+	for _, a := range []struct {
+		name string
+		addr string
+	}{{"http_advertise", *httpAdvertise}, {"raft_advertise", *raftAdvertise}} {
+		if a.addr == "" {
+			continue
+		}
+		host, p, err := net.SplitHostPort(a.addr)
+		if n, perr := strconv.Atoi(p); err != nil || perr != nil || n <= 0 || n > 65535 || host == "" || net.ParseIP(host).IsUnspecified() {
+			errs.add("%s must be a host:port the other nodes can reach, got '%s'", a.name, a.addr)
+		}
+	}
+
+	for _, d := range []struct {
+		name  string
+		value int
+	}{{"cleaner_duration", *cleanerDuration}, {"min_heartbeat", *minHeartbeat}, {"lease_checkpoint", *leaseCheckpoint}, {"agent_interval", *agentInterval}} {
+		if d.value <= 0 {
+			errs.add("%s must be a positive number of seconds, got %d", d.name, d.value)
+		}
+	}
+	if *serviceRetention < 0 {
+		errs.add("service_retention can't be negative, got %d", *serviceRetention)
+	}
+	if *dnsTTL < 0 {
+		errs.add("dns_ttl can't be negative, got %d", *dnsTTL)
+	}
+	if *id == "" {
+		errs.add("id can't be empty")
+	}
+	if *storageDir == "" {
+		errs.add("sdir can't be empty")
+	}
+
+	if hclog.LevelFromString(*logLevel) == hclog.NoLevel {
+		errs.add("log_level '%s' is not one of trace, debug, info, warn or error", *logLevel)
+	}
+	if *logFormat != "text" && *logFormat != "json" {
+		errs.add("log_format '%s' is not one of text or json", *logFormat)
+	}
+	if *traceExporter != "" && *traceExporter != "file" && *traceExporter != "otlp" {
+		errs.add("trace_exporter '%s' is not one of file or otlp", *traceExporter)
+	}
+	if *traceSample < 0 || *traceSample > 1 {
+		errs.add("trace_sample must be between 0 and 1, got %g", *traceSample)
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		errs.add("tls_cert and tls_key must be set together")
+	}
+	if *tlsVerifyClients && (*tlsCert == "" || *tlsCA == "") {
+		errs.add("tls_verify_clients needs tls_cert, tls_key and tls_ca")
+	}
+	if *raftTLS && (*tlsCert == "" || *tlsCA == "") {
+		errs.add("raft_tls needs tls_cert, tls_key and tls_ca")
+	}
+	if *aclDefaultPolicy != "allow" && *aclDefaultPolicy != "deny" {
+		errs.add("acl_default_policy '%s' is not one of allow or deny", *aclDefaultPolicy)
+	}
+
+	if *bootstrapExpect < 0 {
+		errs.add("bootstrap_expect can't be negative, got %d", *bootstrapExpect)
+	}
+	if *bootstrapExpect > 1 && *join == "" && *leaderAddr == "" {
+		errs.add("bootstrap_expect needs the addresses of the other nodes in join")
+	}
+	// The addresses a node announces default to 127.0.0.1, which the nodes on
+	// other hosts can't reach.
+	if (*join != "" || *leaderAddr != "" || *bootstrapExpect > 1) && *advertise == "" && (*raftAdvertise == "" || *httpAdvertise == "") {
+		errs.add("advertise, or raft_advertise and http_advertise, must be set to join or form a cluster")
+	}
+	if *nonVoter && *join == "" && *leaderAddr == "" {
+		errs.add("non_voter needs the addresses of the members of the cluster to join in join")
+	}
+	if *nonVoter && *bootstrapExpect > 0 {
+		errs.add("non_voter can't be used with bootstrap_expect, the nodes forming the cluster are voters")
+	}
+	if *promote != "" && *demote != "" {
+		errs.add("promote and demote can't be used together")
+	}
+	if err := raftConfig().Validate(); err != nil {
+		errs.add("Invalid Raft tuning: %s", err)
+	}
+	return errs.err()
+}
+
+// printConfig writes the effective configuration as a config file, with the
+// secrets redacted.
+func printConfig(w io.Writer) error {
+	values := map[string]interface{}{}
+	flag.VisitAll(func(f *flag.Flag) {
+		if invocationFlags[f.Name] {
+			return
+		}
+		v := f.Value.(flag.Getter).Get()
+		if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		if secretSettings[f.Name] && f.Value.String() != "" {
+			v = "<redacted>"
+		}
+		values[f.Name] = v
+	})
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(values)
+}
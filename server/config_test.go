@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testFlags is a flag set with a few settings and invocation flags, parsed
+// from args.
+func testFlags(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int("port", 9000, "")
+	fs.String("id", "node-1", "")
+	fs.String("join", "", "")
+	fs.Int("min_heartbeat", 20, "")
+	fs.Bool("transfer_leadership", false, "")
+	fs.String("promote", "", "")
+	fs.String("config", "", "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("Could not parse %v: %s", args, err)
+	}
+	return fs
+}
+
+// testConfigFile writes a config file removed at the end of the test.
+func testConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "heartbeat-config")
+	if err != nil {
+		t.Fatalf("Could not create the config file: %s", err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatalf("Could not write the config file: %s", err)
+	}
+	f.Close()
+	return f.Name()
+}
+
+// setenv sets environment variables until the end of the test.
+func setenv(t *testing.T, vars map[string]string) {
+	for k, v := range vars {
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatalf("Could not set %s: %s", k, err)
+		}
+		k := k
+		t.Cleanup(func() { os.Unsetenv(k) })
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := testConfigFile(t, `{"port": 7000, "id": "file", "join": ["10.0.0.1:9000", "10.0.0.2:9000"], "min_heartbeat": 30}`)
+	setenv(t, map[string]string{"HEARTBEAT_PORT": "8000", "HEARTBEAT_ID": "env"})
+	fs := testFlags(t, "-port", "6000")
+
+	if err := loadConfig(fs, path); err != nil {
+		t.Fatalf("Could not load the config: %s", err)
+	}
+	expected := map[string]string{
+		// The command line wins over the environment and the file.
+		"port": "6000",
+		// The environment wins over the file.
+		"id":            "env",
+		"join":          "10.0.0.1:9000,10.0.0.2:9000",
+		"min_heartbeat": "30",
+	}
+	for name, v := range expected {
+		if got := fs.Lookup(name).Value.String(); got != v {
+			t.Errorf("Expected %s to be '%s', got '%s'", name, v, got)
+		}
+	}
+}
+
+func TestLoadConfigInvocationFlags(t *testing.T) {
+	// A server started with these in its environment must not turn into a
+	// single command.
+	setenv(t, map[string]string{
+		"HEARTBEAT_TRANSFER_LEADERSHIP": "true",
+		"HEARTBEAT_PROMOTE":             "node-2",
+		"HEARTBEAT_CONFIG":              "/does/not/exist.json",
+	})
+	fs := testFlags(t)
+	if err := loadConfig(fs, ""); err != nil {
+		t.Fatalf("Could not load the config: %s", err)
+	}
+	for _, name := range []string{"transfer_leadership", "promote", "config"} {
+		if f := fs.Lookup(name); f.Value.String() != f.DefValue {
+			t.Errorf("Expected %s to be ignored in the environment, got '%s'", name, f.Value)
+		}
+	}
+
+	path := testConfigFile(t, `{"promote": "node-2"}`)
+	if err := loadConfig(testFlags(t), path); err == nil || !strings.Contains(err.Error(), "'promote' can't be set") {
+		t.Errorf("Expected promote to be rejected in the config file, got %v", err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	setenv(t, map[string]string{"HEARTBEAT_PORT": "not-a-port"})
+	path := testConfigFile(t, `{"unknown": 1, "min_heartbeat": [1]}`)
+	err := loadConfig(testFlags(t), path)
+	if err == nil {
+		t.Fatalf("Expected the config to be rejected")
+	}
+	// Every problem is reported at once.
+	for _, part := range []string{"HEARTBEAT_PORT", "Unknown setting 'unknown'", "Invalid value for min_heartbeat"} {
+		if !strings.Contains(err.Error(), part) {
+			t.Errorf("Expected the error to mention '%s', got %s", part, err)
+		}
+	}
+}
+
+func TestValidateAdvertise(t *testing.T) {
+	prev := [3]string{*advertise, *httpAdvertise, *raftAdvertise}
+	defer func() { *advertise, *httpAdvertise, *raftAdvertise = prev[0], prev[1], prev[2] }()
+
+	tests := []struct {
+		advertise string
+		http      string
+		raft      string
+		valid     bool
+	}{
+		{"", "", "", true},
+		{"10.0.0.1", "", "", true},
+		{"node-1.example.com", "lb.example.com:443", "10.0.0.1:9999", true},
+		{"0.0.0.0", "", "", false},
+		{"::", "", "", false},
+		{"", "10.0.0.1", "", false},
+		{"", ":9000", "", false},
+		{"", "0.0.0.0:9000", "", false},
+		{"", "", "10.0.0.1:0", false},
+		{"", "", "10.0.0.1:70000", false},
+		{"", "", "10.0.0.1:raft", false},
+	}
+	for _, tt := range tests {
+		*advertise, *httpAdvertise, *raftAdvertise = tt.advertise, tt.http, tt.raft
+		err := validateConfig()
+		if tt.valid && err != nil {
+			t.Errorf("advertise=%q http_advertise=%q raft_advertise=%q: expected the config to be accepted, got %s", tt.advertise, tt.http, tt.raft, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("advertise=%q http_advertise=%q raft_advertise=%q: expected the config to be rejected", tt.advertise, tt.http, tt.raft)
+		}
+	}
+}
@@ -2,4 +2,12 @@ module github.com/chermehdi/heartbeat/server
 
 go 1.14
 
-require github.com/hashicorp/raft v1.2.0
+require (
+	github.com/golang/protobuf v1.4.2
+	github.com/hashicorp/go-hclog v0.9.1
+	github.com/hashicorp/raft v1.2.0
+	github.com/miekg/dns v1.1.29
+	github.com/prometheus/client_golang v1.7.1
+	google.golang.org/grpc v1.36.0
+	google.golang.org/protobuf v1.25.0
+)
@@ -1,65 +1,344 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
-	"net/http"
+	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/chermehdi/heartbeat/server/agent"
 	"github.com/chermehdi/heartbeat/server/node"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
 )
 
+var raftDefaults = raft.DefaultConfig()
+
 var (
-	port            = flag.Int("port", 9000, "Port used by the client to connect")
-	rport           = flag.Int("rport", 9999, "Port used by the underlying Raft protocol")
-	leaderAddr      = flag.String("leader", "", "The leader's join address, if this node is the leader when bootstrapping the cluster, this should be empty")
-	storageDir      = flag.String("sdir", "/tmp/heartbeat/data", "A path to the storage directory")
-	cleanerDuration = flag.Int("cleaner_duration", 10, "The cleaner process duration in seconds")
-	minHeartbeat    = flag.Int("min_heartbeat", 20, "The minimum duration to keep an instance after it's last heartbeat before removing it from the registry")
-	id              = flag.String("id", "node-1", "Node identifier")
+	configFile       = flag.String("config", "", "Path of a JSON config file, an object keyed by the names of these flags, the flags and HEARTBEAT_<NAME> environment variables take precedence over it")
+	showConfig       = flag.Bool("print_config", false, "Print the effective configuration as JSON, with the secrets redacted, and exit")
+	transferLeader   = flag.Bool("transfer_leadership", false, "Ask the leader of the cluster at -servers to hand the leadership over, to -transfer_to if it's set, and exit")
+	transferTo       = flag.String("transfer_to", "", "The ID of the member -transfer_leadership hands the leadership to, the most up to date voter if it's empty")
+	promote          = flag.String("promote", "", "Ask the leader of the cluster at -servers to promote the non-voter with this ID to a voter, and exit")
+	demote           = flag.String("demote", "", "Ask the leader of the cluster at -servers to demote the voter with this ID to a non-voter, and exit")
+	port             = flag.Int("port", 9000, "Port used by the client to connect")
+	rport            = flag.Int("rport", 9999, "Port used by the underlying Raft protocol")
+	leaderAddr       = flag.String("leader", "", "Deprecated, same as -join with a single address")
+	join             = flag.String("join", "", "Comma separated list of HTTP addresses of members of the cluster to join, the join is retried until it succeeds, if this node bootstraps the cluster this should be empty")
+	advertise        = flag.String("advertise", "", "The host or IP the other nodes reach this node at, the Raft transport listens on it unless raft_bind is set, defaults to 127.0.0.1, it must be set to join or form a cluster")
+	bind             = flag.String("bind", "", "The host or IP the HTTP, gRPC and DNS listeners bind on, all the interfaces if it's empty")
+	raftBind         = flag.String("raft_bind", "", "The host or IP the Raft transport listens on, when it's not the advertised one (e.g. 0.0.0.0 behind a NAT)")
+	httpAdvertise    = flag.String("http_advertise", "", "The address (host:port) the other nodes reach the HTTP API at, defaults to the advertise host and port")
+	raftAdvertise    = flag.String("raft_advertise", "", "The address (host:port) the other nodes reach the Raft transport at, defaults to the advertise host and rport")
+	storageDir       = flag.String("sdir", "/tmp/heartbeat/data", "A path to the storage directory")
+	cleanerDuration  = flag.Int("cleaner_duration", 10, "The cleaner process duration in seconds")
+	minHeartbeat     = flag.Int("min_heartbeat", 20, "The minimum duration to keep an instance after it's last heartbeat before removing it from the registry")
+	id               = flag.String("id", "node-1", "Node identifier")
+	leaseCheckpoint  = flag.Int("lease_checkpoint", 30, "The duration in seconds between two replications of the lease renewals tracked by the leader")
+	agentMode        = flag.Bool("agent", false, "Run as a node-local agent that heartbeats to the cluster on behalf of the local instances, instead of as a cluster node")
+	servers          = flag.String("servers", "127.0.0.1:9000", "Comma separated list of the cluster's http addresses, used in agent mode and by -transfer_leadership, -promote and -demote")
+	agentInterval    = flag.Int("agent_interval", 2, "The duration in seconds between two batch heartbeats of the agent")
+	serviceRetention = flag.Int("service_retention", 0, "The duration in seconds to keep a service that has no instances left before removing it from the registry, persistent services are never removed")
+	grpcPort         = flag.Int("grpc_port", 0, "Port of the gRPC API, the gRPC API is disabled if it's 0")
+	dnsPort          = flag.Int("dns_port", 0, "Port of the DNS interface (udp and tcp), the DNS interface is disabled if it's 0")
+	dnsDomain        = flag.String("dns_domain", "heartbeat.", "The domain answered by the DNS interface, services are resolved as '<service>.service.<domain>'")
+	dnsTTL           = flag.Int("dns_ttl", 0, "The time to live in seconds of the DNS records")
+	dnsAllowStale    = flag.Bool("dns_allow_stale", true, "Let the followers answer DNS queries from their local copy of the registry")
+	dnsOnlyPassing   = flag.Bool("dns_only_passing", true, "Only return the instances that did not miss their heartbeats in DNS answers")
+	logLevel         = flag.String("log_level", "info", "The minimum level of the logged lines: trace, debug, info, warn or error")
+	logFormat        = flag.String("log_format", "text", "The format of the logs: text (key=value fields) or json")
+	traceExporter    = flag.String("trace_exporter", "", "Where to export the trace spans of the write paths: file or otlp, tracing is disabled if it's empty")
+	traceFile        = flag.String("trace_file", "/tmp/heartbeat/spans.json", "The file the spans are appended to with the file exporter")
+	traceEndpoint    = flag.String("trace_endpoint", "http://127.0.0.1:4318/v1/traces", "The OTLP/HTTP traces endpoint of the collector used by the otlp exporter")
+	tlsCert          = flag.String("tls_cert", "", "PEM certificate of the node, the HTTP and gRPC APIs are served over TLS if it's set")
+	tlsKey           = flag.String("tls_key", "", "PEM private key of the node's certificate")
+	tlsCA            = flag.String("tls_ca", "", "PEM certificate of the CA that signed the certificates of the clients and nodes")
+	tlsVerifyClients = flag.Bool("tls_verify_clients", false, "Require the clients of the HTTP and gRPC APIs to present a certificate signed by the CA")
+	raftTLS          = flag.Bool("raft_tls", false, "Encrypt the Raft traffic with mutual TLS, the nodes authenticate each other with their certificates signed by the CA")
+	aclEnabled       = flag.Bool("acl_enabled", false, "Enforce the ACL tokens on the HTTP, gRPC and DNS APIs")
+	aclDefaultPolicy = flag.String("acl_default_policy", "allow", "The policy applied to the requests without a token and to what the rules of a token don't cover: allow or deny")
+	joinSecret       = flag.String("join_secret", "", "The secret shared by the members of the cluster to sign the join requests, joins are not authenticated if it's empty")
+	joinForce        = flag.Bool("join_force", false, "Replace the members of the cluster already using this node's ID or Raft address when joining")
+	nonVoter         = flag.Bool("non_voter", false, "Join the cluster as a non-voting read replica, it receives the replicated state and serves stale reads without being part of the quorum")
+	bootstrapExpect  = flag.Int("bootstrap_expect", 0, "Form a new cluster once this number of nodes, reachable through -join, are started with the same value, instead of bootstrapping alone or joining")
+	token            = flag.String("token", "", "The ACL token sent when joining the cluster, or by the agent to the servers")
+	traceSample      = flag.Float64("trace_sample", 1, "The ratio of the traces started by this node that are recorded, traces continued from a client's traceparent follow its sampling decision")
+
+	raftHeartbeatTimeout   = flag.Duration("raft_heartbeat_timeout", raftDefaults.HeartbeatTimeout, "How long a follower goes without hearing from the leader before starting an election")
+	raftElectionTimeout    = flag.Duration("raft_election_timeout", raftDefaults.ElectionTimeout, "How long a candidate goes without a leader before starting an election, at least raft_heartbeat_timeout")
+	raftCommitTimeout      = flag.Duration("raft_commit_timeout", raftDefaults.CommitTimeout, "How long the leader goes without an append entries RPC before sending a heartbeat to the followers")
+	raftLeaderLeaseTimeout = flag.Duration("raft_leader_lease_timeout", raftDefaults.LeaderLeaseTimeout, "How long the leader stays leader without reaching a quorum, at most raft_heartbeat_timeout")
+	raftSnapshotInterval   = flag.Duration("raft_snapshot_interval", raftDefaults.SnapshotInterval, "How often the node checks whether it should snapshot its state")
+	raftSnapshotThreshold  = flag.Uint64("raft_snapshot_threshold", raftDefaults.SnapshotThreshold, "The number of new log entries that triggers a snapshot")
+	raftTrailingLogs       = flag.Uint64("raft_trailing_logs", raftDefaults.TrailingLogs, "The number of log entries kept after a snapshot, so that a slow follower can catch up without the snapshot")
+	raftMaxAppendEntries   = flag.Int("raft_max_append_entries", raftDefaults.MaxAppendEntries, "The maximum number of log entries sent in a single append entries RPC, at most 1024")
+	raftMaxPool            = flag.Int("raft_max_pool", 5, "The number of connections to each peer the Raft transport keeps open")
+	raftTransportTimeout   = flag.Duration("raft_transport_timeout", 20*time.Second, "The timeout of the Raft transport's I/O, snapshots included")
 )
 
+var logger hclog.Logger
+
 func main() {
 	flag.Parse()
-	log.SetOutput(os.Stderr)
+	if err := loadConfig(flag.CommandLine, *configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := validateConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *showConfig {
+		if err := printConfig(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	root, err := node.NewLogger(os.Stderr, *logLevel, *logFormat, *id)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	node.Logger = root
+	logger = node.ComponentLogger("main")
+	// Libraries using the standard logger end up in the same sink.
+	log.SetOutput(root.StandardWriter(&hclog.StandardLoggerOptions{InferLevels: true}))
+	log.SetFlags(0)
+
+	switch *traceExporter {
+	case "":
+	case "file":
+		exporter, err := node.NewFileExporter(*traceFile)
+		if err != nil {
+			fatal("Could not open the spans file", err)
+		}
+		node.Tracer = node.NewTracer(exporter, *traceSample)
+	case "otlp":
+		node.Tracer = node.NewTracer(node.NewOTLPExporter(*traceEndpoint, *id), *traceSample)
+	}
+
+	var certs *node.Certificates
+	if *tlsCert != "" {
+		certs, err = node.NewCertificates(node.TLSConfig{
+			CertFile:      *tlsCert,
+			KeyFile:       *tlsKey,
+			CAFile:        *tlsCA,
+			VerifyClients: *tlsVerifyClients,
+		})
+		if err != nil {
+			fatal("Could not load the TLS certificates", err)
+		}
+		certs.ReloadOnSignal(syscall.SIGHUP)
+	}
 
-	log.Printf("Starting the server at '127.0.0.1:%d' with id='%s'", *port, *id)
+	if *agentMode {
+		runAgent(certs)
+		return
+	}
+	if *transferLeader {
+		runTransferLeadership(certs)
+		return
+	}
+	if *promote != "" || *demote != "" {
+		runSuffrageChange(certs)
+		return
+	}
+
+	logger.Info("Starting the server", "addr", net.JoinHostPort(*bind, strconv.Itoa(*port)))
+
+	seeds := splitList(*join)
+	if *leaderAddr != "" {
+		seeds = append(seeds, *leaderAddr)
+	}
+	host := *advertise
+	if host == "" {
+		host = "127.0.0.1"
+	}
 
 	os.Mkdir(*storageDir, 0775)
 
+	raftAddr, httpAddr := *raftAdvertise, *httpAdvertise
+	if raftAddr == "" {
+		raftAddr = net.JoinHostPort(host, strconv.Itoa(*rport))
+	}
+	if httpAddr == "" {
+		httpAddr = net.JoinHostPort(host, strconv.Itoa(*port))
+	}
+
 	storage := node.NewInMemStore()
-	nd := node.NewNode(*id, *storageDir, fmt.Sprintf("127.0.0.1:%d", *rport), storage)
+	nd := node.NewNode(*id, *storageDir, raftAddr, storage)
+	nd.HttpAddr = httpAddr
+	if *raftBind != "" {
+		nd.RaftBindAddr = net.JoinHostPort(*raftBind, strconv.Itoa(*rport))
+	}
 
 	storage.Node = nd
+	if *raftTLS {
+		nd.RaftTLS = certs
+	}
+	nd.ACL = node.ACLConfig{Enabled: *aclEnabled, DefaultPolicy: *aclDefaultPolicy}
+	nd.JoinSecret = *joinSecret
+	nd.RaftConfig = raftConfig()
+	node.RegisterMetrics(nd)
 
-	httpServer := node.NewServer(fmt.Sprintf(":%d", *port), nd)
+	httpServer := node.NewServer(net.JoinHostPort(*bind, strconv.Itoa(*port)), nd)
+	httpServer.TLS = certs
 
-	if err := nd.Bootstrap(*leaderAddr == ""); err != nil {
-		log.Fatalf("Bootrapping finished with errors: %s", err)
+	if err := nd.Bootstrap(len(seeds) == 0 || *bootstrapExpect == 1); err != nil {
+		fatal("Bootrapping finished with errors", err)
 	}
 
 	if err := httpServer.Start(); err != nil {
-		log.Fatalf("Could not start the http server: %s", err)
+		fatal("Could not start the http server", err)
 	}
 
-	if *leaderAddr != "" {
-		b, err := json.Marshal(node.JoinRequest{Id: *id, Addr: fmt.Sprintf(":%d", *rport)})
-		if err != nil {
-			log.Fatalf("Could not marshal join request: %s", err)
+	if *grpcPort != 0 {
+		grpcServer := node.NewGrpcServer(net.JoinHostPort(*bind, strconv.Itoa(*grpcPort)), nd)
+		grpcServer.TLS = certs
+		if err := grpcServer.Start(); err != nil {
+			fatal("Could not start the gRPC server", err)
 		}
-		res, err := http.Post(fmt.Sprintf("http://%s/join", *leaderAddr), "application/json", bytes.NewReader(b))
-		if err != nil {
-			log.Fatalf("Failed to join the leader: %s", err)
+	}
+
+	if *dnsPort != 0 {
+		dnsServer := node.NewDNSServer(node.DNSConfig{
+			Addr:            net.JoinHostPort(*bind, strconv.Itoa(*dnsPort)),
+			Domain:          *dnsDomain,
+			TTL:             time.Duration(int64(*dnsTTL) * int64(1e9)),
+			AllowStale:      *dnsAllowStale,
+			OnlyPassing:     *dnsOnlyPassing,
+			HealthThreshold: time.Duration(int64(*minHeartbeat) * int64(1e9)),
+		}, nd)
+		if err := dnsServer.Start(); err != nil {
+			fatal("Could not start the DNS server", err)
 		}
-		res.Body.Close()
 	}
 
-	cleaner := node.NewCleaner(time.Duration(int64(*cleanerDuration)*int64(1e9)), time.Duration(int64(*minHeartbeat)*int64(1e9)), nd)
+	if len(seeds) > 0 && *bootstrapExpect != 1 {
+		config := node.JoinConfig{
+			Seeds: seeds,
+			Request: node.JoinRequest{
+				Id:       *id,
+				Addr:     raftAddr,
+				HttpAddr: httpAddr,
+				Force:    *joinForce,
+				NonVoter: *nonVoter,
+			},
+			Secret: *joinSecret,
+			Token:  *token,
+		}
+		if certs != nil {
+			config.TLS = certs.ClientTLS()
+		}
+		if *bootstrapExpect > 1 {
+			if err := nd.BootstrapExpect(*bootstrapExpect, config); err != nil {
+				fatal("Failed to form the cluster", err)
+			}
+		} else if err := node.JoinCluster(config); err != nil {
+			fatal("Failed to join the cluster", err)
+		}
+	}
+
+	node.LeaseCheckpointInterval = time.Duration(int64(*leaseCheckpoint) * int64(1e9))
+	cleaner := node.NewCleaner(time.Duration(int64(*cleanerDuration)*int64(1e9)), time.Duration(int64(*minHeartbeat)*int64(1e9)), time.Duration(int64(*serviceRetention)*int64(1e9)), nd)
 	go cleaner.Start()
 
-	time.Sleep(300 * time.Second)
+	sig := waitForShutdown()
+	logger.Info("Shutting down", "signal", sig)
+	cleaner.Stop()
+}
+
+// waitForShutdown blocks until the process is asked to stop with SIGINT or
+// SIGTERM, and returns the signal.
+func waitForShutdown() os.Signal {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	return <-sig
+}
+
+// splitList splits a comma separated list, leaving out the empty items.
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// raftConfig returns the Raft tuning of the configuration.
+func raftConfig() node.RaftConfig {
+	return node.RaftConfig{
+		HeartbeatTimeout:   *raftHeartbeatTimeout,
+		ElectionTimeout:    *raftElectionTimeout,
+		CommitTimeout:      *raftCommitTimeout,
+		LeaderLeaseTimeout: *raftLeaderLeaseTimeout,
+		SnapshotInterval:   *raftSnapshotInterval,
+		SnapshotThreshold:  *raftSnapshotThreshold,
+		TrailingLogs:       *raftTrailingLogs,
+		MaxAppendEntries:   *raftMaxAppendEntries,
+		MaxPool:            *raftMaxPool,
+		TransportTimeout:   *raftTransportTimeout,
+	}
+}
+
+func runAgent(certs *node.Certificates) {
+	logger.Info("Starting the agent", "addr", fmt.Sprintf("127.0.0.1:%d", *port))
+
+	a := agent.NewAgent(fmt.Sprintf("127.0.0.1:%d", *port), strings.Split(*servers, ","), time.Duration(int64(*agentInterval)*int64(1e9)))
+	if certs != nil {
+		a.UseTLS(certs.ClientTLS())
+	}
+	if *token != "" {
+		a.UseToken(*token)
+	}
+	if err := a.Start(); err != nil {
+		fatal("Could not start the agent", err)
+	}
+
+	sig := waitForShutdown()
+	logger.Info("Shutting down the agent", "signal", sig)
+	a.Shutdown()
+}
+
+func runTransferLeadership(certs *node.Certificates) {
+	var tlsConfig *tls.Config
+	if certs != nil {
+		tlsConfig = certs.ClientTLS()
+	}
+	leader, err := node.RequestLeadershipTransfer(splitList(*servers), *transferTo, *token, tlsConfig)
+	if err != nil {
+		fatal("Could not transfer the leadership", err)
+	}
+	logger.Info("Transferred the leadership", "leader", leader.ID, "raft_addr", leader.RaftAddr, "http_addr", leader.HttpAddr)
+}
+
+func runSuffrageChange(certs *node.Certificates) {
+	var tlsConfig *tls.Config
+	if certs != nil {
+		tlsConfig = certs.ClientTLS()
+	}
+	id, voter := *promote, true
+	if *demote != "" {
+		id, voter = *demote, false
+	}
+	if err := node.RequestSuffrageChange(splitList(*servers), id, voter, *token, tlsConfig); err != nil {
+		fatal("Could not change the suffrage of the member", err)
+	}
+	logger.Info("Changed the suffrage of the member", "member", id, "voter", voter)
+}
+
+func fatal(msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
 }
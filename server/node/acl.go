@@ -0,0 +1,461 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ACLConfig turns the enforcement of the ACLs on, `DefaultPolicy` (`allow` or
+// `deny`) is applied to the requests without a token and to what the rules of
+// a token don't cover.
+type ACLConfig struct {
+	Enabled       bool
+	DefaultPolicy string
+}
+
+// ErrACLNotFound is returned when a request carries a token that doesn't exist.
+var ErrACLNotFound = errors.New("ACL token not found")
+
+// Authorizer tells what the holder of a token is allowed to do.
+type Authorizer struct {
+	// policy is nil when the ACLs are disabled, everything is allowed then.
+	policy       *ACLPolicy
+	defaultAllow bool
+}
+
+var allowAll = &Authorizer{}
+
+// Authorize resolves the secret ID sent with a request, an empty secret gets
+// the default policy.
+func (n *Node) Authorize(secret string) (*Authorizer, error) {
+	if !n.ACL.Enabled {
+		return allowAll, nil
+	}
+	a := &Authorizer{policy: &ACLPolicy{}, defaultAllow: n.ACL.DefaultPolicy != ACLDeny}
+	if secret == "" {
+		return a, nil
+	}
+	token, ok := n.store.ResolveACLToken(secret)
+	if !ok {
+		return nil, ErrACLNotFound
+	}
+	a.policy = &token.Policy
+	return a, nil
+}
+
+// access returns the access level of the rule with the longest prefix of
+// `name`, or of the default policy if none matches.
+func (a *Authorizer) access(rules []ACLRule, name string) string {
+	best := -1
+	access := ACLDeny
+	if a.defaultAllow {
+		access = ACLWrite
+	}
+	for _, r := range rules {
+		if strings.HasPrefix(name, r.Prefix) && len(r.Prefix) > best {
+			best = len(r.Prefix)
+			access = r.Access
+		}
+	}
+	return access
+}
+
+func (a *Authorizer) scalar(access string) string {
+	if access != "" {
+		return access
+	}
+	if a.defaultAllow {
+		return ACLWrite
+	}
+	return ACLDeny
+}
+
+func canRead(access string) bool {
+	return access == ACLRead || access == ACLWrite
+}
+
+// Management reports whether the token can manage the ACL tokens.
+func (a *Authorizer) Management() bool {
+	return a.policy == nil || a.policy.Management
+}
+
+func (a *Authorizer) ServiceRead(name string) bool {
+	return a.Management() || canRead(a.access(a.policy.Services, name))
+}
+
+func (a *Authorizer) ServiceWrite(name string) bool {
+	return a.Management() || a.access(a.policy.Services, name) == ACLWrite
+}
+
+func (a *Authorizer) KeyRead(key string) bool {
+	return a.Management() || canRead(a.access(a.policy.Keys, key))
+}
+
+func (a *Authorizer) KeyWrite(key string) bool {
+	return a.Management() || a.access(a.policy.Keys, key) == ACLWrite
+}
+
+// KeyWritePrefix reports whether every key under the prefix can be written.
+func (a *Authorizer) KeyWritePrefix(prefix string) bool {
+	if a.Management() {
+		return true
+	}
+	if !a.KeyWrite(prefix) {
+		return false
+	}
+	for _, r := range a.policy.Keys {
+		if strings.HasPrefix(r.Prefix, prefix) && r.Access != ACLWrite {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *Authorizer) SessionRead() bool {
+	return a.Management() || canRead(a.scalar(a.policy.Session))
+}
+
+func (a *Authorizer) SessionWrite() bool {
+	return a.Management() || a.scalar(a.policy.Session) == ACLWrite
+}
+
+func (a *Authorizer) OperatorRead() bool {
+	return a.Management() || canRead(a.scalar(a.policy.Operator))
+}
+
+func (a *Authorizer) OperatorWrite() bool {
+	return a.Management() || a.scalar(a.policy.Operator) == ACLWrite
+}
+
+// TxnOp reports whether the transaction operation is allowed, reading verbs
+// need to read the key, the others to write it.
+func (a *Authorizer) TxnOp(op TxnOp) bool {
+	switch op.Verb {
+	case TxnGet, TxnCheckIndex:
+		return a.KeyRead(op.Key)
+	case TxnDeletePrefix:
+		return a.KeyWritePrefix(op.Key)
+	default:
+		return a.KeyWrite(op.Key)
+	}
+}
+
+// FilterServices drops the services the token can't read.
+func (a *Authorizer) FilterServices(services []Service) []Service {
+	if a.Management() {
+		return services
+	}
+	res := make([]Service, 0, len(services))
+	for _, svc := range services {
+		if a.ServiceRead(svc.Name) {
+			res = append(res, svc)
+		}
+	}
+	return res
+}
+
+// FilterEvents drops the events of the services the token can't read.
+func (a *Authorizer) FilterEvents(events []ServiceEvent) []ServiceEvent {
+	if a.Management() {
+		return events
+	}
+	res := make([]ServiceEvent, 0, len(events))
+	for _, ev := range events {
+		if a.ServiceRead(ev.Service) {
+			res = append(res, ev)
+		}
+	}
+	return res
+}
+
+// FilterEntries drops the keys the token can't read.
+func (a *Authorizer) FilterEntries(entries []KVEntry) []KVEntry {
+	if a.Management() {
+		return entries
+	}
+	res := make([]KVEntry, 0, len(entries))
+	for _, e := range entries {
+		if a.KeyRead(e.Key) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+func validateACLPolicy(p ACLPolicy) error {
+	valid := func(access string) bool {
+		return access == ACLDeny || access == ACLRead || access == ACLWrite
+	}
+	for _, rules := range [][]ACLRule{p.Services, p.Keys} {
+		for _, r := range rules {
+			if !valid(r.Access) {
+				return fmt.Errorf("Invalid access '%s' for prefix '%s'", r.Access, r.Prefix)
+			}
+		}
+	}
+	for _, access := range []string{p.Session, p.Operator} {
+		if access != "" && !valid(access) {
+			return fmt.Errorf("Invalid access '%s'", access)
+		}
+	}
+	return nil
+}
+
+func (s *inMemStore) BootstrapACL() (*ACLToken, error) {
+	return s.applyACLCommand("ABOOT", ACLToken{
+		Description: "Bootstrap management token",
+		Policy:      ACLPolicy{Management: true},
+	})
+}
+
+func (s *inMemStore) CreateACLToken(token ACLToken) (*ACLToken, error) {
+	if err := validateACLPolicy(token.Policy); err != nil {
+		return nil, err
+	}
+	return s.applyACLCommand("ACREATE", token)
+}
+
+// applyACLCommand replicates the creation of the token, the identifiers are
+// chosen by the leader so that every replica stores the same token.
+func (s *inMemStore) applyACLCommand(typ string, token ACLToken) (*ACLToken, error) {
+	var err error
+	if token.AccessorID, err = newSessionID(); err != nil {
+		return nil, err
+	}
+	if token.SecretID, err = newSessionID(); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(token); err != nil {
+		return nil, err
+	}
+	resp, err := applyCommand(&Command{Type: typ, Value: b.String()}, s.Node.raft)
+	if err != nil {
+		return nil, err
+	}
+	switch r := resp.(type) {
+	case *ACLToken:
+		return r, nil
+	case error:
+		return nil, r
+	default:
+		return nil, fmt.Errorf("Unexpected ACL response %v", resp)
+	}
+}
+
+func (s *inMemStore) DeleteACLToken(accessor string) error {
+	resp, err := applyCommand(&Command{Type: "ADELETE", Key: accessor}, s.Node.raft)
+	if err != nil {
+		return err
+	}
+	if err, ok := resp.(error); ok {
+		return err
+	}
+	return nil
+}
+
+func (s *inMemStore) ResolveACLToken(secret string) (*ACLToken, bool) {
+	s.ma.Lock()
+	defer s.ma.Unlock()
+	token, ok := s.acl[secret]
+	if !ok {
+		return nil, false
+	}
+	cp := *token
+	return &cp, true
+}
+
+func (s *inMemStore) GetACLTokens() []ACLToken {
+	s.ma.Lock()
+	defer s.ma.Unlock()
+	tokens := make([]ACLToken, 0, len(s.acl))
+	for _, t := range s.acl {
+		cp := *t
+		cp.SecretID = ""
+		tokens = append(tokens, cp)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreateIndex < tokens[j].CreateIndex })
+	return tokens
+}
+
+func (s *inMemStore) execACLCreate(index uint64, value string, bootstrap bool) interface{} {
+	var token ACLToken
+	if err := json.NewDecoder(bytes.NewReader([]byte(value))).Decode(&token); err != nil {
+		s.logger.Error("Failed executing an ACL token create request", "error", err)
+		return err
+	}
+
+	s.ma.Lock()
+	defer s.ma.Unlock()
+	if bootstrap {
+		if s.aclBootstrapped {
+			return fmt.Errorf("The ACLs were already bootstrapped")
+		}
+		s.aclBootstrapped = true
+	}
+	token.CreateIndex = index
+	s.acl[token.SecretID] = &token
+	s.logger.Info("Created ACL token", "accessor", token.AccessorID, "bootstrap", bootstrap)
+
+	cp := token
+	return &cp
+}
+
+func (s *inMemStore) execACLDelete(accessor string) interface{} {
+	s.ma.Lock()
+	defer s.ma.Unlock()
+	for secret, t := range s.acl {
+		if t.AccessorID == accessor {
+			delete(s.acl, secret)
+			s.logger.Info("Deleted ACL token", "accessor", accessor)
+			return nil
+		}
+	}
+	return fmt.Errorf("ACL token '%s' does not exist", accessor)
+}
+
+// aclToken returns the secret ID sent with the request, either in the
+// `X-Heartbeat-Token` header or as a bearer token.
+func aclToken(req *http.Request) string {
+	if token := req.Header.Get("X-Heartbeat-Token"); token != "" {
+		return token
+	}
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+}
+
+// authorize resolves the token of the request, the error response is written
+// and nil returned if the token is unknown.
+func (s *HttpServer) authorize(req *http.Request, res http.ResponseWriter) *Authorizer {
+	authz, err := s.node.Authorize(aclToken(req))
+	if err != nil {
+		s.log(req).Warn("Rejecting a request", "error", err)
+		res.WriteHeader(http.StatusForbidden)
+		res.Write([]byte(err.Error()))
+		return nil
+	}
+	return authz
+}
+
+// forbidden rejects a request its token doesn't allow.
+func (s *HttpServer) forbidden(req *http.Request, res http.ResponseWriter) {
+	s.log(req).Warn("Permission denied", "method", req.Method, "path", req.URL.Path)
+	res.WriteHeader(http.StatusForbidden)
+	res.Write([]byte("Permission denied"))
+}
+
+// handleACL serves the ACL endpoints:
+//   - `PUT /acl/bootstrap` creates the initial management token, only once.
+//   - `PUT /acl/token` with an `ACLToken` body (description and policy).
+//   - `GET /acl/token/self` returns the token of the request.
+//   - `GET` and `DELETE /acl/token/<accessor id>`.
+//   - `GET /acl/tokens`, without the secrets.
+func (s *HttpServer) handleACL(req *http.Request, res http.ResponseWriter) {
+	path := strings.TrimPrefix(req.URL.Path, "/acl/")
+	if !s.node.ACL.Enabled {
+		res.WriteHeader(http.StatusNotFound)
+		res.Write([]byte("The ACLs are disabled"))
+		return
+	}
+
+	if path == "bootstrap" {
+		if req.Method != http.MethodPut && req.Method != http.MethodPost {
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		token, err := s.node.store.BootstrapACL()
+		if err != nil {
+			s.log(req).Error("ACL bootstrap failed", "error", err)
+			if errors.Is(err, ErrNotLeader) {
+				s.writeError(req, res, err)
+				return
+			}
+			res.WriteHeader(http.StatusForbidden)
+			res.Write([]byte(fmt.Sprintf("Server error occured: %s", err)))
+			return
+		}
+		s.log(req).Info("Bootstrapped the ACLs", "accessor", token.AccessorID)
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(token)
+		return
+	}
+
+	authz := s.authorize(req, res)
+	if authz == nil {
+		return
+	}
+	if path == "token/self" && req.Method == http.MethodGet {
+		token, _ := s.node.store.ResolveACLToken(aclToken(req))
+		if token == nil {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(token)
+		return
+	}
+	if !authz.Management() {
+		s.forbidden(req, res)
+		return
+	}
+
+	switch {
+	case path == "tokens" && req.Method == http.MethodGet:
+		if !s.verifyRead(req, res) {
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(s.node.store.GetACLTokens())
+	case path == "token" && (req.Method == http.MethodPut || req.Method == http.MethodPost):
+		var t ACLToken
+		if err := json.NewDecoder(req.Body).Decode(&t); err != nil {
+			s.log(req).Warn("Could not parse ACL token request", "error", err)
+			s.badRequest(res)
+			return
+		}
+		if err := validateACLPolicy(t.Policy); err != nil {
+			res.WriteHeader(http.StatusBadRequest)
+			res.Write([]byte(err.Error()))
+			return
+		}
+		token, err := s.node.store.CreateACLToken(ACLToken{Description: t.Description, Policy: t.Policy})
+		if err != nil {
+			s.log(req).Error("Could not create the ACL token", "error", err)
+			s.writeError(req, res, err)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(token)
+	case strings.HasPrefix(path, "token/"):
+		accessor := strings.TrimPrefix(path, "token/")
+		switch req.Method {
+		case http.MethodGet:
+			if !s.verifyRead(req, res) {
+				return
+			}
+			for _, t := range s.node.store.GetACLTokens() {
+				if t.AccessorID == accessor {
+					res.Header().Set("Content-Type", "application/json")
+					json.NewEncoder(res).Encode(t)
+					return
+				}
+			}
+			res.WriteHeader(http.StatusNotFound)
+		case http.MethodDelete:
+			if err := s.node.store.DeleteACLToken(accessor); err != nil {
+				s.log(req).Error("Could not delete the ACL token", "accessor", accessor, "error", err)
+				s.writeError(req, res, err)
+				return
+			}
+			res.WriteHeader(http.StatusOK)
+		default:
+			res.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	default:
+		s.badRequest(res)
+	}
+}
@@ -0,0 +1,117 @@
+package node
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizerLongestPrefix(t *testing.T) {
+	rules := []ACLRule{
+		{Prefix: "", Access: ACLRead},
+		{Prefix: "app/", Access: ACLWrite},
+		{Prefix: "app/secret/", Access: ACLDeny},
+		{Prefix: "app/secret/public", Access: ACLRead},
+	}
+	tests := []struct {
+		key   string
+		read  bool
+		write bool
+	}{
+		{"other", true, false},
+		{"app/config", true, true},
+		{"app/secret/password", false, false},
+		{"app/secret/public-key", true, false},
+		// A prefix is matched as is, not as a path segment.
+		{"app", true, false},
+	}
+	for _, defaultAllow := range []bool{false, true} {
+		a := &Authorizer{policy: &ACLPolicy{Keys: rules}, defaultAllow: defaultAllow}
+		for _, tt := range tests {
+			if read := a.KeyRead(tt.key); read != tt.read {
+				t.Errorf("Expected reading '%s' to be %v with default allow %v, got %v", tt.key, tt.read, defaultAllow, read)
+			}
+			if write := a.KeyWrite(tt.key); write != tt.write {
+				t.Errorf("Expected writing '%s' to be %v with default allow %v, got %v", tt.key, tt.write, defaultAllow, write)
+			}
+		}
+	}
+
+	// Clearing a prefix needs write access to every rule under it.
+	a := &Authorizer{policy: &ACLPolicy{Keys: rules}}
+	if a.KeyWritePrefix("app/") {
+		t.Errorf("Expected clearing 'app/' to be denied by the rules under it")
+	}
+	if !a.KeyWritePrefix("app/config/") {
+		t.Errorf("Expected clearing 'app/config/' to be allowed")
+	}
+}
+
+func TestAuthorizeDefaultPolicy(t *testing.T) {
+	s := newTestStore()
+	a := &testApplier{t: t, s: s}
+	a.apply(Command{Type: "ACREATE", Value: encode(t, ACLToken{AccessorID: "a1", SecretID: "secret", Policy: ACLPolicy{
+		Services: []ACLRule{{Prefix: "web", Access: ACLRead}},
+	}})})
+
+	tests := []struct {
+		policy  string
+		secret  string
+		service bool
+		key     bool
+		op      bool
+	}{
+		{"deny", "", false, false, false},
+		{"deny", "secret", true, false, false},
+		{"allow", "", true, true, true},
+		{"allow", "secret", true, true, true},
+	}
+	for _, tt := range tests {
+		s.Node.ACL = ACLConfig{Enabled: true, DefaultPolicy: tt.policy}
+		authz, err := s.Node.Authorize(tt.secret)
+		if err != nil {
+			t.Fatalf("Could not resolve '%s': %s", tt.secret, err)
+		}
+		if got := authz.ServiceRead("web"); got != tt.service {
+			t.Errorf("%s policy with '%s': expected reading the service to be %v, got %v", tt.policy, tt.secret, tt.service, got)
+		}
+		if got := authz.KeyRead("k"); got != tt.key {
+			t.Errorf("%s policy with '%s': expected reading a key to be %v, got %v", tt.policy, tt.secret, tt.key, got)
+		}
+		if got := authz.OperatorRead(); got != tt.op {
+			t.Errorf("%s policy with '%s': expected the operator reads to be %v, got %v", tt.policy, tt.secret, tt.op, got)
+		}
+	}
+
+	if _, err := s.Node.Authorize("unknown"); err != ErrACLNotFound {
+		t.Errorf("Expected an unknown token to be rejected, got %v", err)
+	}
+}
+
+func TestACLBootstrapOnce(t *testing.T) {
+	s := newTestNode(t, true)
+	s.Node.ACL = ACLConfig{Enabled: true, DefaultPolicy: ACLDeny}
+	srv := NewServer("", s.Node)
+
+	bootstrap := func() *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		srv.ServeHTTP(res, httptest.NewRequest(http.MethodPut, "/acl/bootstrap", nil))
+		return res
+	}
+	res := bootstrap()
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected the first bootstrap to succeed, got %d: %s", res.Code, res.Body)
+	}
+	var token ACLToken
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil || !token.Policy.Management {
+		t.Fatalf("Expected a management token, got %+v (%v)", token, err)
+	}
+
+	if res := bootstrap(); res.Code != http.StatusForbidden {
+		t.Errorf("Expected the second bootstrap to be rejected, got %d: %s", res.Code, res.Body)
+	}
+	if tokens := s.GetACLTokens(); len(tokens) != 1 {
+		t.Errorf("Expected a single token, got %d", len(tokens))
+	}
+}
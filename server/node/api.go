@@ -1,6 +1,7 @@
 package node
 
 import (
+	"context"
 	"time"
 
 	"github.com/hashicorp/raft"
@@ -9,6 +10,13 @@ import (
 // The timeout to execute Raft commands
 var Timeout = 5 * time.Second
 
+// DefaultWatchWait and MaxWatchWait bound how long a blocking query waits for a
+// change before returning the current state.
+var (
+	DefaultWatchWait = 5 * time.Minute
+	MaxWatchWait     = 10 * time.Minute
+)
+
 // Command is what we will use to change the state of the Replicate state
 // machine.
 // The type field defines how the message is going to be interpreted by the
@@ -18,6 +26,120 @@ type Command struct {
 	Key  string `json:"key"`
 	// some commands don't have a value such as `DELETE` and `GET`
 	Value string `json:"value,omitempty"`
+	// TTLMs is the time to live of the key written by a `PUT` command, `0`
+	// means the key never expires.
+	TTLMs uint64 `json:"ttl_ms,omitempty"`
+	// Index is the modify index a `KEXP` command expects the key to still have
+	// for it to be removed.
+	Index uint64 `json:"index,omitempty"`
+	// Session identifies the session acquiring or releasing the lock on the key
+	// for the `LOCK` and `UNLOCK` commands.
+	Session string `json:"session,omitempty"`
+	// TimeMs is the leader's clock in milliseconds when it checkpointed the
+	// lease renewals of a `LEASES` command, the replicas compute the last beats
+	// from it rather than from their own clock when they apply the command.
+	TimeMs uint64 `json:"time_ms,omitempty"`
+	// Trace is the W3C `traceparent` of the span that submitted the command,
+	// every replica records applying it as a child span.
+	Trace string `json:"trace,omitempty"`
+}
+
+// KVEntry is a single key-value pair as held by the replicated state machine.
+//
+// Entries are never mutated in place, a write replaces the whole entry, which
+// makes it safe to hand them out to readers once the lock is released.
+type KVEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// CreateIndex is the Raft log index of the command that created the key.
+	CreateIndex uint64 `json:"create_index"`
+	// ModifyIndex is the Raft log index of the last command that changed the
+	// key, it is the value used for check-and-set operations.
+	ModifyIndex uint64 `json:"modify_index"`
+	// TTLMs is the time to live the key was written with, `0` means the key
+	// never expires.
+	TTLMs uint64 `json:"ttl_ms,omitempty"`
+	// RemainingTTLMs is only filled on the copies handed out to readers, and is
+	// an estimate based on when the write was applied on the serving node.
+	RemainingTTLMs uint64 `json:"remaining_ttl_ms,omitempty"`
+	// Session is the identifier of the session holding the lock on the key, if
+	// any.
+	Session string `json:"session,omitempty"`
+	// LockIndex counts how many times the lock on the key has been acquired, it
+	// can be used as a fencing token by the lock holder.
+	LockIndex uint64 `json:"lock_index,omitempty"`
+}
+
+// Session ties locks on keys to the liveness of a client.
+//
+// A session is either bound to a registered instance, in which case it's
+// invalidated as soon as the instance is evicted by the `Cleaner`, or has its
+// own TTL that the client must keep renewing, or both. Invalidating a session
+// releases every lock it holds.
+type Session struct {
+	ID      string `json:"id"`
+	Service string `json:"service,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Port    uint16 `json:"port,omitempty"`
+	TTLMs   uint64 `json:"ttl_ms,omitempty"`
+	// CreateIndex is the Raft log index of the command that created the
+	// session.
+	CreateIndex uint64 `json:"create_index"`
+}
+
+// bound reports whether the session is tied to a registered instance.
+func (s *Session) bound() bool {
+	return s.Service != ""
+}
+
+// SessionRequest is the message received by the API to create a session, the
+// `TTL` is a duration string such as `15s`.
+type SessionRequest struct {
+	Service string `json:"service,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Port    uint16 `json:"port,omitempty"`
+	TTL     string `json:"ttl,omitempty"`
+}
+
+// The access levels granted by an ACL rule, `write` implies `read`.
+const (
+	ACLDeny  = "deny"
+	ACLRead  = "read"
+	ACLWrite = "write"
+)
+
+// ACLRule grants an access level on the services or keys whose name starts
+// with `Prefix`, the rule with the longest matching prefix applies.
+type ACLRule struct {
+	Prefix string `json:"prefix"`
+	Access string `json:"access"`
+}
+
+// ACLPolicy lists what a token is allowed to do:
+//   - `Services` on the registry, writing is registering an instance.
+//   - `Keys` on the key-value store.
+//   - `Session` on the sessions, and `Operator` on the cluster itself (reading
+//     the metrics, joining nodes).
+//   - `Management` grants everything, including managing the ACL tokens.
+type ACLPolicy struct {
+	Services   []ACLRule `json:"services,omitempty"`
+	Keys       []ACLRule `json:"keys,omitempty"`
+	Session    string    `json:"session,omitempty"`
+	Operator   string    `json:"operator,omitempty"`
+	Management bool      `json:"management,omitempty"`
+}
+
+// ACLToken is a replicated token, the `SecretID` is what the clients send to
+// authenticate, the `AccessorID` identifies the token to manage it without
+// revealing the secret.
+type ACLToken struct {
+	AccessorID  string    `json:"accessor_id"`
+	SecretID    string    `json:"secret_id,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Policy      ACLPolicy `json:"policy"`
+	// CreateIndex is the Raft log index of the command that created the
+	// token.
+	CreateIndex uint64 `json:"create_index"`
 }
 
 type InstanceEntry struct {
@@ -25,17 +147,40 @@ type InstanceEntry struct {
 	Host       string
 	LastBeatMs uint64
 	Created    time.Time
+	Tags       []string
+	Meta       map[string]string
 }
 
 type ServiceEntry struct {
 	Name      string
 	Instances []*InstanceEntry
+	// Persistent services are kept in the registry once they have no
+	// instances left, other services are removed by the `Cleaner`.
+	Persistent bool
+	// EmptySinceMs is when the service lost its last instance, as observed by
+	// the node applying the removal, `0` while it has instances.
+	EmptySinceMs uint64
 }
 
 // CleanableResource represents a resource (services) accessible by the cleanup
 // service.
 type CleanableResource interface {
 	GetResources() map[string]*ServiceEntry
+
+	// LastBeat returns when the instance of the service last heartbeated, in
+	// milliseconds since the epoch.
+	LastBeat(string, *InstanceEntry) uint64
+
+	// CheckpointLeases replicates the lease renewals that were only recorded in
+	// the leader's memory so far.
+	CheckpointLeases() error
+
+	// ExpiredKeys returns the keys whose TTL elapsed at the given time.
+	ExpiredKeys(time.Time) []KVEntry
+
+	// ExpiredSessions returns the sessions that were not renewed within their
+	// TTL at the given time.
+	ExpiredSessions(time.Time) []Session
 }
 
 // A storage engine abstraction over the key-value store.
@@ -53,6 +198,18 @@ type StorageEngine interface {
 	// finish the operation.
 	Put(string, string) error
 
+	// PutTTL is like `Put`, but the key will be removed by the leader once the
+	// given duration elapses without the key being written again.
+	PutTTL(string, string, time.Duration) error
+
+	// GetEntry returns a copy of the entry identified by the given key, along
+	// with its indexes and remaining time to live.
+	GetEntry(string) (*KVEntry, bool)
+
+	// ExpireKey removes the key, only if it was not modified since the entry
+	// with the given modify index was observed.
+	ExpireKey(string, uint64) error
+
 	// Get the value identified by the given key.
 	Get(string) (string, error)
 
@@ -60,6 +217,40 @@ type StorageEngine interface {
 	// and return it.
 	Delete(string) (string, error)
 
+	// CreateSession creates a new session and returns it.
+	CreateSession(SessionRequest) (*Session, error)
+
+	// RenewSession resets the TTL of the session with the given ID.
+	RenewSession(string) error
+
+	// DestroySession invalidates the session with the given ID, releasing all
+	// the locks it holds.
+	DestroySession(string) error
+
+	// GetSessions returns the list of live sessions.
+	GetSessions() []Session
+
+	// Acquire takes the lock on the key for the given session and writes the
+	// value, it returns false if the lock is held by another session.
+	Acquire(key, value, session string) (bool, error)
+
+	// Release gives up the lock on the key if it's held by the given session.
+	Release(key, session string) (bool, error)
+
+	// QueryKV returns the entry for the key, or every entry whose key starts
+	// with it if the second argument is set, along with the index of the last
+	// change to the key-value store.
+	QueryKV(string, bool) ([]KVEntry, uint64)
+
+	// WatchKV returns a channel that's closed once the key (or a key under the
+	// prefix) is modified after the given index, and a function to cancel the
+	// watch.
+	WatchKV(string, bool, uint64) (<-chan struct{}, func())
+
+	// Txn applies the given operations atomically, either all of them succeed
+	// or none of them is applied.
+	Txn([]TxnOp) (*TxnResponse, error)
+
 	// GetServices will return the list of known live services to the heartbeat service
 	// at query time.
 	GetServices() *ServicesResponse
@@ -67,11 +258,47 @@ type StorageEngine interface {
 	// RegisterInstance will update the store's service list with the new
 	// instance, This is usually resulting from a new service starting somewhere,
 	// and doing a heartbeat request.
-	RegisterInstance(InstanceRegistration)
+	RegisterInstance(context.Context, InstanceRegistration) error
+
+	// RegisterInstances registers or renews the lease of all the given
+	// instances with a single replicated command.
+	RegisterInstances(context.Context, []InstanceRegistration) error
 
 	// DeleteInstance will delete the corresponding entry (instance) from the replicated
 	// state machine
-	DeleteInstance(string, InstanceEntry)
+	DeleteInstance(string, InstanceEntry) error
+
+	// DeleteService removes the service from the registry, unless it is
+	// persistent or got new instances in the meantime.
+	DeleteService(string) error
+
+	// BootstrapACL creates the initial management token, it can only succeed
+	// once in the life of the cluster.
+	BootstrapACL() (*ACLToken, error)
+
+	// CreateACLToken creates a token with the given description and policy,
+	// the identifiers are chosen by the leader.
+	CreateACLToken(ACLToken) (*ACLToken, error)
+
+	// DeleteACLToken removes the token with the given accessor ID.
+	DeleteACLToken(string) error
+
+	// ResolveACLToken returns the token with the given secret ID.
+	ResolveACLToken(string) (*ACLToken, bool)
+
+	// GetACLTokens returns the list of tokens, without their secrets.
+	GetACLTokens() []ACLToken
+
+	// SetMember records the addresses of a node of the cluster, replacing the
+	// member with the same ID or Raft address.
+	SetMember(Member) error
+
+	// GetMembers returns the known members of the cluster.
+	GetMembers() []Member
+
+	// ServiceEvents returns the registry events that happened after the given
+	// index, and a channel closed on the next event if there are none.
+	ServiceEvents(uint64) ([]ServiceEvent, <-chan struct{})
 }
 
 // JoinRequest is the message received by the API to handle new nodes joining
@@ -79,6 +306,41 @@ type StorageEngine interface {
 type JoinRequest struct {
 	Id   string `json:"id"`
 	Addr string `json:"addr"`
+	// Force replaces the members already using the ID or the address.
+	Force bool `json:"force,omitempty"`
+	// Time is when the request was signed, in seconds since the epoch.
+	Time int64 `json:"time,omitempty"`
+	// HttpAddr is the address of the node's HTTP API, used to redirect the
+	// requests that must be served by the leader. As for `Addr`, a missing
+	// host is the source of the request.
+	HttpAddr string `json:"http_addr,omitempty"`
+	// NonVoter joins the node as a read replica, it receives the replicated
+	// state without being part of the quorum.
+	NonVoter bool `json:"non_voter,omitempty"`
+}
+
+// Member is a node of the cluster along with the addresses it can be reached
+// at.
+type Member struct {
+	ID       string `json:"id"`
+	RaftAddr string `json:"raft_addr"`
+	HttpAddr string `json:"http_addr"`
+}
+
+// MemberStatus is a member of the cluster as listed by `/cluster/members`.
+type MemberStatus struct {
+	Member
+	Voter  bool `json:"voter"`
+	Leader bool `json:"leader"`
+}
+
+// PeerStatus is what a node tells the others about itself while they are
+// forming a cluster, `Bootstrapped` is set once it's part of one. `Peers` are
+// the sorted IDs of the nodes it found, itself included.
+type PeerStatus struct {
+	Member
+	Bootstrapped bool     `json:"bootstrapped"`
+	Peers        []string `json:"peers,omitempty"`
 }
 
 // ServicesResponse is the message returned by the leader when the `/services`
@@ -88,18 +350,95 @@ type ServicesResponse struct {
 }
 
 type Service struct {
-	Name      string     `json:"name"`
-	Instances []Instance `json:"instances"`
+	Name       string     `json:"name"`
+	Persistent bool       `json:"persistent,omitempty"`
+	Instances  []Instance `json:"instances"`
 }
 
 type Instance struct {
-	Port   uint16 `json:"port"`
-	Host   string `json:"host"`
-	Uptime uint64 `json:"uptime"`
+	Port   uint16            `json:"port"`
+	Host   string            `json:"host"`
+	Uptime uint64            `json:"uptime"`
+	Tags   []string          `json:"tags,omitempty"`
+	Meta   map[string]string `json:"meta,omitempty"`
 }
 
 type InstanceRegistration struct {
 	ServiceName string `json:"service"`
 	Host        string `json:"host"`
 	Port        uint16 `json:"port"`
+	// Persistent marks the service as one that stays listed even when none of
+	// its instances is alive.
+	Persistent bool `json:"persistent,omitempty"`
+	// Tags are free-form labels of the instance (e.g. `primary`, `v2`), a
+	// registration with different tags replaces the instance's tags.
+	Tags []string `json:"tags,omitempty"`
+	// Meta holds key/value metadata of the instance (e.g. `version`), replaced
+	// the same way as the tags.
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// The types of the registry events.
+const (
+	EventServiceRegistered  = "service-registered"
+	EventServiceDeleted     = "service-deleted"
+	EventInstanceRegistered = "instance-registered"
+	EventInstanceRemoved    = "instance-removed"
+)
+
+// ServiceEvent describes a change of the registry applied at the Raft log
+// index `Index`, lease renewals are not reported.
+type ServiceEvent struct {
+	Index   uint64 `json:"index"`
+	Type    string `json:"type"`
+	Service string `json:"service"`
+	Host    string `json:"host,omitempty"`
+	Port    uint16 `json:"port,omitempty"`
+}
+
+// WatchEvent is a message of the `/watch/` stream, it holds the state of the
+// watched key(s) after the change at `Index`.
+type WatchEvent struct {
+	Index   uint64    `json:"index"`
+	Entries []KVEntry `json:"entries"`
+}
+
+// The verbs supported by a transaction operation.
+const (
+	TxnGet          = "get"
+	TxnSet          = "set"
+	TxnCAS          = "cas"
+	TxnDelete       = "delete"
+	TxnDeletePrefix = "delete-prefix"
+	TxnCheckIndex   = "check-index"
+)
+
+// TxnOp is a single operation of a transaction.
+//
+// `Index` is only used by the `cas` and `check-index` verbs, an index of `0`
+// means the key is expected not to exist.
+type TxnOp struct {
+	Verb  string `json:"verb"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	Index uint64 `json:"index,omitempty"`
+	// TTLMs is the time to live of the key written by `set` and `cas`.
+	TTLMs uint64 `json:"ttl_ms,omitempty"`
+}
+
+// TxnError describes why the operation at position `OpIndex` caused the
+// transaction to be rolled back.
+type TxnError struct {
+	OpIndex int    `json:"op_index"`
+	What    string `json:"what"`
+}
+
+// TxnResponse is the outcome of a transaction.
+//
+// `Results` holds one entry per operation in the order they were submitted, the
+// entry is nil for deletes and for keys that don't exist. If `Errors` is not
+// empty, the transaction was rolled back and `Results` is empty.
+type TxnResponse struct {
+	Results []*KVEntry `json:"results"`
+	Errors  []TxnError `json:"errors,omitempty"`
 }
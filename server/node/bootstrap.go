@@ -0,0 +1,200 @@
+package node
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// BootstrapPollInterval is how often a node waiting for the expected number of
+// nodes asks the seeds about themselves.
+var BootstrapPollInterval = 2 * time.Second
+
+// Bootstrapped reports whether the node is part of a cluster, either because it
+// bootstrapped one or because a leader added it.
+func (n *Node) Bootstrapped() bool {
+	ft := n.raft.GetConfiguration()
+	return ft.Error() == nil && len(ft.Configuration().Servers) > 0
+}
+
+// Status returns what the node tells the others about itself.
+func (n *Node) Status() PeerStatus {
+	n.lmu.Lock()
+	peers := n.bootstrapPeers
+	n.lmu.Unlock()
+	return PeerStatus{
+		Member:       Member{ID: n.id, RaftAddr: n.raftAddr, HttpAddr: n.HttpAddr},
+		Bootstrapped: n.Bootstrapped(),
+		Peers:        peers,
+	}
+}
+
+// BootstrapExpect forms a cluster together with the nodes reachable through
+// the seeds of the configuration, without a designated initial leader. Once
+// `expect` nodes (this one included) are found, and each of them found the
+// exact same nodes, every one of them bootstraps the cluster with the same
+// configuration. Nodes seeded with disjoint subsets of each other never agree,
+// instead of forming separate clusters. If one of the seeds is already part of
+// a cluster, the node joins it instead.
+//
+// The node must have been bootstrapped without being the leader, and every
+// node of the initial cluster must be started with the same `expect` and the
+// addresses of all the others.
+func (n *Node) BootstrapExpect(expect int, config JoinConfig) error {
+	client, scheme := &http.Client{Timeout: 10 * time.Second}, "http"
+	if config.TLS != nil {
+		client.Transport = &http.Transport{TLSClientConfig: config.TLS}
+		scheme = "https"
+	}
+
+	for {
+		if n.Bootstrapped() {
+			n.logger.Info("The node was added to the cluster by another node")
+			return nil
+		}
+
+		peers := map[string]Member{n.id: n.Status().Member}
+		statuses := make([]*PeerStatus, 0, len(config.Seeds))
+		for _, seed := range config.Seeds {
+			status, err := fetchStatus(client, fmt.Sprintf("%s://%s/cluster/self", scheme, seed), config)
+			if err != nil {
+				n.logger.Warn("Could not get the status of a seed", "seed", seed, "error", err)
+				continue
+			}
+			if status.Bootstrapped {
+				n.logger.Info("Found an existing cluster, joining it", "seed", seed, "peer", status.ID)
+				return JoinCluster(config)
+			}
+			peers[status.ID] = status.Member
+			statuses = append(statuses, status)
+		}
+		ids := peerIDs(peers)
+		n.lmu.Lock()
+		n.bootstrapPeers = ids
+		n.lmu.Unlock()
+
+		switch {
+		case len(peers) < expect:
+			n.logger.Info("Waiting for the expected nodes", "found", len(peers), "expect", expect)
+		case !samePeers(ids, statuses):
+			n.logger.Info("Waiting for the expected nodes to find the same nodes", "peers", ids)
+		default:
+			return n.bootstrapWith(peers)
+		}
+		time.Sleep(BootstrapPollInterval)
+	}
+}
+
+// bootstrapWith bootstraps the cluster with the given voters, the servers are
+// sorted so that every node uses the exact same configuration.
+func (n *Node) bootstrapWith(peers map[string]Member) error {
+	servers := make([]raft.Server, 0, len(peers))
+	for _, p := range peers {
+		servers = append(servers, raft.Server{
+			ID:      raft.ServerID(p.ID),
+			Address: raft.ServerAddress(p.RaftAddr),
+		})
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ID < servers[j].ID })
+
+	n.logger.Info("Bootstrapping the cluster with the expected nodes", "servers", len(servers))
+	err := n.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+	// Another node's configuration might have reached this one in the meantime.
+	if err == raft.ErrCantBootstrap && n.Bootstrapped() {
+		return nil
+	}
+	return err
+}
+
+// peerIDs returns the sorted IDs of the nodes.
+func peerIDs(peers map[string]Member) []string {
+	ids := make([]string, 0, len(peers))
+	for id := range peers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// samePeers reports whether every seed found the same nodes as this one.
+func samePeers(ids []string, statuses []*PeerStatus) bool {
+	for _, status := range statuses {
+		if len(status.Peers) != len(ids) {
+			return false
+		}
+		for i := range ids {
+			if status.Peers[i] != ids[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// fetchStatus asks a seed about itself, its answer must be signed with the
+// cluster's join secret if one is configured.
+func fetchStatus(client *http.Client, url string, config JoinConfig) (*PeerStatus, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if config.Token != "" {
+		req.Header.Set("X-Heartbeat-Token", config.Token)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Answered with status %d: %s", res.StatusCode, body)
+	}
+	if config.Secret != "" && !hmac.Equal([]byte(SignJoinRequest(config.Secret, body)), []byte(res.Header.Get(JoinSignatureHeader))) {
+		return nil, fmt.Errorf("Invalid signature of the peer status")
+	}
+	var status PeerStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// handleClusterSelf serves the status of the node to the nodes forming a
+// cluster with `BootstrapExpect`, signed with the join secret if there's one.
+func (s *HttpServer) handleClusterSelf(req *http.Request, res http.ResponseWriter) {
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	// There can't be any ACL token before the node is part of a cluster.
+	status := s.node.Status()
+	if status.Bootstrapped {
+		if authz := s.authorize(req, res); authz == nil {
+			return
+		} else if !authz.OperatorRead() {
+			s.forbidden(req, res)
+			return
+		}
+	}
+	body, err := json.Marshal(status)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		res.Write([]byte(fmt.Sprintf("Server error occured: %s", err)))
+		return
+	}
+	if s.node.JoinSecret != "" {
+		res.Header().Set(JoinSignatureHeader, SignJoinRequest(s.node.JoinSecret, body))
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(body)
+}
@@ -0,0 +1,62 @@
+package node
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchStatusSignature(t *testing.T) {
+	body := `{"id":"node-2","raft_addr":"10.0.0.2:9999","http_addr":"10.0.0.2:9000","bootstrapped":false,"peers":["node-1","node-2"]}`
+	tests := []struct {
+		name      string
+		signature string
+		valid     bool
+	}{
+		{"signed", SignJoinRequest("secret", []byte(body)), true},
+		{"signed with another secret", SignJoinRequest("other", []byte(body)), false},
+		{"not signed", "", false},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			res.Header().Set(JoinSignatureHeader, tt.signature)
+			res.Write([]byte(body))
+		}))
+		status, err := fetchStatus(srv.Client(), srv.URL+"/cluster/self", JoinConfig{Secret: "secret"})
+		srv.Close()
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("%s: expected the status to be rejected", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected the status to be accepted, got %s", tt.name, err)
+		} else if status.ID != "node-2" || len(status.Peers) != 2 {
+			t.Errorf("%s: unexpected status %+v", tt.name, status)
+		}
+	}
+}
+
+func TestSamePeers(t *testing.T) {
+	ids := []string{"node-1", "node-2", "node-3"}
+	tests := []struct {
+		name  string
+		peers [][]string
+		same  bool
+	}{
+		{"same nodes", [][]string{{"node-1", "node-2", "node-3"}, {"node-1", "node-2", "node-3"}}, true},
+		{"a seed found another node", [][]string{{"node-1", "node-2", "node-3"}, {"node-1", "node-3", "node-4"}}, false},
+		{"a seed found fewer nodes", [][]string{{"node-1", "node-2", "node-3"}, {"node-2", "node-3"}}, false},
+		{"a seed didn't report yet", [][]string{{"node-1", "node-2", "node-3"}, nil}, false},
+	}
+	for _, tt := range tests {
+		statuses := make([]*PeerStatus, 0, len(tt.peers))
+		for _, p := range tt.peers {
+			statuses = append(statuses, &PeerStatus{Peers: p})
+		}
+		if same := samePeers(ids, statuses); same != tt.same {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.same, same)
+		}
+	}
+}
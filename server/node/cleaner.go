@@ -1,9 +1,10 @@
 package node
 
 import (
-	"log"
-	"os"
+	"sync"
 	"time"
+
+	"github.com/hashicorp/go-hclog"
 )
 
 // SafetyDelta is the period of time that a heart beat should be late after the
@@ -13,37 +14,147 @@ var SafetyDelta = uint64(100 * time.Millisecond)
 type Cleaner struct {
 	period       time.Duration
 	remThreshold time.Duration
-	node         *Node
-	logger       *log.Logger
+	// lastCheckpoint is when the lease renewals were last replicated.
+	lastCheckpoint time.Time
+	// retention is how long a service without instances is kept before being
+	// removed from the registry.
+	retention time.Duration
+	node      *Node
+	logger    hclog.Logger
+	// stop is closed by `Stop` to end the loop of `Start`.
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
-func NewCleaner(period, remThreshold time.Duration, node *Node) *Cleaner {
+func NewCleaner(period, remThreshold, retention time.Duration, node *Node) *Cleaner {
 	return &Cleaner{
 		period:       period,
 		node:         node,
 		remThreshold: remThreshold,
-		logger:       log.New(os.Stderr, "(Cleaner) ", log.LstdFlags),
+		retention:    retention,
+		logger:       ComponentLogger("cleaner"),
+		stop:         make(chan struct{}),
 	}
 }
 
+// Start runs a cleanup pass every `period` until `Stop` is called.
 func (c *Cleaner) Start() {
-	c.logger.Printf("Starting entries cleanup, cleaner will run every %s", c.period)
+	c.logger.Info("Starting entries cleanup", "period", c.period)
 	for {
 		// For each service instance, send commands to remove them from the cluster
 		// registery if they are haven't renewed their lease for more than
 		// `remThreshold + SafetyDelta`.
+		start := time.Now()
 		services := c.node.store.GetResources()
 		nowMs := uint64(time.Now().UnixNano()) / uint64(1e6)
-		for _, v := range services {
-			for _, instance := range v.Instances {
-				if nowMs-instance.LastBeatMs > uint64(c.remThreshold.Milliseconds()) {
-					// Send a delete request to remove the instance.
-					c.logger.Printf("Sending a delete request for instance %s:%d, of service (%s) -- difference is %dms expected at most %dms", instance.Host, instance.Port, v.Name, nowMs-instance.LastBeatMs, c.remThreshold.Milliseconds())
-					c.node.store.DeleteInstance(v.Name, *instance)
+		if c.canEvict() {
+			for _, v := range services {
+				for _, instance := range v.Instances {
+					lastBeat := c.node.store.LastBeat(v.Name, instance)
+					if nowMs > lastBeat && nowMs-lastBeat > uint64(c.remThreshold.Milliseconds()) {
+						// Send a delete request to remove the instance.
+						c.logger.Info("Sending a delete request for an expired instance", "service", v.Name, "host", instance.Host, "port", instance.Port, "since_beat_ms", nowMs-lastBeat, "threshold_ms", c.remThreshold.Milliseconds())
+						if err := c.node.store.DeleteInstance(v.Name, *instance); err != nil {
+							c.logger.Error("Could not delete instance", "service", v.Name, "host", instance.Host, "port", instance.Port, "error", err)
+						} else {
+							cleanerEvictions.Inc()
+						}
+					}
 				}
 			}
 		}
-		c.logger.Printf("Scanned all the services, sleeping until the next run")
-		time.Sleep(c.period)
+		c.checkpointLeases()
+		c.removeEmptyServices(services, nowMs)
+		c.expireKeys()
+		c.expireSessions()
+		cleanerDuration.Observe(time.Since(start).Seconds())
+		c.logger.Debug("Scanned all the services, sleeping until the next run", "duration", time.Since(start))
+		select {
+		case <-c.stop:
+			c.logger.Info("Stopped entries cleanup")
+			return
+		case <-time.After(c.period):
+		}
+	}
+}
+
+// Stop ends the cleanup loop once the current pass is done.
+func (c *Cleaner) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// expireKeys replicates a delete for every key whose TTL elapsed, only the
+// leader's clock is used to decide that a key expired.
+func (c *Cleaner) expireKeys() {
+	if !c.node.leading() {
+		return
+	}
+	for _, e := range c.node.store.ExpiredKeys(time.Now()) {
+		c.logger.Info("Sending an expire request", "key", e.Key, "ttl_ms", e.TTLMs)
+		if err := c.node.store.ExpireKey(e.Key, e.ModifyIndex); err != nil {
+			c.logger.Error("Could not expire key", "key", e.Key, "error", err)
+		}
+	}
+}
+
+// expireSessions invalidates the sessions that were not renewed in time,
+// releasing the locks they hold.
+func (c *Cleaner) expireSessions() {
+	if !c.node.leading() {
+		return
+	}
+	for _, sess := range c.node.store.ExpiredSessions(time.Now()) {
+		c.logger.Info("Sending a destroy request for an expired session", "session", sess.ID, "ttl_ms", sess.TTLMs)
+		if err := c.node.store.DestroySession(sess.ID); err != nil {
+			c.logger.Error("Could not destroy session", "session", sess.ID, "error", err)
+		}
+	}
+}
+
+// removeEmptyServices removes the services that have had no instances for
+// longer than the retention, persistent services are kept.
+func (c *Cleaner) removeEmptyServices(services map[string]*ServiceEntry, nowMs uint64) {
+	if !c.node.leading() {
+		return
+	}
+	for _, v := range services {
+		if v.Persistent || len(v.Instances) > 0 || v.EmptySinceMs == 0 {
+			continue
+		}
+		if nowMs-v.EmptySinceMs >= uint64(c.retention.Milliseconds()) {
+			c.logger.Info("Sending a delete request for an empty service", "service", v.Name, "empty_ms", nowMs-v.EmptySinceMs)
+			if err := c.node.store.DeleteService(v.Name); err != nil {
+				c.logger.Error("Could not delete service", "service", v.Name, "error", err)
+			}
+		}
+	}
+}
+
+// canEvict reports whether this node may evict instances. Only the leader
+// knows about the latest lease renewals, and a new leader waits for a full
+// lease period before evicting anything, giving every live instance the time to
+// heartbeat to it.
+func (c *Cleaner) canEvict() bool {
+	since := c.node.LeaderSince()
+	if since.IsZero() {
+		return false
+	}
+	if grace := time.Since(since); grace < c.remThreshold {
+		c.logger.Debug("Not evicting instances during the grace period", "leader_since", grace)
+		return false
+	}
+	return true
+}
+
+// checkpointLeases replicates the lease renewals tracked by the leader every
+// `LeaseCheckpointInterval`.
+func (c *Cleaner) checkpointLeases() {
+	if !c.node.leading() || time.Since(c.lastCheckpoint) < LeaseCheckpointInterval {
+		return
+	}
+	if err := c.node.store.CheckpointLeases(); err != nil {
+		c.logger.Error("Could not checkpoint the lease renewals", "error", err)
+		return
 	}
+	c.lastCheckpoint = time.Now()
 }
@@ -0,0 +1,110 @@
+package node
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// ReadMode is the consistency level requested by a read.
+type ReadMode string
+
+const (
+	// ReadDefault is served by the leader without contacting the other nodes,
+	// the leader steps down as soon as its lease expires, so the data can only
+	// be stale during a short window after a partition.
+	ReadDefault ReadMode = "default"
+	// ReadConsistent is served by the leader after confirming with a quorum
+	// that it's still the leader, and after applying every committed command.
+	ReadConsistent ReadMode = "consistent"
+	// ReadStale is served by any node from its local state, which can lag
+	// behind the leader.
+	ReadStale ReadMode = "stale"
+)
+
+// ConsistentReadTimeout bounds how long a consistent read waits for the local
+// state machine to catch up with the read index.
+var ConsistentReadTimeout = 5 * time.Second
+
+// ParseReadMode maps the query parameters of a request to a read mode, the
+// `consistent` and `stale` parameters are mutually exclusive.
+func ParseReadMode(consistent, stale bool) (ReadMode, error) {
+	switch {
+	case consistent && stale:
+		return "", fmt.Errorf("The 'consistent' and 'stale' read modes are mutually exclusive")
+	case consistent:
+		return ReadConsistent, nil
+	case stale:
+		return ReadStale, nil
+	default:
+		return ReadDefault, nil
+	}
+}
+
+// VerifyRead returns an error if this node can't serve a read with the given
+// consistency mode.
+func (n *Node) VerifyRead(mode ReadMode) error {
+	switch mode {
+	case ReadStale:
+		return nil
+	case ReadDefault:
+		if !n.IsLeader() {
+			return n.notLeaderError()
+		}
+		return nil
+	case ReadConsistent:
+		if !n.IsLeader() {
+			return n.notLeaderError()
+		}
+		// The last index is at least the commit index, once it's applied the
+		// local state reflects every write acknowledged before this read.
+		readIndex := n.raft.LastIndex()
+		if err := n.raft.VerifyLeader().Error(); err != nil {
+			return fmt.Errorf("Could not verify the leadership: %s", err)
+		}
+		return n.waitApplied(readIndex, ConsistentReadTimeout)
+	default:
+		return fmt.Errorf("Unknown read mode '%s'", mode)
+	}
+}
+
+func (n *Node) waitApplied(index uint64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for n.raft.AppliedIndex() < index {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out waiting for index %d to be applied", index)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil
+}
+
+// LastContact returns the time elapsed since this node last heard from the
+// leader, it is `0` on the leader itself.
+func (n *Node) LastContact() time.Duration {
+	if n.IsLeader() {
+		return 0
+	}
+	last := n.raft.LastContact()
+	if last.IsZero() {
+		// Never heard from a leader.
+		return time.Duration(-1)
+	}
+	return time.Since(last)
+}
+
+// KnownLeader reports whether this node knows which node is the leader.
+func (n *Node) KnownLeader() bool {
+	return n.raft != nil && n.raft.Leader() != ""
+}
+
+func (n *Node) notLeaderError() error {
+	if leader := n.raft.Leader(); leader != "" {
+		return fmt.Errorf("%w, the leader is at '%s'", ErrNotLeader, leader)
+	}
+	return fmt.Errorf("%w, no leader is known", ErrNotLeader)
+}
+
+// ErrNotLeader is returned for operations that must be served by the leader.
+var ErrNotLeader = raft.ErrNotLeader
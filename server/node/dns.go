@@ -0,0 +1,296 @@
+package node
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+)
+
+// DNSConfig configures the DNS interface of the registry.
+type DNSConfig struct {
+	// Addr is the `host:port` the DNS server listens on, over both UDP and TCP.
+	Addr string
+	// Domain is the zone answered by the server, services are looked up as
+	// `<service>.service.<domain>`.
+	Domain string
+	// TTL is the time to live of the returned records.
+	TTL time.Duration
+	// AllowStale lets followers answer from their local copy of the registry,
+	// otherwise only the leader answers and the followers reply with SERVFAIL.
+	AllowStale bool
+	// OnlyPassing leaves out the instances that missed their heartbeats but
+	// were not evicted yet.
+	OnlyPassing bool
+	// HealthThreshold is how long after its last heartbeat an instance is
+	// considered failing.
+	HealthThreshold time.Duration
+}
+
+// DNSServer answers DNS queries from the service registry:
+//   - `A`/`AAAA` queries for `<service>.service.<domain>` with the addresses of
+//     the service's instances.
+//   - `SRV` queries for the same name with their ports, the targets are
+//     resolvable as `<hex ip>.addr.<domain>` and sent as additional records.
+//   - `<tag>.<service>.service.<domain>` to only get the instances having the
+//     tag.
+type DNSServer struct {
+	config DNSConfig
+	node   *Node
+
+	udp *dns.Server
+	tcp *dns.Server
+
+	logger hclog.Logger
+}
+
+// NewDNSServer creates a `DNSServer` that will answer from the node's registry
+// once `Start` is called.
+func NewDNSServer(config DNSConfig, node *Node) *DNSServer {
+	config.Domain = dns.Fqdn(strings.ToLower(config.Domain))
+	return &DNSServer{
+		config: config,
+		node:   node,
+		logger: ComponentLogger("dns"),
+	}
+}
+
+// Start starts listening on the UDP and TCP ports, the queries are served in
+// their own goroutines.
+func (d *DNSServer) Start() error {
+	d.logger.Info("Starting DNS server", "addr", d.config.Addr, "domain", d.config.Domain)
+
+	pc, err := net.ListenPacket("udp", d.config.Addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", d.config.Addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	d.udp = &dns.Server{PacketConn: pc, Handler: d}
+	d.tcp = &dns.Server{Listener: l, Handler: d}
+	for _, sv := range []*dns.Server{d.udp, d.tcp} {
+		go func(sv *dns.Server) {
+			if err := sv.ActivateAndServe(); err != nil {
+				fatal(d.logger, "Unexpected error happened", "error", err)
+			}
+		}(sv)
+	}
+	return nil
+}
+
+// Shutdown stops both listeners.
+func (d *DNSServer) Shutdown() {
+	d.udp.Shutdown()
+	d.tcp.Shutdown()
+}
+
+// ServeDNS is an implementation of the `dns.Handler` interface.
+func (d *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	if len(r.Question) != 1 {
+		m.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+	if !d.config.AllowStale && !d.node.IsLeader() {
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+
+	q := r.Question[0]
+	m.Rcode = d.answer(q, m)
+	if m.Rcode == dns.RcodeNameError {
+		m.Ns = append(m.Ns, d.soa())
+	}
+	w.WriteMsg(m)
+}
+
+// answer fills the message with the records matching the question, and returns
+// the response code.
+func (d *DNSServer) answer(q dns.Question, m *dns.Msg) int {
+	name := strings.ToLower(q.Name)
+	if !dns.IsSubDomain(d.config.Domain, name) {
+		return dns.RcodeRefused
+	}
+	labels := dns.SplitDomainName(strings.TrimSuffix(name, d.config.Domain))
+
+	switch {
+	case len(labels) == 2 && labels[1] == "addr":
+		ip := decodeAddr(labels[0])
+		if ip == nil {
+			return dns.RcodeNameError
+		}
+		if rr := d.addressRecord(q.Name, q.Qtype, ip); rr != nil {
+			m.Answer = append(m.Answer, rr)
+		}
+		return dns.RcodeSuccess
+	case len(labels) == 2 && labels[1] == "service":
+		return d.answerService(q, labels[0], "", m)
+	case len(labels) == 3 && labels[2] == "service":
+		return d.answerService(q, labels[1], labels[0], m)
+	default:
+		return dns.RcodeNameError
+	}
+}
+
+func (d *DNSServer) answerService(q dns.Question, service, tag string, m *dns.Msg) int {
+	var se *ServiceEntry
+	for k, v := range d.node.store.GetResources() {
+		if strings.EqualFold(k, service) {
+			se = v
+			break
+		}
+	}
+	if se == nil {
+		return dns.RcodeNameError
+	}
+	// The queries carry no token, they get the default policy of the ACLs.
+	if authz, _ := d.node.Authorize(""); !authz.ServiceRead(se.Name) {
+		return dns.RcodeNameError
+	}
+
+	instances := d.instances(se, tag)
+	rand.Shuffle(len(instances), func(i, j int) {
+		instances[i], instances[j] = instances[j], instances[i]
+	})
+	for _, inst := range instances {
+		ip := net.ParseIP(inst.Host)
+		switch q.Qtype {
+		case dns.TypeSRV:
+			target := dns.Fqdn(inst.Host)
+			if ip != nil {
+				target = encodeAddr(ip) + ".addr." + d.config.Domain
+				if rr := d.addressRecord(target, addressType(ip), ip); rr != nil {
+					m.Extra = append(m.Extra, rr)
+				}
+			}
+			m.Answer = append(m.Answer, &dns.SRV{
+				Hdr:      d.header(q.Name, dns.TypeSRV),
+				Priority: 1,
+				Weight:   1,
+				Port:     inst.Port,
+				Target:   target,
+			})
+		case dns.TypeA, dns.TypeAAAA, dns.TypeANY:
+			// Instances registered with a hostname can only be found through
+			// their `SRV` records.
+			if ip == nil {
+				continue
+			}
+			if rr := d.addressRecord(q.Name, q.Qtype, ip); rr != nil {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// instances returns the instances of the service that have the tag (if one is
+// given), leaving out the failing ones if only passing instances are served.
+func (d *DNSServer) instances(se *ServiceEntry, tag string) []*InstanceEntry {
+	threshold := uint64(d.config.HealthThreshold.Milliseconds())
+	if !d.node.IsLeader() {
+		// Followers only know about the renewals replicated by the last lease
+		// checkpoint.
+		threshold += uint64(LeaseCheckpointInterval.Milliseconds())
+	}
+	nowMs := uint64(time.Now().UnixNano()) / uint64(1e6)
+
+	res := make([]*InstanceEntry, 0, len(se.Instances))
+	for _, inst := range se.Instances {
+		if tag != "" && !hasTag(inst.Tags, tag) {
+			continue
+		}
+		if d.config.OnlyPassing {
+			if last := d.node.store.LastBeat(se.Name, inst); nowMs > last && nowMs-last > threshold {
+				continue
+			}
+		}
+		res = append(res, inst)
+	}
+	return res
+}
+
+// addressRecord returns the `A` or `AAAA` record of the ip if it matches the
+// queried type, `nil` otherwise.
+func (d *DNSServer) addressRecord(name string, qtype uint16, ip net.IP) dns.RR {
+	if v4 := ip.To4(); v4 != nil {
+		if qtype != dns.TypeA && qtype != dns.TypeANY {
+			return nil
+		}
+		return &dns.A{Hdr: d.header(name, dns.TypeA), A: v4}
+	}
+	if qtype != dns.TypeAAAA && qtype != dns.TypeANY {
+		return nil
+	}
+	return &dns.AAAA{Hdr: d.header(name, dns.TypeAAAA), AAAA: ip}
+}
+
+func (d *DNSServer) header(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{
+		Name:   name,
+		Rrtype: rrtype,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(d.config.TTL.Seconds()),
+	}
+}
+
+// soa is sent in the authority section of negative answers, so that resolvers
+// cache them for no longer than the configured TTL.
+func (d *DNSServer) soa() dns.RR {
+	ttl := uint32(d.config.TTL.Seconds())
+	return &dns.SOA{
+		Hdr:     d.header(d.config.Domain, dns.TypeSOA),
+		Ns:      "ns." + d.config.Domain,
+		Mbox:    "hostmaster." + d.config.Domain,
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
+
+func addressType(ip net.IP) uint16 {
+	if ip.To4() != nil {
+		return dns.TypeA
+	}
+	return dns.TypeAAAA
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeAddr encodes the ip as a single label, e.g. `7f000001` for `127.0.0.1`.
+func encodeAddr(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return hex.EncodeToString(v4)
+	}
+	return hex.EncodeToString(ip.To16())
+}
+
+func decodeAddr(label string) net.IP {
+	b, err := hex.DecodeString(label)
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil
+	}
+	return net.IP(b)
+}
@@ -0,0 +1,210 @@
+package node
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsRecorder is a `dns.ResponseWriter` keeping the written message.
+type dnsRecorder struct {
+	msg *dns.Msg
+}
+
+var dnsTestAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+
+func (r *dnsRecorder) LocalAddr() net.Addr  { return dnsTestAddr }
+func (r *dnsRecorder) RemoteAddr() net.Addr { return dnsTestAddr }
+func (r *dnsRecorder) Close() error         { return nil }
+func (r *dnsRecorder) TsigStatus() error    { return nil }
+func (r *dnsRecorder) TsigTimersOnly(bool)  {}
+func (r *dnsRecorder) Hijack()              {}
+
+func (r *dnsRecorder) WriteMsg(m *dns.Msg) error {
+	r.msg = m
+	return nil
+}
+
+func (r *dnsRecorder) Write(b []byte) (int, error) {
+	r.msg = new(dns.Msg)
+	return len(b), r.msg.Unpack(b)
+}
+
+// newTestDNS returns a DNS server answering from a store seeded with the
+// instances of `web` (IPv4, IPv6 and hostname ones) and `api`.
+func newTestDNS(t *testing.T) (*DNSServer, *inMemStore) {
+	s := newTestStore()
+	a := &testApplier{t: t, s: s}
+	for _, reg := range []InstanceRegistration{
+		{ServiceName: "web", Host: "10.0.0.1", Port: 80, Tags: []string{"primary"}},
+		{ServiceName: "web", Host: "10.0.0.2", Port: 81},
+		{ServiceName: "web", Host: "fd00::1", Port: 82},
+		{ServiceName: "web", Host: "web-4.example.com", Port: 83},
+		{ServiceName: "api", Host: "10.0.1.1", Port: 90},
+	} {
+		a.apply(Command{Type: "REG", Value: encode(t, reg)})
+	}
+	d := NewDNSServer(DNSConfig{Domain: "Heartbeat", TTL: 30 * time.Second, AllowStale: true, HealthThreshold: time.Minute}, s.Node)
+	return d, s
+}
+
+func query(d *DNSServer, name string, qtype uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	w := &dnsRecorder{}
+	d.ServeDNS(w, req)
+	return w.msg
+}
+
+// records returns the answers as sorted `<type> <value>` strings.
+func records(rrs []dns.RR) []string {
+	out := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		switch v := rr.(type) {
+		case *dns.A:
+			out = append(out, "A "+v.A.String())
+		case *dns.AAAA:
+			out = append(out, "AAAA "+v.AAAA.String())
+		case *dns.SRV:
+			out = append(out, "SRV "+v.Target+" "+strings.TrimSpace(dns.Field(v, 3)))
+		default:
+			out = append(out, rr.String())
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestDNSAnswers(t *testing.T) {
+	d, _ := newTestDNS(t)
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer []string
+		extra  []string
+	}{
+		{"web.service.heartbeat.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.0.0.1", "A 10.0.0.2"}, nil},
+		{"WEB.Service.heartbeat.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.0.0.1", "A 10.0.0.2"}, nil},
+		{"web.service.heartbeat.", dns.TypeAAAA, dns.RcodeSuccess, []string{"AAAA fd00::1"}, nil},
+		{"web.service.heartbeat.", dns.TypeSRV, dns.RcodeSuccess, []string{
+			"SRV 0a000001.addr.heartbeat. 80",
+			"SRV 0a000002.addr.heartbeat. 81",
+			"SRV fd000000000000000000000000000001.addr.heartbeat. 82",
+			"SRV web-4.example.com. 83",
+		}, []string{"A 10.0.0.1", "A 10.0.0.2", "AAAA fd00::1"}},
+		{"primary.web.service.heartbeat.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.0.0.1"}, nil},
+		{"secondary.web.service.heartbeat.", dns.TypeA, dns.RcodeSuccess, []string{}, nil},
+		{"api.service.heartbeat.", dns.TypeAAAA, dns.RcodeSuccess, []string{}, nil},
+		{"0a000001.addr.heartbeat.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.0.0.1"}, nil},
+		{"fd000000000000000000000000000001.addr.heartbeat.", dns.TypeAAAA, dns.RcodeSuccess, []string{"AAAA fd00::1"}, nil},
+		{"0a0001.addr.heartbeat.", dns.TypeA, dns.RcodeNameError, []string{}, nil},
+		{"zz000001.addr.heartbeat.", dns.TypeA, dns.RcodeNameError, []string{}, nil},
+		{"db.service.heartbeat.", dns.TypeA, dns.RcodeNameError, []string{}, nil},
+		{"a.primary.web.service.heartbeat.", dns.TypeA, dns.RcodeNameError, []string{}, nil},
+		{"web.node.heartbeat.", dns.TypeA, dns.RcodeNameError, []string{}, nil},
+		{"web.service.example.com.", dns.TypeA, dns.RcodeRefused, []string{}, nil},
+	}
+	for _, tt := range tests {
+		m := query(d, tt.name, tt.qtype)
+		if m.Rcode != tt.rcode {
+			t.Errorf("%s %s: expected %s, got %s", dns.TypeToString[tt.qtype], tt.name, dns.RcodeToString[tt.rcode], dns.RcodeToString[m.Rcode])
+			continue
+		}
+		if got := records(m.Answer); strings.Join(got, ",") != strings.Join(tt.answer, ",") {
+			t.Errorf("%s %s: expected %v, got %v", dns.TypeToString[tt.qtype], tt.name, tt.answer, got)
+		}
+		if got := records(m.Extra); strings.Join(got, ",") != strings.Join(tt.extra, ",") {
+			t.Errorf("%s %s: expected the additional records %v, got %v", dns.TypeToString[tt.qtype], tt.name, tt.extra, got)
+		}
+		for _, rr := range m.Answer {
+			if rr.Header().Ttl != 30 || rr.Header().Name != tt.name {
+				t.Errorf("%s %s: unexpected record header %s", dns.TypeToString[tt.qtype], tt.name, rr.Header())
+			}
+		}
+		// Negative answers carry the SOA of the zone.
+		if nx := tt.rcode == dns.RcodeNameError; nx != (len(m.Ns) == 1) {
+			t.Errorf("%s %s: expected the SOA in the authority section: %v, got %v", dns.TypeToString[tt.qtype], tt.name, nx, m.Ns)
+		}
+		if !m.Authoritative {
+			t.Errorf("%s %s: expected an authoritative answer", dns.TypeToString[tt.qtype], tt.name)
+		}
+	}
+}
+
+func TestDNSRequests(t *testing.T) {
+	d, _ := newTestDNS(t)
+
+	req := new(dns.Msg)
+	req.SetQuestion("web.service.heartbeat.", dns.TypeA)
+	req.Question = append(req.Question, req.Question[0])
+	w := &dnsRecorder{}
+	d.ServeDNS(w, req)
+	if w.msg.Rcode != dns.RcodeFormatError {
+		t.Errorf("Expected a query with 2 questions to be rejected, got %s", dns.RcodeToString[w.msg.Rcode])
+	}
+
+	// Without stale reads, only the leader answers.
+	d.config.AllowStale = false
+	if m := query(d, "web.service.heartbeat.", dns.TypeA); m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected a follower to refuse the query, got %s", dns.RcodeToString[m.Rcode])
+	}
+}
+
+func TestDNSOnlyPassing(t *testing.T) {
+	d, _ := newTestDNS(t)
+	d.config.OnlyPassing = true
+	if m := query(d, "web.service.heartbeat.", dns.TypeA); len(m.Answer) != 2 {
+		t.Errorf("Expected the passing instances, got %v", records(m.Answer))
+	}
+
+	prev := LeaseCheckpointInterval
+	LeaseCheckpointInterval = 0
+	defer func() { LeaseCheckpointInterval = prev }()
+	d.config.HealthThreshold = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	if m := query(d, "web.service.heartbeat.", dns.TypeA); m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Errorf("Expected the failing instances to be left out, got %v", records(m.Answer))
+	}
+	d.config.OnlyPassing = false
+	if m := query(d, "web.service.heartbeat.", dns.TypeA); len(m.Answer) != 2 {
+		t.Errorf("Expected the failing instances, got %v", records(m.Answer))
+	}
+}
+
+func TestDNSDefaultPolicy(t *testing.T) {
+	d, s := newTestDNS(t)
+	a := &testApplier{t: t, s: s, index: 100}
+	// A token granting access doesn't matter, the queries carry none.
+	a.apply(Command{Type: "ACREATE", Value: encode(t, ACLToken{AccessorID: "a1", SecretID: "secret", Policy: ACLPolicy{
+		Services: []ACLRule{{Prefix: "", Access: ACLRead}},
+	}})})
+
+	tests := []struct {
+		acl   ACLConfig
+		rcode int
+	}{
+		{ACLConfig{}, dns.RcodeSuccess},
+		{ACLConfig{Enabled: true, DefaultPolicy: "allow"}, dns.RcodeSuccess},
+		{ACLConfig{Enabled: true, DefaultPolicy: "deny"}, dns.RcodeNameError},
+	}
+	for _, tt := range tests {
+		s.Node.ACL = tt.acl
+		for _, name := range []string{"web", "api"} {
+			m := query(d, name+".service.heartbeat.", dns.TypeA)
+			if m.Rcode != tt.rcode || (tt.rcode == dns.RcodeNameError && len(m.Answer) != 0) {
+				t.Errorf("%+v: expected %s for %s, got %s %v", tt.acl, dns.RcodeToString[tt.rcode], name, dns.RcodeToString[m.Rcode], records(m.Answer))
+			}
+		}
+	}
+
+	// The addresses are not services, the policy doesn't apply to them.
+	if m := query(d, "0a000001.addr.heartbeat.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("Expected the address to be resolved, got %v", records(m.Answer))
+	}
+}
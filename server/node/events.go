@@ -0,0 +1,81 @@
+package node
+
+// MaxTrackedEvents is the number of recent registry events kept in memory.
+var MaxTrackedEvents = 1024
+
+// recordEvent appends the event to the recent registry events and wakes up the
+// callers waiting for one. Once `MaxTrackedEvents` are tracked, the event
+// replaces the oldest one.
+// Must be called with `ms` held.
+func (s *inMemStore) recordEvent(ev ServiceEvent) {
+	if len(s.events) < MaxTrackedEvents {
+		s.events = append(s.events, ev)
+	} else {
+		s.events[s.eventsHead] = ev
+		s.eventsHead = (s.eventsHead + 1) % len(s.events)
+	}
+	for _, ch := range s.eventWaiters {
+		close(ch)
+	}
+	s.eventWaiters = nil
+}
+
+// resetEvents forgets the recent events, it's used when the registry is
+// replaced by a snapshot.
+// Must be called with `ms` held.
+func (s *inMemStore) resetEvents() {
+	s.events = s.events[:0]
+	s.eventsHead = 0
+	for _, ch := range s.eventWaiters {
+		close(ch)
+	}
+	s.eventWaiters = nil
+}
+
+// ServiceEvents returns the events recorded after `index`. Callers that are
+// further behind than the tracked events only get the ones still tracked, and
+// should read the whole registry again.
+func (s *inMemStore) ServiceEvents(index uint64) ([]ServiceEvent, <-chan struct{}) {
+	s.ms.Lock()
+	defer s.ms.Unlock()
+
+	events := make([]ServiceEvent, 0)
+	for i := range s.events {
+		if ev := s.events[(s.eventsHead+i)%len(s.events)]; ev.Index > index {
+			events = append(events, ev)
+		}
+	}
+	if len(events) > 0 {
+		return events, nil
+	}
+
+	ch := make(chan struct{})
+	s.eventWaiters = append(s.eventWaiters, ch)
+	return events, ch
+}
+
+func (s *inMemStore) DeleteService(name string) error {
+	cmd := &Command{
+		Type: "SVCDEL",
+		Key:  name,
+	}
+
+	return execCommand(cmd, s.Node.raft)
+}
+
+// execServiceDel removes a service that still has no instances, the check is
+// done again as an instance might have registered since the leader decided to
+// remove it.
+func (s *inMemStore) execServiceDel(index uint64, name string) interface{} {
+	s.ms.Lock()
+	defer s.ms.Unlock()
+
+	se, has := s.registry()[name]
+	if !has || se.Persistent || len(se.Instances) > 0 {
+		return nil
+	}
+	s.logger.Info("Removing service as it has no instances left", "service", name)
+	s.publishService(name, nil)
+	s.recordEvent(ServiceEvent{Index: index, Type: EventServiceDeleted, Service: name})
+	return nil
+}
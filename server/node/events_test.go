@@ -0,0 +1,64 @@
+package node
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServiceEventsRing(t *testing.T) {
+	prev := MaxTrackedEvents
+	MaxTrackedEvents = 3
+	defer func() { MaxTrackedEvents = prev }()
+
+	s := newTestStore()
+	a := &testApplier{t: t, s: s}
+	for port := uint16(1); port <= 5; port++ {
+		a.apply(Command{Type: "REG", Value: encode(t, InstanceRegistration{ServiceName: "web", Host: "10.0.0.1", Port: port})})
+	}
+
+	// Only the registrations of the last 3 instances are still tracked, in
+	// the order they happened.
+	events, ch := s.ServiceEvents(0)
+	if ch != nil || len(events) != 3 {
+		t.Fatalf("Expected the 3 tracked events, got %+v", events)
+	}
+	for i, ev := range events {
+		if port := uint16(i + 3); ev.Port != port || ev.Index != uint64(port) || ev.Type != EventInstanceRegistered {
+			t.Errorf("Expected event %d to register port %d, got %+v", i, port, ev)
+		}
+	}
+	if events, _ := s.ServiceEvents(4); len(events) != 1 || events[0].Port != 5 {
+		t.Errorf("Expected the single event after index 4, got %+v", events)
+	}
+
+	events, ch = s.ServiceEvents(5)
+	if len(events) != 0 || ch == nil {
+		t.Fatalf("Expected to wait for the next event, got %+v", events)
+	}
+	a.apply(Command{Type: "ENDEL", Value: encode(t, DelRequest{Name: "web", Instance: InstanceEntry{Host: "10.0.0.1", Port: 1}})})
+	select {
+	case <-ch:
+	default:
+		t.Fatalf("Expected the waiters to be woken up by the next event")
+	}
+	if events, _ := s.ServiceEvents(5); len(events) != 1 || events[0].Type != EventInstanceRemoved {
+		t.Errorf("Expected the removal of the instance, got %+v", events)
+	}
+}
+
+func TestServiceEventsOnFollower(t *testing.T) {
+	s := newTestNode(t, false)
+	srv := NewServer("", s.Node)
+
+	start := time.Now()
+	res := httptest.NewRecorder()
+	srv.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/services/events?index=1&wait=5s", nil))
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the events to be refused without a known leader, got %d: %s", res.Code, res.Body)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the events to be refused right away, it took %s", elapsed)
+	}
+}
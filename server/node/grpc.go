@@ -0,0 +1,414 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chermehdi/heartbeat/server/pb"
+	"github.com/hashicorp/go-hclog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// GrpcServer serves the `pb.Heartbeat` gRPC service, it offers the same
+// operations as the `HttpServer` on top of the same storage engine.
+type GrpcServer struct {
+	pb.UnimplementedHeartbeatServer
+
+	addr   string
+	server *grpc.Server
+
+	// TLS serves the calls over TLS when set, it must be set before `Start`.
+	TLS *Certificates
+
+	node   *Node
+	logger hclog.Logger
+}
+
+// NewGrpcServer will create a new `GrpcServer` that will listen on `addr` later
+// on after `Start` is called.
+func NewGrpcServer(addr string, node *Node) *GrpcServer {
+	return &GrpcServer{
+		addr:   addr,
+		node:   node,
+		logger: ComponentLogger("grpc"),
+	}
+}
+
+// Start will start listening for incoming calls in it's own goroutine.
+func (s *GrpcServer) Start() error {
+	s.logger.Info("Starting gRPC server", "addr", s.addr)
+
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	var opts []grpc.ServerOption
+	if s.TLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.TLS.ServerTLS("h2"))))
+	}
+	s.server = grpc.NewServer(opts...)
+	pb.RegisterHeartbeatServer(s.server, s)
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil {
+			fatal(s.logger, "Unexpected error happened", "error", err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops accepting calls and waits for the pending ones to finish.
+func (s *GrpcServer) Shutdown() {
+	s.server.GracefulStop()
+}
+
+func (s *GrpcServer) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+	heartbeatRequests.WithLabelValues("grpc").Inc()
+	if len(req.Registrations) > MaxHeartbeatBatch {
+		heartbeatErrors.WithLabelValues("grpc").Inc()
+		return nil, status.Errorf(codes.InvalidArgument, "At most %d registrations are accepted, got %d", MaxHeartbeatBatch, len(req.Registrations))
+	}
+	regs := make([]InstanceRegistration, 0, len(req.Registrations))
+	for _, r := range req.Registrations {
+		if r.Service == "" || r.Host == "" || r.Port > 65535 {
+			heartbeatErrors.WithLabelValues("grpc").Inc()
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid registration for service '%s' at '%s:%d'", r.Service, r.Host, r.Port)
+		}
+		regs = append(regs, InstanceRegistration{
+			ServiceName: r.Service,
+			Host:        r.Host,
+			Port:        uint16(r.Port),
+			Persistent:  r.Persistent,
+			Tags:        r.Tags,
+			Meta:        r.Meta,
+		})
+	}
+	if len(regs) == 0 {
+		return &pb.RegisterResponse{}, nil
+	}
+	authz, err := s.authorize(ctx)
+	if err != nil {
+		heartbeatErrors.WithLabelValues("grpc").Inc()
+		return nil, err
+	}
+	for _, reg := range regs {
+		if !authz.ServiceWrite(reg.ServiceName) {
+			heartbeatErrors.WithLabelValues("grpc").Inc()
+			return nil, errPermissionDenied
+		}
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("traceparent")) > 0 {
+		ctx = ContextWithTraceParent(ctx, md.Get("traceparent")[0])
+	}
+	ctx, span := Tracer.Start(ctx, "grpc.Register")
+	span.SetAttribute("instances", len(regs))
+	err = s.node.store.RegisterInstances(ctx, regs)
+	span.Finish(err)
+	if err != nil {
+		s.logger.Error("Registration failed", "instances", len(regs), "error", err)
+		heartbeatErrors.WithLabelValues("grpc").Inc()
+		return nil, s.writeError(err)
+	}
+	return &pb.RegisterResponse{}, nil
+}
+
+func (s *GrpcServer) Deregister(ctx context.Context, req *pb.DeregisterRequest) (*pb.DeregisterResponse, error) {
+	if req.Service == "" || req.Host == "" || req.Port > 65535 {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid instance '%s:%d' of service '%s'", req.Host, req.Port, req.Service)
+	}
+	if authz, err := s.authorize(ctx); err != nil {
+		return nil, err
+	} else if !authz.ServiceWrite(req.Service) {
+		return nil, errPermissionDenied
+	}
+	s.logger.Info("Deregistering instance", "service", req.Service, "host", req.Host, "port", req.Port)
+	instance := InstanceEntry{Host: req.Host, Port: uint16(req.Port)}
+	if err := s.node.store.DeleteInstance(req.Service, instance); err != nil {
+		return nil, s.writeError(err)
+	}
+	return &pb.DeregisterResponse{}, nil
+}
+
+func (s *GrpcServer) ListServices(ctx context.Context, req *pb.ListServicesRequest) (*pb.ListServicesResponse, error) {
+	authz, err := s.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.verifyRead(ctx, req.Mode); err != nil {
+		return nil, err
+	}
+	res := &pb.ListServicesResponse{}
+	for _, svc := range authz.FilterServices(s.node.store.GetServices().Services) {
+		out := &pb.Service{Name: svc.Name, Persistent: svc.Persistent}
+		for _, inst := range svc.Instances {
+			out.Instances = append(out.Instances, &pb.Instance{
+				Host:   inst.Host,
+				Port:   uint32(inst.Port),
+				Uptime: inst.Uptime,
+				Tags:   inst.Tags,
+				Meta:   inst.Meta,
+			})
+		}
+		res.Services = append(res.Services, out)
+	}
+	return res, nil
+}
+
+// WatchServices sends every registry event applied after the requested index,
+// the stream never ends unless the client cancels it.
+func (s *GrpcServer) WatchServices(req *pb.WatchServicesRequest, stream pb.Heartbeat_WatchServicesServer) error {
+	authz, err := s.authorize(stream.Context())
+	if err != nil {
+		return err
+	}
+	if err := s.verifyRead(stream.Context(), req.Mode); err != nil {
+		return err
+	}
+	index := req.Index
+	for {
+		events, ch := s.node.store.ServiceEvents(index)
+		if len(events) == 0 {
+			select {
+			case <-ch:
+				continue
+			case <-stream.Context().Done():
+				return nil
+			}
+		}
+		for _, ev := range events {
+			index = ev.Index
+			if !authz.ServiceRead(ev.Service) {
+				continue
+			}
+			err := stream.Send(&pb.ServiceEvent{
+				Index:   ev.Index,
+				Type:    ev.Type,
+				Service: ev.Service,
+				Host:    ev.Host,
+				Port:    uint32(ev.Port),
+			})
+			if err != nil {
+				s.logger.Debug("Stopping the services watch", "error", err)
+				return err
+			}
+		}
+	}
+}
+
+func (s *GrpcServer) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	if req.Key == "" && !req.Prefix {
+		return nil, status.Errorf(codes.InvalidArgument, "A key is required")
+	}
+	authz, err := s.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !req.Prefix && !authz.KeyRead(req.Key) {
+		return nil, errPermissionDenied
+	}
+	if err := s.verifyRead(ctx, req.Mode); err != nil {
+		return nil, err
+	}
+	entries, index := s.node.store.QueryKV(req.Key, req.Prefix)
+	entries = authz.FilterEntries(entries)
+	if !req.Prefix && len(entries) == 0 {
+		return nil, status.Errorf(codes.NotFound, "Key '%s' not found", req.Key)
+	}
+	return &pb.GetResponse{Entries: toPbEntries(entries), Index: index}, nil
+}
+
+func (s *GrpcServer) Put(ctx context.Context, req *pb.PutRequest) (*pb.PutResponse, error) {
+	if req.Key == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "A key is required")
+	}
+	if authz, err := s.authorize(ctx); err != nil {
+		return nil, err
+	} else if !authz.KeyWrite(req.Key) {
+		return nil, errPermissionDenied
+	}
+	ttl := time.Duration(req.TtlMs) * time.Millisecond
+	if err := s.node.store.PutTTL(req.Key, string(req.Value), ttl); err != nil {
+		s.logger.Error("Could not put key", "key", req.Key, "error", err)
+		return nil, s.writeError(err)
+	}
+	return &pb.PutResponse{}, nil
+}
+
+func (s *GrpcServer) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	if req.Key == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "A key is required")
+	}
+	if authz, err := s.authorize(ctx); err != nil {
+		return nil, err
+	} else if !authz.KeyWrite(req.Key) {
+		return nil, errPermissionDenied
+	}
+	if _, err := s.node.store.Delete(req.Key); err != nil {
+		s.logger.Error("Could not delete key", "key", req.Key, "error", err)
+		return nil, s.writeError(err)
+	}
+	return &pb.DeleteResponse{}, nil
+}
+
+// Watch sends the state of the key (or of the keys under the prefix) every time
+// it changes, starting with the current state unless an index is given.
+func (s *GrpcServer) Watch(req *pb.WatchRequest, stream pb.Heartbeat_WatchServer) error {
+	if req.Key == "" && !req.Prefix {
+		return status.Errorf(codes.InvalidArgument, "A key is required")
+	}
+	authz, err := s.authorize(stream.Context())
+	if err != nil {
+		return err
+	}
+	if !req.Prefix && !authz.KeyRead(req.Key) {
+		return errPermissionDenied
+	}
+	// As for the REST watch, the consistency is only checked when the stream
+	// starts.
+	if err := s.verifyRead(stream.Context(), req.Mode); err != nil {
+		return err
+	}
+
+	index := req.Index
+	for first := index == 0; ; first = false {
+		if !first {
+			ch, cancel := s.node.store.WatchKV(req.Key, req.Prefix, index)
+			select {
+			case <-ch:
+			case <-stream.Context().Done():
+				cancel()
+				return nil
+			}
+			cancel()
+		}
+
+		entries, cur := s.node.store.QueryKV(req.Key, req.Prefix)
+		index = cur
+		if err := stream.Send(&pb.WatchResponse{Index: cur, Entries: toPbEntries(authz.FilterEntries(entries))}); err != nil {
+			s.logger.Debug("Stopping the watch", "key", req.Key, "error", err)
+			return err
+		}
+	}
+}
+
+func (s *GrpcServer) ClusterInfo(ctx context.Context, req *pb.ClusterInfoRequest) (*pb.ClusterInfoResponse, error) {
+	if authz, err := s.authorize(ctx); err != nil {
+		return nil, err
+	} else if !authz.OperatorRead() {
+		return nil, errPermissionDenied
+	}
+	rft := s.node.raft
+	res := &pb.ClusterInfoResponse{
+		Id:           s.node.id,
+		State:        rft.State().String(),
+		Leader:       string(rft.Leader()),
+		LastIndex:    rft.LastIndex(),
+		AppliedIndex: rft.AppliedIndex(),
+	}
+	res.Term, _ = strconv.ParseUint(rft.Stats()["term"], 10, 64)
+	if last := s.node.LastContact(); last >= 0 {
+		res.LastContactMs = last.Milliseconds()
+	} else {
+		res.LastContactMs = -1
+	}
+
+	ft := rft.GetConfiguration()
+	if err := ft.Error(); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not get the Raft configuration: %s", err)
+	}
+	for _, srv := range ft.Configuration().Servers {
+		res.Members = append(res.Members, &pb.Member{
+			Id:       string(srv.ID),
+			Address:  string(srv.Address),
+			Suffrage: srv.Suffrage.String(),
+		})
+	}
+	return res, nil
+}
+
+var errPermissionDenied = status.Error(codes.PermissionDenied, "Permission denied")
+
+// authorize resolves the token sent in the `x-heartbeat-token` metadata, or as
+// a bearer token in `authorization`.
+func (s *GrpcServer) authorize(ctx context.Context) (*Authorizer, error) {
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("x-heartbeat-token"); len(v) > 0 {
+			token = v[0]
+		} else if v := md.Get("authorization"); len(v) > 0 {
+			token = strings.TrimPrefix(v[0], "Bearer ")
+		}
+	}
+	authz, err := s.node.Authorize(token)
+	if err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	return authz, nil
+}
+
+// verifyRead checks that this node can serve a read with the requested
+// consistency, and sends the `x-known-leader` and `x-last-contact` headers, the
+// same as the REST API's.
+func (s *GrpcServer) verifyRead(ctx context.Context, mode pb.ReadMode) error {
+	lastContact := int64(-1)
+	if last := s.node.LastContact(); last >= 0 {
+		lastContact = last.Milliseconds()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(
+		"x-known-leader", strconv.FormatBool(s.node.KnownLeader()),
+		"x-last-contact", strconv.FormatInt(lastContact, 10),
+	))
+
+	var rm ReadMode
+	switch mode {
+	case pb.ReadMode_CONSISTENT:
+		rm = ReadConsistent
+	case pb.ReadMode_STALE:
+		rm = ReadStale
+	default:
+		rm = ReadDefault
+	}
+	if err := s.node.VerifyRead(rm); err != nil {
+		s.logger.Warn("Refusing a read", "mode", rm, "error", err)
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return nil
+}
+
+// writeError maps the error of a replicated write to a status, writes sent to
+// a follower are reported as unavailable so that clients retry on the leader.
+func (s *GrpcServer) writeError(err error) error {
+	if errors.Is(err, ErrNotLeader) {
+		return status.Error(codes.Unavailable, s.node.notLeaderError().Error())
+	}
+	if errors.Is(err, ErrLeadershipTransferInProgress) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Errorf(codes.Internal, "Server error occured: %s", err)
+}
+
+func toPbEntries(entries []KVEntry) []*pb.KVEntry {
+	res := make([]*pb.KVEntry, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, &pb.KVEntry{
+			Key:            e.Key,
+			Value:          []byte(e.Value),
+			CreateIndex:    e.CreateIndex,
+			ModifyIndex:    e.ModifyIndex,
+			TtlMs:          e.TTLMs,
+			RemainingTtlMs: e.RemainingTTLMs,
+			Session:        e.Session,
+			LockIndex:      e.LockIndex,
+		})
+	}
+	return res
+}
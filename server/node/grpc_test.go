@@ -0,0 +1,46 @@
+package node
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWriteErrorOnFollower(t *testing.T) {
+	s := newTestNode(t, false)
+	srv := NewGrpcServer("", s.Node)
+
+	writes := []struct {
+		name  string
+		write func() error
+	}{
+		{"put", func() error { return s.PutTTL("k", "v", 0) }},
+		{"txn", func() error {
+			_, err := s.Txn([]TxnOp{{Verb: TxnSet, Key: "k", Value: "v"}})
+			return err
+		}},
+		{"session", func() error {
+			_, err := s.CreateSession(SessionRequest{TTL: "10s"})
+			return err
+		}},
+		{"lock", func() error {
+			_, err := s.Acquire("k", "v", "session")
+			return err
+		}},
+		{"delete", func() error {
+			_, err := s.Delete("k")
+			return err
+		}},
+	}
+	for _, w := range writes {
+		err := w.write()
+		if err == nil {
+			t.Errorf("%s: expected the write to be refused by a follower", w.name)
+			continue
+		}
+		if code := status.Code(srv.writeError(err)); code != codes.Unavailable {
+			t.Errorf("%s: expected %s for '%s', got %s", w.name, codes.Unavailable, err, code)
+		}
+	}
+}
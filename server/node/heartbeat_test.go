@@ -0,0 +1,109 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatchHeartbeat(t *testing.T) {
+	s := newTestNode(t, true)
+	srv := NewServer("", s.Node)
+	post := func(regs []InstanceRegistration) *httptest.ResponseRecorder {
+		body, err := json.Marshal(regs)
+		if err != nil {
+			t.Fatalf("Could not encode the batch: %s", err)
+		}
+		res := httptest.NewRecorder()
+		srv.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/heartbeat/batch", strings.NewReader(string(body))))
+		return res
+	}
+
+	regs := make([]InstanceRegistration, 0, 10)
+	for i := 0; i < 10; i++ {
+		regs = append(regs, InstanceRegistration{ServiceName: fmt.Sprintf("svc-%d", i%3), Host: "10.0.0.1", Port: uint16(8000 + i)})
+	}
+	before := s.Node.raft.LastIndex()
+	if res := post(regs); res.Code != http.StatusOK {
+		t.Fatalf("Expected the batch to be accepted, got %d: %s", res.Code, res.Body)
+	}
+	if entries := s.Node.raft.LastIndex() - before; entries != 1 {
+		t.Errorf("Expected the batch to be replicated as a single command, got %d entries", entries)
+	}
+	for _, r := range regs {
+		if !s.hasInstance(r.ServiceName, r.Host, r.Port) {
+			t.Errorf("Expected %s at %s:%d to be registered", r.ServiceName, r.Host, r.Port)
+		}
+	}
+
+	// Heartbeats of registered instances only renew their leases in memory,
+	// the new ones are replicated in a single command again.
+	before = s.Node.raft.LastIndex()
+	if res := post(regs); res.Code != http.StatusOK {
+		t.Fatalf("Expected the renewals to be accepted, got %d: %s", res.Code, res.Body)
+	}
+	if entries := s.Node.raft.LastIndex() - before; entries != 0 {
+		t.Errorf("Expected the renewals not to be replicated, got %d entries", entries)
+	}
+	regs = append(regs, InstanceRegistration{ServiceName: "svc-0", Host: "10.0.0.2", Port: 8000}, InstanceRegistration{ServiceName: "svc-9", Host: "10.0.0.2", Port: 8000})
+	if res := post(regs); res.Code != http.StatusOK {
+		t.Fatalf("Expected the batch to be accepted, got %d: %s", res.Code, res.Body)
+	}
+	if entries := s.Node.raft.LastIndex() - before; entries != 1 {
+		t.Errorf("Expected the new instances to be replicated as a single command, got %d entries", entries)
+	}
+	if services := len(s.registry()); services != 4 {
+		t.Errorf("Expected 4 services, got %d", services)
+	}
+
+	prev := MaxHeartbeatBatch
+	MaxHeartbeatBatch = 5
+	defer func() { MaxHeartbeatBatch = prev }()
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"empty batch", `[]`, http.StatusOK},
+		{"too large", string(encode(t, regs)), http.StatusRequestEntityTooLarge},
+		{"not a list", `{"service":"web"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		res := httptest.NewRecorder()
+		srv.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/heartbeat/batch", strings.NewReader(tt.body)))
+		if res.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.code, res.Code)
+		}
+	}
+	res := httptest.NewRecorder()
+	srv.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/heartbeat/batch", nil))
+	if res.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected a GET to be refused, got %d", res.Code)
+	}
+}
+
+func TestBatchHeartbeatACL(t *testing.T) {
+	s := newTestNode(t, true)
+	srv := NewServer("", s.Node)
+	token, err := s.CreateACLToken(ACLToken{Policy: ACLPolicy{Services: []ACLRule{{Prefix: "web", Access: ACLWrite}}}})
+	if err != nil {
+		t.Fatalf("Could not create the token: %s", err)
+	}
+	s.Node.ACL = ACLConfig{Enabled: true, DefaultPolicy: ACLDeny}
+
+	// A single service the token can't write rejects the whole batch.
+	before := s.Node.raft.LastIndex()
+	req := httptest.NewRequest(http.MethodPost, "/heartbeat/batch", strings.NewReader(`[{"service":"web","host":"10.0.0.1","port":80},{"service":"db","host":"10.0.0.1","port":5432}]`))
+	req.Header.Set("X-Heartbeat-Token", token.SecretID)
+	res := httptest.NewRecorder()
+	srv.ServeHTTP(res, req)
+	if res.Code != http.StatusForbidden {
+		t.Errorf("Expected the batch to be forbidden, got %d", res.Code)
+	}
+	if s.Node.raft.LastIndex() != before || len(s.registry()) != 0 {
+		t.Errorf("Expected nothing to be registered")
+	}
+}
@@ -1,12 +1,19 @@
 package node
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"net"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // HttpServer is the component that will interact with the outside world through
@@ -18,8 +25,11 @@ type HttpServer struct {
 	addr     string
 	listener net.Listener
 
+	// TLS serves the API over HTTPS when set, it must be set before `Start`.
+	TLS *Certificates
+
 	node   *Node
-	logger *log.Logger
+	logger hclog.Logger
 }
 
 // NewServer will create a new `HttpServer` that will listen on `addr` later on
@@ -28,14 +38,14 @@ func NewServer(addr string, node *Node) *HttpServer {
 	return &HttpServer{
 		addr:   addr,
 		node:   node,
-		logger: log.New(os.Stderr, "(Server) ", log.LstdFlags),
+		logger: ComponentLogger("server"),
 	}
 }
 
 // Start will start listening for incoming client requests.
 // The HttpServer will create and run in it's own goroutine.
 func (s *HttpServer) Start() error {
-	s.logger.Printf("Starting Http server on: '%s'", s.addr)
+	s.logger.Info("Starting Http server", "addr", s.addr)
 
 	sv := http.Server{
 		Handler: s,
@@ -43,9 +53,12 @@ func (s *HttpServer) Start() error {
 
 	listener, err := net.Listen("tcp", s.addr)
 	if err != nil {
-		s.logger.Fatalf("Cannot start a listener: %s", err)
+		s.logger.Error("Cannot start a listener", "error", err)
 		return err
 	}
+	if s.TLS != nil {
+		listener = tls.NewListener(listener, s.TLS.ServerTLS())
+	}
 
 	http.Handle("/", s)
 
@@ -53,7 +66,7 @@ func (s *HttpServer) Start() error {
 	go func() {
 		err := sv.Serve(listener)
 		if err != nil {
-			s.logger.Fatalf("Unexpected error happened: %s", err)
+			fatal(s.logger, "Unexpected error happened", "error", err)
 		}
 	}()
 
@@ -68,55 +81,671 @@ func (s *HttpServer) Shutdown() {
 // ServeHTTP is an implementation of the `http.Handler` interface to process
 // incoming client requets.
 func (s *HttpServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: res, code: http.StatusOK}
+	defer func() { observeRequest(req, rec.code, start) }()
+	res = rec
+	req = withRequestID(s.logger, req, res)
+
 	if req.URL.Path == "/join" {
 		s.handleJoin(req, res)
+	} else if req.URL.Path == "/cluster/self" {
+		s.handleClusterSelf(req, res)
+	} else if req.URL.Path == "/cluster/transfer-leadership" {
+		s.handleTransferLeadership(req, res)
+	} else if req.URL.Path == "/cluster/members" {
+		s.handleMembers(req, res)
+	} else if req.URL.Path == "/cluster/promote" || req.URL.Path == "/cluster/demote" {
+		s.handleSuffrage(req, res)
 	} else if req.URL.Path == "/services" {
 		s.handleServices(req, res)
+	} else if req.URL.Path == "/services/events" {
+		s.handleServiceEvents(req, res)
 	} else if req.URL.Path == "/heartbeat" {
 		s.handleHeartbeat(req, res)
+	} else if req.URL.Path == "/heartbeat/batch" {
+		s.handleBatchHeartbeat(req, res)
+	} else if strings.HasPrefix(req.URL.Path, "/kv/") {
+		s.handleKV(req, res)
+	} else if strings.HasPrefix(req.URL.Path, "/session/") {
+		s.handleSession(req, res)
+	} else if strings.HasPrefix(req.URL.Path, "/watch/") {
+		s.handleWatch(req, res)
+	} else if req.URL.Path == "/txn" {
+		s.handleTxn(req, res)
+	} else if req.URL.Path == "/sd/prometheus" {
+		s.handlePrometheusSD(req, res)
+	} else if strings.HasPrefix(req.URL.Path, "/acl/") {
+		s.handleACL(req, res)
+	} else if req.URL.Path == "/metrics" {
+		s.handleMetrics(req, res)
 	} else {
 		s.badRequest(res)
 	}
 }
 
 func (s *HttpServer) handleJoin(req *http.Request, res http.ResponseWriter) {
-	s.logger.Printf("Join request received")
+	s.log(req).Info("Join request received")
+	if authz := s.authorize(req, res); authz == nil {
+		return
+	} else if !authz.OperatorWrite() {
+		s.forbidden(req, res)
+		return
+	}
+	if !s.node.IsLeader() {
+		s.redirectToLeader(req, res)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		s.badRequest(res)
+		return
+	}
 	var jr JoinRequest
-	if err := json.NewDecoder(req.Body).Decode(&jr); err != nil {
+	if err := json.Unmarshal(body, &jr); err != nil {
 		s.badRequest(res)
 		return
 	}
-	s.logger.Printf("Node '%s' trying to join with address '%s'", jr.Id, jr.Addr)
-	if err := s.node.AddPeer(jr.Id, jr.Addr); err != nil {
-		s.logger.Printf("Failed to join node '%s': %s", jr.Id, err)
+	if s.node.JoinSecret != "" {
+		if err := verifyJoinRequest(s.node.JoinSecret, body, req.Header.Get(JoinSignatureHeader), jr); err != nil {
+			s.log(req).Warn("Rejecting a join request", "peer", jr.Id, "error", err)
+			res.WriteHeader(http.StatusForbidden)
+			res.Write([]byte(err.Error()))
+			return
+		}
+	}
+	addr, err := joinAddr(jr.Addr, req.RemoteAddr)
+	var httpAddr string
+	if err == nil && jr.HttpAddr != "" {
+		httpAddr, err = joinAddr(jr.HttpAddr, req.RemoteAddr)
+	}
+	if err != nil {
+		s.log(req).Warn("Rejecting a join request", "peer", jr.Id, "error", err)
+		res.WriteHeader(http.StatusForbidden)
+		res.Write([]byte(err.Error()))
+		return
+	}
+	s.log(req).Info("Node trying to join", "peer", jr.Id, "addr", addr, "force", jr.Force, "non_voter", jr.NonVoter)
+	if err := s.node.AddPeer(jr.Id, addr, jr.Force, jr.NonVoter); err != nil {
+		s.log(req).Error("Failed to join node", "peer", jr.Id, "error", err)
+		if _, ok := err.(*MemberConflictError); ok {
+			res.WriteHeader(http.StatusConflict)
+			res.Write([]byte(err.Error()))
+			return
+		}
 		s.badRequest(res)
 		return
 	}
+	if httpAddr != "" {
+		if err := s.node.store.SetMember(Member{ID: jr.Id, RaftAddr: addr, HttpAddr: httpAddr}); err != nil {
+			s.log(req).Warn("Could not record the addresses of the new member", "peer", jr.Id, "error", err)
+		}
+	}
 	res.WriteHeader(200)
 }
 
 func (s *HttpServer) handleServices(req *http.Request, res http.ResponseWriter) {
+	authz := s.authorize(req, res)
+	if authz == nil || !s.verifyRead(req, res) {
+		return
+	}
 	services := s.node.store.GetServices()
+	services.Services = authz.FilterServices(services.Services)
 	if err := json.NewEncoder(res).Encode(services); err != nil {
 		res.Write([]byte(fmt.Sprintf("Server error occured: %s", err)))
 		res.WriteHeader(http.StatusInternalServerError)
 	}
 }
 
+// handleServiceEvents returns the registry events that happened after the
+// `index` query parameter, blocking until one happens or `wait` elapses if there
+// are none yet.
+func (s *HttpServer) handleServiceEvents(req *http.Request, res http.ResponseWriter) {
+	authz := s.authorize(req, res)
+	if authz == nil {
+		return
+	}
+	var index uint64
+	if raw := req.URL.Query().Get("index"); raw != "" {
+		var err error
+		if index, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			s.badRequest(res)
+			return
+		}
+	}
+	wait, err := parseWait(req.URL.Query().Get("wait"))
+	if err != nil {
+		s.badRequest(res)
+		return
+	}
+
+	if !s.verifyRead(req, res) {
+		return
+	}
+	events, ch := s.node.store.ServiceEvents(index)
+	if len(events) == 0 {
+		select {
+		case <-ch:
+			events, _ = s.node.store.ServiceEvents(index)
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	last := index
+	if len(events) > 0 {
+		last = events[len(events)-1].Index
+	}
+	res.Header().Set("X-Heartbeat-Index", strconv.FormatUint(last, 10))
+	res.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(authz.FilterEvents(events)); err != nil {
+		s.log(req).Error("Could not write the service events", "error", err)
+	}
+}
+
 func (s *HttpServer) handleHeartbeat(req *http.Request, res http.ResponseWriter) {
+	heartbeatRequests.WithLabelValues("/heartbeat").Inc()
 	var reg InstanceRegistration
 	if err := json.NewDecoder(req.Body).Decode(&reg); err != nil {
-		s.logger.Printf("Could not parse heartbeat request: %s", err)
+		s.log(req).Warn("Could not parse heartbeat request", "error", err)
+		heartbeatErrors.WithLabelValues("/heartbeat").Inc()
+		s.badRequest(res)
+		return
+	}
+	if authz := s.authorize(req, res); authz == nil {
+		heartbeatErrors.WithLabelValues("/heartbeat").Inc()
+		return
+	} else if !authz.ServiceWrite(reg.ServiceName) {
+		heartbeatErrors.WithLabelValues("/heartbeat").Inc()
+		s.forbidden(req, res)
+		return
+	}
+
+	ctx, span := Tracer.Start(ContextWithTraceParent(req.Context(), req.Header.Get("traceparent")), "http.heartbeat")
+	span.SetAttribute("service", reg.ServiceName)
+	span.SetAttribute("host", reg.Host)
+	span.SetAttribute("port", reg.Port)
+	if !s.node.IsLeader() {
+		s.redirectToLeaderTraced(ctx, req, res)
+		span.Finish(nil)
+		return
+	}
+
+	s.log(req).Debug("Staring instance registration", "service", reg.ServiceName, "host", reg.Host, "port", reg.Port)
+	err := s.node.store.RegisterInstance(ctx, reg)
+	span.Finish(err)
+	if err != nil {
+		s.log(req).Error("Registration failed", "service", reg.ServiceName, "error", err)
+		heartbeatErrors.WithLabelValues("/heartbeat").Inc()
+		s.writeError(req, res, err)
+		return
+	}
+
+	res.WriteHeader(http.StatusOK)
+}
+
+// MaxHeartbeatBatch is the maximum number of registrations accepted in a single
+// batch heartbeat, to bound the size of the resulting Raft log entry.
+var MaxHeartbeatBatch = 1000
+
+// handleBatchHeartbeat registers a list of instances at once, typically sent by
+// an agent renewing the leases of every instance running on its host.
+func (s *HttpServer) handleBatchHeartbeat(req *http.Request, res http.ResponseWriter) {
+	if req.Method != http.MethodPost {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	heartbeatRequests.WithLabelValues("/heartbeat/batch").Inc()
+	var regs []InstanceRegistration
+	if err := json.NewDecoder(req.Body).Decode(&regs); err != nil {
+		s.log(req).Warn("Could not parse batch heartbeat request", "error", err)
+		heartbeatErrors.WithLabelValues("/heartbeat/batch").Inc()
+		s.badRequest(res)
+		return
+	}
+	if len(regs) == 0 {
+		res.WriteHeader(http.StatusOK)
+		return
+	}
+	if len(regs) > MaxHeartbeatBatch {
+		s.log(req).Warn("Rejecting a batch heartbeat", "instances", len(regs), "max", MaxHeartbeatBatch)
+		heartbeatErrors.WithLabelValues("/heartbeat/batch").Inc()
+		res.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	authz := s.authorize(req, res)
+	if authz == nil {
+		heartbeatErrors.WithLabelValues("/heartbeat/batch").Inc()
+		return
+	}
+	for _, reg := range regs {
+		if !authz.ServiceWrite(reg.ServiceName) {
+			heartbeatErrors.WithLabelValues("/heartbeat/batch").Inc()
+			s.forbidden(req, res)
+			return
+		}
+	}
+
+	ctx, span := Tracer.Start(ContextWithTraceParent(req.Context(), req.Header.Get("traceparent")), "http.heartbeat.batch")
+	span.SetAttribute("instances", len(regs))
+	if !s.node.IsLeader() {
+		s.redirectToLeaderTraced(ctx, req, res)
+		span.Finish(nil)
+		return
+	}
+
+	s.log(req).Debug("Starting batch registration", "instances", len(regs))
+	err := s.node.store.RegisterInstances(ctx, regs)
+	span.Finish(err)
+	if err != nil {
+		s.log(req).Error("Batch registration failed", "instances", len(regs), "error", err)
+		heartbeatErrors.WithLabelValues("/heartbeat/batch").Inc()
+		s.writeError(req, res, err)
+		return
+	}
+	res.WriteHeader(http.StatusOK)
+}
+
+// handleKV serves single key operations on `/kv/<key>`, the body of a `PUT` is
+// the raw value and an optional `ttl` query parameter (e.g. `30s`) makes the key
+// expire unless it gets written again.
+func (s *HttpServer) handleKV(req *http.Request, res http.ResponseWriter) {
+	key := strings.TrimPrefix(req.URL.Path, "/kv/")
+	_, recurse := req.URL.Query()["recurse"]
+	if key == "" && !(recurse && req.Method == http.MethodGet) {
+		s.badRequest(res)
+		return
+	}
+	authz := s.authorize(req, res)
+	if authz == nil {
+		return
+	}
+	if req.Method == http.MethodGet && !recurse && !authz.KeyRead(key) ||
+		(req.Method == http.MethodPut || req.Method == http.MethodDelete) && !authz.KeyWrite(key) {
+		s.forbidden(req, res)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		s.handleKVRead(key, recurse, authz, req, res)
+	case http.MethodPut:
+		if req.URL.Query().Get("acquire") != "" || req.URL.Query().Get("release") != "" {
+			s.handleLock(key, req, res)
+			return
+		}
+		var ttl time.Duration
+		if raw := req.URL.Query().Get("ttl"); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil || d < 0 {
+				s.log(req).Warn("Invalid ttl", "key", key, "ttl", raw)
+				s.badRequest(res)
+				return
+			}
+			ttl = d
+		}
+		value, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			s.badRequest(res)
+			return
+		}
+		if err := s.node.store.PutTTL(key, string(value), ttl); err != nil {
+			s.log(req).Error("Could not put key", "key", key, "error", err)
+			s.writeError(req, res, err)
+			return
+		}
+		res.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		if _, err := s.node.store.Delete(key); err != nil {
+			s.log(req).Error("Could not delete key", "key", key, "error", err)
+			s.writeError(req, res, err)
+			return
+		}
+		res.WriteHeader(http.StatusOK)
+	default:
+		res.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleKVRead returns the entry for the key, or the list of entries under the
+// key if `recurse` is set.
+//
+// When an `index` query parameter is given, the request blocks until a matching
+// key is modified after that index, or until `wait` (defaults to
+// `DefaultWatchWait`) elapses. The index to use for the next call is returned
+// in the `X-Heartbeat-Index` header.
+func (s *HttpServer) handleKVRead(key string, recurse bool, authz *Authorizer, req *http.Request, res http.ResponseWriter) {
+	var index uint64
+	var wait time.Duration
+	raw := req.URL.Query().Get("index")
+	if raw != "" {
+		var err error
+		if index, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			s.badRequest(res)
+			return
+		}
+		if wait, err = parseWait(req.URL.Query().Get("wait")); err != nil {
+			s.badRequest(res)
+			return
+		}
+	}
+
+	// Only block once this node may answer, a follower redirects right away.
+	if !s.verifyRead(req, res) {
+		return
+	}
+	if raw != "" {
+		ch, cancel := s.node.store.WatchKV(key, recurse, index)
+		select {
+		case <-ch:
+		case <-time.After(wait):
+		case <-req.Context().Done():
+		}
+		cancel()
+	}
+
+	entries, index := s.node.store.QueryKV(key, recurse)
+	entries = authz.FilterEntries(entries)
+	res.Header().Set("X-Heartbeat-Index", strconv.FormatUint(index, 10))
+	res.Header().Set("Content-Type", "application/json")
+
+	var out interface{} = entries
+	if !recurse {
+		if len(entries) == 0 {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+		out = entries[0]
+	}
+	if err := json.NewEncoder(res).Encode(out); err != nil {
+		s.log(req).Error("Could not write the entries", "key", key, "error", err)
+	}
+}
+
+// handleWatch streams a `WatchEvent` per line every time the watched key (or a
+// key under the prefix with `recurse`) changes, starting with the current state
+// unless an `index` is given.
+func (s *HttpServer) handleWatch(req *http.Request, res http.ResponseWriter) {
+	key := strings.TrimPrefix(req.URL.Path, "/watch/")
+	_, recurse := req.URL.Query()["recurse"]
+	flusher, ok := res.(http.Flusher)
+	if req.Method != http.MethodGet || !ok {
 		s.badRequest(res)
 		return
 	}
+	authz := s.authorize(req, res)
+	if authz == nil {
+		return
+	}
+	if !recurse && !authz.KeyRead(key) {
+		s.forbidden(req, res)
+		return
+	}
 
-	s.logger.Printf("Staring instance registration for service='%s' host='%s' port='%d'", reg.ServiceName, reg.Host, reg.Port)
-	s.node.store.RegisterInstance(reg)
+	var index uint64
+	raw := req.URL.Query().Get("index")
+	if raw != "" {
+		var err error
+		if index, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			s.badRequest(res)
+			return
+		}
+	}
+	// The consistency is only checked when the stream starts, the events that
+	// follow are pushed by the local state machine as commands get applied.
+	if !s.verifyRead(req, res) {
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/x-ndjson")
+	res.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(res)
+	for first := raw == ""; ; first = false {
+		if !first {
+			ch, cancel := s.node.store.WatchKV(key, recurse, index)
+			select {
+			case <-ch:
+			case <-req.Context().Done():
+				cancel()
+				return
+			}
+			cancel()
+		}
+
+		entries, cur := s.node.store.QueryKV(key, recurse)
+		index = cur
+		if err := enc.Encode(WatchEvent{Index: cur, Entries: authz.FilterEntries(entries)}); err != nil {
+			s.log(req).Debug("Stopping the watch", "key", key, "error", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// handleLock acquires or releases the lock on the key for the session given in
+// the `acquire` or `release` query parameter, the response body is `true` if
+// the operation succeeded.
+func (s *HttpServer) handleLock(key string, req *http.Request, res http.ResponseWriter) {
+	var ok bool
+	var err error
+	if session := req.URL.Query().Get("acquire"); session != "" {
+		value, rerr := ioutil.ReadAll(req.Body)
+		if rerr != nil {
+			s.badRequest(res)
+			return
+		}
+		ok, err = s.node.store.Acquire(key, string(value), session)
+	} else {
+		ok, err = s.node.store.Release(key, req.URL.Query().Get("release"))
+	}
+	if err != nil {
+		s.log(req).Error("Lock operation failed", "key", key, "error", err)
+		s.writeError(req, res, err)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(ok)
+}
+
+// handleSession serves the session endpoints:
+//   - `PUT /session/create` with a `SessionRequest` body.
+//   - `PUT /session/renew/<id>` and `PUT /session/destroy/<id>`.
+//   - `GET /session/list`.
+func (s *HttpServer) handleSession(req *http.Request, res http.ResponseWriter) {
+	path := strings.TrimPrefix(req.URL.Path, "/session/")
+	authz := s.authorize(req, res)
+	if authz == nil {
+		return
+	}
+
+	if path == "list" {
+		if req.Method != http.MethodGet {
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !authz.SessionRead() {
+			s.forbidden(req, res)
+			return
+		}
+		if !s.verifyRead(req, res) {
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(s.node.store.GetSessions())
+		return
+	}
+
+	if req.Method != http.MethodPut && req.Method != http.MethodPost {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !authz.SessionWrite() {
+		s.forbidden(req, res)
+		return
+	}
+
+	var err error
+	switch {
+	case path == "create":
+		var sr SessionRequest
+		if err := json.NewDecoder(req.Body).Decode(&sr); err != nil {
+			s.log(req).Warn("Could not parse session request", "error", err)
+			s.badRequest(res)
+			return
+		}
+		var sess *Session
+		if sess, err = s.node.store.CreateSession(sr); err == nil {
+			res.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(res).Encode(sess)
+			return
+		}
+	case strings.HasPrefix(path, "renew/"):
+		err = s.node.store.RenewSession(strings.TrimPrefix(path, "renew/"))
+	case strings.HasPrefix(path, "destroy/"):
+		err = s.node.store.DestroySession(strings.TrimPrefix(path, "destroy/"))
+	default:
+		s.badRequest(res)
+		return
+	}
 
+	if err != nil {
+		s.log(req).Error("Session request failed", "request", path, "error", err)
+		s.writeError(req, res, err)
+		return
+	}
 	res.WriteHeader(http.StatusOK)
 }
 
+func (s *HttpServer) handleTxn(req *http.Request, res http.ResponseWriter) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var ops []TxnOp
+	if err := json.NewDecoder(req.Body).Decode(&ops); err != nil {
+		s.log(req).Warn("Could not parse transaction request", "error", err)
+		s.badRequest(res)
+		return
+	}
+	authz := s.authorize(req, res)
+	if authz == nil {
+		return
+	}
+	for _, op := range ops {
+		if !authz.TxnOp(op) {
+			s.forbidden(req, res)
+			return
+		}
+	}
+
+	txn, err := s.node.store.Txn(ops)
+	if err != nil {
+		s.log(req).Error("Transaction failed", "error", err)
+		s.writeError(req, res, err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	// A rolled back transaction is reported as a conflict, the body still
+	// describes which operations failed.
+	if len(txn.Errors) > 0 {
+		res.WriteHeader(http.StatusConflict)
+	}
+	if err := json.NewEncoder(res).Encode(txn); err != nil {
+		s.log(req).Error("Could not write the transaction response", "error", err)
+	}
+}
+
+// handleMetrics serves the Prometheus metrics to the tokens that can read the
+// operator's data.
+func (s *HttpServer) handleMetrics(req *http.Request, res http.ResponseWriter) {
+	if authz := s.authorize(req, res); authz == nil {
+		return
+	} else if !authz.OperatorRead() {
+		s.forbidden(req, res)
+		return
+	}
+	promhttp.Handler().ServeHTTP(res, req)
+}
+
+// verifyRead checks that this node can serve the read with the consistency
+// requested through the `consistent` or `stale` query parameters, and sets the
+// `X-Known-Leader` and `X-Last-Contact` (in milliseconds, `-1` if the leader was
+// never contacted) headers describing how fresh the local state is.
+//
+// The reads that only the leader can serve are redirected to it when this node
+// is a follower. If the read can't be served, the error response is written
+// and false is returned.
+func (s *HttpServer) verifyRead(req *http.Request, res http.ResponseWriter) bool {
+	_, consistent := req.URL.Query()["consistent"]
+	_, stale := req.URL.Query()["stale"]
+	mode, err := ParseReadMode(consistent, stale)
+	if err != nil {
+		s.badRequest(res)
+		return false
+	}
+
+	res.Header().Set("X-Known-Leader", strconv.FormatBool(s.node.KnownLeader()))
+	lastContact := s.node.LastContact()
+	if lastContact >= 0 {
+		res.Header().Set("X-Last-Contact", strconv.FormatInt(lastContact.Milliseconds(), 10))
+	} else {
+		res.Header().Set("X-Last-Contact", "-1")
+	}
+
+	if mode != ReadStale && !s.node.IsLeader() {
+		s.redirectToLeader(req, res)
+		return false
+	}
+	if err := s.node.VerifyRead(mode); err != nil {
+		s.log(req).Warn("Refusing a read", "mode", mode, "error", err)
+		res.WriteHeader(http.StatusServiceUnavailable)
+		res.Write([]byte(fmt.Sprintf("Server error occured: %s", err)))
+		return false
+	}
+	return true
+}
+
+// parseWait parses the `wait` parameter of blocking queries, capping it to
+// `MaxWatchWait`.
+func parseWait(raw string) (time.Duration, error) {
+	if raw == "" {
+		return DefaultWatchWait, nil
+	}
+	wait, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, err
+	}
+	if wait > MaxWatchWait {
+		wait = MaxWatchWait
+	}
+	return wait, nil
+}
+
+// log returns the logger of the request, carrying its ID.
+func (s *HttpServer) log(req *http.Request) hclog.Logger {
+	return requestLogger(req, s.logger)
+}
+
 func (s *HttpServer) badRequest(res http.ResponseWriter) {
 	res.WriteHeader(http.StatusBadRequest)
 }
+
+// writeError answers a request whose replicated write failed, the writes sent
+// to a follower are redirected to the leader.
+func (s *HttpServer) writeError(req *http.Request, res http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNotLeader) {
+		s.redirectToLeader(req, res)
+		return
+	}
+	if errors.Is(err, ErrLeadershipTransferInProgress) {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		res.Write([]byte(fmt.Sprintf("Server error occured: %s", err)))
+		return
+	}
+	res.WriteHeader(http.StatusInternalServerError)
+	res.Write([]byte(fmt.Sprintf("Server error occured: %s", err)))
+}
@@ -0,0 +1,45 @@
+package node
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFollowerWritesRedirect(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	follower := NewServer("", nodes[1].Node)
+	alone := NewServer("", newTestNode(t, false).Node)
+
+	tests := []struct {
+		method string
+		target string
+		body   string
+	}{
+		{http.MethodPut, "/kv/k", "v"},
+		{http.MethodDelete, "/kv/k", ""},
+		{http.MethodPost, "/txn", `[{"verb":"set","key":"k","value":"v"}]`},
+		{http.MethodPost, "/heartbeat", `{"service":"web","host":"10.0.0.1","port":80}`},
+		{http.MethodPost, "/heartbeat/batch", `[{"service":"web","host":"10.0.0.1","port":80}]`},
+		{http.MethodPut, "/session/create", `{"ttl":"10s"}`},
+		{http.MethodPut, "/kv/k?acquire=session", "v"},
+		{http.MethodPut, "/kv/k?release=session", ""},
+	}
+	for _, tt := range tests {
+		res := httptest.NewRecorder()
+		follower.ServeHTTP(res, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+		if res.Code != http.StatusTemporaryRedirect {
+			t.Errorf("%s %s: expected a redirection to the leader, got %d: %s", tt.method, tt.target, res.Code, res.Body)
+		} else if loc := res.Header().Get("Location"); loc != "http://"+nodes[0].Node.id+":9000"+tt.target {
+			t.Errorf("%s %s: expected a redirection to %s, got '%s'", tt.method, tt.target, nodes[0].Node.id, loc)
+		}
+
+		// Without a known leader the write can't be redirected.
+		res = httptest.NewRecorder()
+		alone.ServeHTTP(res, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+		if res.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s %s: expected the write to be unavailable without a leader, got %d: %s", tt.method, tt.target, res.Code, res.Body)
+		}
+	}
+}
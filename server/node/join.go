@@ -0,0 +1,163 @@
+package node
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// MaxJoinClockSkew bounds how old (or how far in the future) the time of a
+// signed join request can be, to limit how long a captured request can be
+// replayed.
+var MaxJoinClockSkew = time.Minute
+
+// JoinRetryInterval is the wait after the first round of failed join attempts,
+// it doubles after every round up to MaxJoinRetryInterval.
+var (
+	JoinRetryInterval    = time.Second
+	MaxJoinRetryInterval = 30 * time.Second
+)
+
+// JoinConfig describes how a node joins an existing cluster.
+type JoinConfig struct {
+	// Seeds are HTTP addresses of members of the cluster, any of them will
+	// redirect the request to the leader.
+	Seeds   []string
+	Request JoinRequest
+	// Secret signs the request if set, and Token is the ACL token sent with
+	// it.
+	Secret string
+	Token  string
+	// TLS makes the requests over HTTPS when set.
+	TLS *tls.Config
+}
+
+// JoinCluster sends the join request to the seeds in turn until one of them
+// (or the leader it redirects to) accepts it, waiting longer between every
+// round. It only gives up if the request is refused for a reason retrying
+// won't fix: a wrong secret, token or address, or a conflicting member.
+func JoinCluster(config JoinConfig) error {
+	logger := ComponentLogger("join")
+	client, scheme := &http.Client{Timeout: 10 * time.Second}, "http"
+	if config.TLS != nil {
+		client.Transport = &http.Transport{TLSClientConfig: config.TLS}
+		scheme = "https"
+	}
+
+	wait := JoinRetryInterval
+	for {
+		for _, seed := range config.Seeds {
+			status, err := sendJoin(client, fmt.Sprintf("%s://%s/join", scheme, seed), config)
+			if err == nil {
+				logger.Info("Joined the cluster", "seed", seed)
+				return nil
+			}
+			if status == http.StatusForbidden || status == http.StatusConflict {
+				return err
+			}
+			logger.Warn("Join attempt failed", "seed", seed, "error", err)
+		}
+		logger.Info("Retrying to join the cluster", "wait", wait)
+		time.Sleep(wait)
+		if wait *= 2; wait > MaxJoinRetryInterval {
+			wait = MaxJoinRetryInterval
+		}
+	}
+}
+
+// sendJoin sends a single join request, signed at the time it's sent, and
+// returns the status of the response if there was one.
+func sendJoin(client *http.Client, url string, config JoinConfig) (int, error) {
+	jr := config.Request
+	jr.Time = time.Now().Unix()
+	b, err := json.Marshal(jr)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if config.Token != "" {
+		req.Header.Set("X-Heartbeat-Token", config.Token)
+	}
+	if config.Secret != "" {
+		req.Header.Set(JoinSignatureHeader, SignJoinRequest(config.Secret, b))
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, fmt.Errorf("%s answered with status %d: %s", res.Request.URL.Host, res.StatusCode, msg)
+	}
+	return res.StatusCode, nil
+}
+
+// JoinSignatureHeader carries the signature of a join request's body.
+const JoinSignatureHeader = "X-Heartbeat-Join-Signature"
+
+// SignJoinRequest returns the signature of the body of a join request, an
+// HMAC-SHA256 keyed with the cluster's join secret.
+func SignJoinRequest(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyJoinRequest checks the signature of the join request and that it was
+// signed recently.
+func verifyJoinRequest(secret string, body []byte, signature string, jr JoinRequest) error {
+	expected := SignJoinRequest(secret, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("Invalid join request signature")
+	}
+	skew := time.Since(time.Unix(jr.Time, 0))
+	if skew > MaxJoinClockSkew || skew < -MaxJoinClockSkew {
+		return fmt.Errorf("The join request was signed %s ago, at most %s is allowed", skew.Round(time.Second), MaxJoinClockSkew)
+	}
+	return nil
+}
+
+// joinAddr checks an address a node asks to join with against the address the
+// request came from, and returns the address to record. An address without a
+// host (e.g. `:9999`) or with an unspecified one gets the request's source
+// host.
+func joinAddr(addr, remoteAddr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port == "" {
+		return "", fmt.Errorf("Invalid address '%s'", addr)
+	}
+	source, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return "", err
+	}
+	sourceIP := net.ParseIP(source)
+
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		return net.JoinHostPort(source, port), nil
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = net.LookupIP(host); err != nil {
+			return "", fmt.Errorf("Could not resolve '%s': %s", host, err)
+		}
+	}
+	for _, ip := range ips {
+		if ip.Equal(sourceIP) {
+			return addr, nil
+		}
+	}
+	return "", fmt.Errorf("The address '%s' doesn't match the source of the request '%s'", addr, source)
+}
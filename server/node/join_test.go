@@ -0,0 +1,200 @@
+package node
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVerifyJoinRequest(t *testing.T) {
+	sign := func(jr JoinRequest, secret string) ([]byte, string) {
+		body, err := json.Marshal(jr)
+		if err != nil {
+			t.Fatalf("Could not encode the join request: %s", err)
+		}
+		return body, SignJoinRequest(secret, body)
+	}
+	now := time.Now().Unix()
+	jr := JoinRequest{Id: "node-2", Addr: "10.0.0.2:9999", Time: now}
+
+	tests := []struct {
+		name  string
+		req   func() ([]byte, string, JoinRequest)
+		valid bool
+	}{
+		{"valid", func() ([]byte, string, JoinRequest) {
+			body, sig := sign(jr, "secret")
+			return body, sig, jr
+		}, true},
+		{"wrong secret", func() ([]byte, string, JoinRequest) {
+			body, sig := sign(jr, "other")
+			return body, sig, jr
+		}, false},
+		{"no signature", func() ([]byte, string, JoinRequest) {
+			body, _ := sign(jr, "secret")
+			return body, "", jr
+		}, false},
+		{"time changed after signing", func() ([]byte, string, JoinRequest) {
+			_, sig := sign(jr, "secret")
+			fresh := jr
+			fresh.Time = now + 1
+			body, _ := sign(fresh, "secret")
+			return body, sig, fresh
+		}, false},
+		{"replayed after the allowed skew", func() ([]byte, string, JoinRequest) {
+			old := jr
+			old.Time = now - int64((MaxJoinClockSkew + time.Minute).Seconds())
+			body, sig := sign(old, "secret")
+			return body, sig, old
+		}, false},
+		{"signed in the future", func() ([]byte, string, JoinRequest) {
+			future := jr
+			future.Time = now + int64((MaxJoinClockSkew + time.Minute).Seconds())
+			body, sig := sign(future, "secret")
+			return body, sig, future
+		}, false},
+	}
+	for _, tt := range tests {
+		body, sig, req := tt.req()
+		err := verifyJoinRequest("secret", body, sig, req)
+		if tt.valid && err != nil {
+			t.Errorf("%s: expected the request to be accepted, got %s", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: expected the request to be rejected", tt.name)
+		}
+	}
+}
+
+func TestJoinAddr(t *testing.T) {
+	tests := []struct {
+		addr     string
+		remote   string
+		expected string
+	}{
+		{"10.0.0.2:9999", "10.0.0.2:51000", "10.0.0.2:9999"},
+		{":9999", "10.0.0.2:51000", "10.0.0.2:9999"},
+		{"0.0.0.0:9999", "10.0.0.2:51000", "10.0.0.2:9999"},
+		{":9999", "[fd00::2]:51000", "[fd00::2]:9999"},
+		{"localhost:9999", "127.0.0.1:51000", "localhost:9999"},
+		// The address must match the source of the request.
+		{"10.0.0.3:9999", "10.0.0.2:51000", ""},
+		{"localhost:9999", "10.0.0.2:51000", ""},
+		{"10.0.0.2", "10.0.0.2:51000", ""},
+	}
+	for _, tt := range tests {
+		addr, err := joinAddr(tt.addr, tt.remote)
+		if tt.expected == "" {
+			if err == nil {
+				t.Errorf("Expected '%s' from '%s' to be rejected, got '%s'", tt.addr, tt.remote, addr)
+			}
+			continue
+		}
+		if err != nil || addr != tt.expected {
+			t.Errorf("Expected '%s' from '%s' to be recorded as '%s', got '%s' (%v)", tt.addr, tt.remote, tt.expected, addr, err)
+		}
+	}
+}
+
+// joinSeed is a seed answering the join requests with the statuses in turn,
+// then with the last one, a 307 redirects to `redirect`.
+type joinSeed struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	redirect string
+	bodies   [][]byte
+	headers  []http.Header
+}
+
+func newJoinSeed(t *testing.T, statuses ...int) *joinSeed {
+	seed := &joinSeed{statuses: statuses}
+	seed.Server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		seed.mu.Lock()
+		defer seed.mu.Unlock()
+		seed.bodies = append(seed.bodies, body)
+		seed.headers = append(seed.headers, req.Header)
+		status := seed.statuses[0]
+		if len(seed.statuses) > 1 {
+			seed.statuses = seed.statuses[1:]
+		}
+		if status == http.StatusTemporaryRedirect {
+			res.Header().Set("Location", seed.redirect+req.URL.Path)
+		}
+		res.WriteHeader(status)
+	}))
+	t.Cleanup(seed.Close)
+	return seed
+}
+
+func (s *joinSeed) addr() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+func (s *joinSeed) attempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.bodies)
+}
+
+func TestJoinCluster(t *testing.T) {
+	prev := JoinRetryInterval
+	JoinRetryInterval = time.Millisecond
+	defer func() { JoinRetryInterval = prev }()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	closed.Close()
+
+	// The leader is unavailable at first, the node retries the seeds until
+	// the one redirecting to the leader succeeds.
+	leader := newJoinSeed(t, http.StatusServiceUnavailable, http.StatusOK)
+	unavailable := newJoinSeed(t, http.StatusServiceUnavailable)
+	follower := newJoinSeed(t, http.StatusTemporaryRedirect)
+	follower.redirect = leader.URL
+	config := JoinConfig{
+		Seeds:   []string{closed.Addr().String(), unavailable.addr(), follower.addr()},
+		Request: JoinRequest{Id: "node-2", Addr: "127.0.0.1:9999"},
+		Secret:  "secret",
+		Token:   "token",
+	}
+	if err := JoinCluster(config); err != nil {
+		t.Fatalf("Expected the node to join, got %s", err)
+	}
+	if unavailable.attempts() != 2 || follower.attempts() != 2 || leader.attempts() != 2 {
+		t.Errorf("Expected 2 rounds of attempts, got %d, %d and %d", unavailable.attempts(), follower.attempts(), leader.attempts())
+	}
+	// The redirected request keeps its signed body and token.
+	var jr JoinRequest
+	body, header := leader.bodies[1], leader.headers[1]
+	if err := json.Unmarshal(body, &jr); err != nil || jr.Id != "node-2" || jr.Addr != "127.0.0.1:9999" {
+		t.Errorf("Unexpected join request %s", body)
+	}
+	if err := verifyJoinRequest("secret", body, header.Get(JoinSignatureHeader), jr); err != nil {
+		t.Errorf("Expected the redirected request to be signed, got %s", err)
+	}
+	if header.Get("X-Heartbeat-Token") != "token" {
+		t.Errorf("Expected the redirected request to carry the token, got %v", header)
+	}
+
+	// The refusals retrying won't fix end the attempts.
+	for _, status := range []int{http.StatusForbidden, http.StatusConflict} {
+		refusing, other := newJoinSeed(t, status), newJoinSeed(t, http.StatusOK)
+		config.Seeds = []string{refusing.addr(), other.addr()}
+		if err := JoinCluster(config); err == nil {
+			t.Errorf("%d: expected the join to fail", status)
+		}
+		if refusing.attempts() != 1 || other.attempts() != 0 {
+			t.Errorf("%d: expected a single attempt, got %d and %d", status, refusing.attempts(), other.attempts())
+		}
+	}
+}
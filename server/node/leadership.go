@@ -0,0 +1,216 @@
+package node
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// ErrLeadershipTransferInProgress is returned for the writes sent to a leader
+// that is handing the leadership over, they must be retried on the new leader.
+var ErrLeadershipTransferInProgress = raft.ErrLeadershipTransferInProgress
+
+// LeadershipTransferTimeout bounds how long the transfer waits for the new
+// leader to be known once this node stepped down.
+var LeadershipTransferTimeout = 5 * time.Second
+
+// MemberChangeError is returned when an operator asks for a change that the
+// targeted member can't go through, e.g. transferring the leadership to a
+// non-voter.
+type MemberChangeError struct {
+	ID     string
+	Action string
+	Reason string
+}
+
+func (e *MemberChangeError) Error() string {
+	return fmt.Sprintf("Can't %s '%s': %s", e.Action, e.ID, e.Reason)
+}
+
+// TransferLeadership hands the leadership over to the voter with the given ID,
+// or to the most up to date voter if it's empty, and returns the new leader.
+//
+// The lease renewals tracked in memory are replicated first so that the new
+// leader doesn't start from stale leases, and the leader-only loops of the
+// `Cleaner` stop while the transfer is in progress.
+func (n *Node) TransferLeadership(target string) (Member, error) {
+	if !n.IsLeader() {
+		return Member{}, n.notLeaderError()
+	}
+	var server *raft.Server
+	if target != "" {
+		confFt := n.raft.GetConfiguration()
+		if err := confFt.Error(); err != nil {
+			return Member{}, err
+		}
+		for _, srv := range confFt.Configuration().Servers {
+			if srv.ID == raft.ServerID(target) {
+				srv := srv
+				server = &srv
+			}
+		}
+		switch {
+		case server == nil:
+			return Member{}, &MemberChangeError{ID: target, Action: "transfer the leadership to", Reason: "not a member of the cluster"}
+		case target == n.id:
+			return Member{}, &MemberChangeError{ID: target, Action: "transfer the leadership to", Reason: "it's already the leader"}
+		case server.Suffrage != raft.Voter:
+			return Member{}, &MemberChangeError{ID: target, Action: "transfer the leadership to", Reason: "not a voter"}
+		}
+	}
+
+	if err := n.store.CheckpointLeases(); err != nil {
+		n.logger.Warn("Could not checkpoint the lease renewals before the leadership transfer", "error", err)
+	}
+	n.lmu.Lock()
+	n.transferring = true
+	n.lmu.Unlock()
+	defer func() {
+		n.lmu.Lock()
+		n.transferring = false
+		n.lmu.Unlock()
+	}()
+
+	n.logger.Info("Transferring the leadership", "target", target)
+	var ft raft.Future
+	if server != nil {
+		ft = n.raft.LeadershipTransferToServer(server.ID, server.Address)
+	} else {
+		ft = n.raft.LeadershipTransfer()
+	}
+	if err := ft.Error(); err != nil {
+		n.logger.Error("The leadership transfer failed", "target", target, "error", err)
+		return Member{}, err
+	}
+	return n.waitLeader(LeadershipTransferTimeout), nil
+}
+
+// waitLeader waits for another node to be known as the leader and to announce
+// its HTTP address, and returns it. The transfer completes before this node
+// steps down, so it still believes it's the leader for a moment.
+func (n *Node) waitLeader(timeout time.Duration) Member {
+	var leader Member
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		leader = Member{RaftAddr: string(n.raft.Leader())}
+		if leader.RaftAddr == "" {
+			continue
+		}
+		if confFt := n.raft.GetConfiguration(); confFt.Error() == nil {
+			for _, srv := range confFt.Configuration().Servers {
+				if srv.Address == raft.ServerAddress(leader.RaftAddr) {
+					leader.ID = string(srv.ID)
+				}
+			}
+		}
+		if leader.ID == n.id {
+			continue
+		}
+		for _, m := range n.store.GetMembers() {
+			if m.RaftAddr == leader.RaftAddr {
+				leader.HttpAddr = m.HttpAddr
+			}
+		}
+		if leader.HttpAddr != "" {
+			break
+		}
+	}
+	return leader
+}
+
+// leading reports whether this node is the leader and is not handing the
+// leadership over, the leader-only loops only run then.
+func (n *Node) leading() bool {
+	n.lmu.Lock()
+	defer n.lmu.Unlock()
+	return n.IsLeader() && !n.transferring
+}
+
+// handleTransferLeadership serves `POST /cluster/transfer-leadership`, with
+// the ID of the new leader in the optional `id` parameter.
+func (s *HttpServer) handleTransferLeadership(req *http.Request, res http.ResponseWriter) {
+	if req.Method != http.MethodPost {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if authz := s.authorize(req, res); authz == nil {
+		return
+	} else if !authz.OperatorWrite() {
+		s.forbidden(req, res)
+		return
+	}
+	if !s.node.IsLeader() {
+		s.redirectToLeader(req, res)
+		return
+	}
+
+	target := req.URL.Query().Get("id")
+	s.log(req).Info("Leadership transfer requested", "target", target)
+	leader, err := s.node.TransferLeadership(target)
+	if err != nil {
+		if _, ok := err.(*MemberChangeError); ok {
+			res.WriteHeader(http.StatusBadRequest)
+			res.Write([]byte(err.Error()))
+			return
+		}
+		s.writeError(req, res, err)
+		return
+	}
+	s.log(req).Info("Transferred the leadership", "leader", leader.ID, "addr", leader.RaftAddr)
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(leader)
+}
+
+// RequestLeadershipTransfer asks the servers in turn to transfer the
+// leadership to the member with the given ID, the followers redirect the
+// request to the leader.
+func RequestLeadershipTransfer(servers []string, target, token string, config *tls.Config) (Member, error) {
+	var leader Member
+	body, err := sendOperatorRequest(servers, "/cluster/transfer-leadership?id="+url.QueryEscape(target), token, config)
+	if err != nil {
+		return leader, err
+	}
+	return leader, json.Unmarshal(body, &leader)
+}
+
+// sendOperatorRequest posts an operator request to the servers in turn and
+// returns the body of the answer. A server that can't be reached, or doesn't
+// know the leader, is skipped.
+func sendOperatorRequest(servers []string, path, token string, config *tls.Config) ([]byte, error) {
+	client, scheme := &http.Client{Timeout: LeadershipTransferTimeout + 10*time.Second}, "http"
+	if config != nil {
+		client.Transport = &http.Transport{TLSClientConfig: config}
+		scheme = "https"
+	}
+
+	err := fmt.Errorf("No server to send the request to")
+	for _, addr := range servers {
+		req, rerr := http.NewRequest(http.MethodPost, fmt.Sprintf("%s://%s%s", scheme, addr, path), nil)
+		if rerr != nil {
+			return nil, rerr
+		}
+		if token != "" {
+			req.Header.Set("X-Heartbeat-Token", token)
+		}
+		res, derr := client.Do(req)
+		if derr != nil {
+			err = derr
+			continue
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			return body, nil
+		}
+		err = fmt.Errorf("%s answered with status %d: %s", res.Request.URL.Host, res.StatusCode, body)
+		if res.StatusCode != http.StatusServiceUnavailable {
+			return nil, err
+		}
+	}
+	return nil, err
+}
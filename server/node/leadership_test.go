@@ -0,0 +1,144 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForNewLeader waits for every node to agree on a leader other than
+// `previous`, and returns it.
+func waitForNewLeader(t *testing.T, previous *inMemStore, nodes []*inMemStore) *inMemStore {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, s := range nodes {
+			if s == previous || s.Node.LeaderSince().IsZero() {
+				continue
+			}
+			agreed := true
+			for _, other := range nodes {
+				agreed = agreed && other.Node.LeaderHttpAddr() == s.Node.HttpAddr
+			}
+			if agreed {
+				return s
+			}
+		}
+	}
+	t.Fatalf("No new leader was elected")
+	return nil
+}
+
+func TestTransferLeadership(t *testing.T) {
+	nodes := newTestCluster(t, 3)
+	leader, follower := nodes[0], nodes[1]
+
+	if _, err := follower.Node.TransferLeadership(""); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("Expected a follower to refuse the transfer, got %v", err)
+	}
+	for _, target := range []string{"node-9", leader.Node.id} {
+		if _, err := leader.Node.TransferLeadership(target); err == nil {
+			t.Errorf("%s: expected the transfer to be refused", target)
+		} else if _, ok := err.(*MemberChangeError); !ok {
+			t.Errorf("%s: expected a member change error, got %s", target, err)
+		}
+	}
+	if !leader.Node.IsLeader() {
+		t.Fatalf("Expected the refused transfers to keep the leader")
+	}
+
+	target := nodes[2]
+	m, err := leader.Node.TransferLeadership(target.Node.id)
+	if err != nil {
+		t.Fatalf("Could not transfer the leadership: %s", err)
+	}
+	if m.ID != target.Node.id || m.HttpAddr != target.Node.HttpAddr {
+		t.Errorf("Expected the target to lead, got %+v", m)
+	}
+	if waitForNewLeader(t, leader, nodes) != target {
+		t.Errorf("Expected %s to be the leader", target.Node.id)
+	}
+	if leader.Node.leading() {
+		t.Errorf("Expected the previous leader to stop its leader-only loops")
+	}
+
+	// Without a target, the leadership goes to any other voter.
+	m, err = target.Node.TransferLeadership("")
+	if err != nil {
+		t.Fatalf("Could not transfer the leadership: %s", err)
+	}
+	if m.ID == target.Node.id || m.ID == "" {
+		t.Errorf("Expected another node to lead, got %+v", m)
+	}
+	waitForNewLeader(t, target, nodes)
+}
+
+func TestTransferLeadershipEndpoint(t *testing.T) {
+	nodes := newTestCluster(t, 3)
+	leader, follower := NewServer("", nodes[0].Node), NewServer("", nodes[1].Node)
+	post := func(srv *HttpServer, query string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		srv.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/cluster/transfer-leadership"+query, nil))
+		return res
+	}
+
+	res := post(follower, "?id=node-3")
+	if res.Code != http.StatusTemporaryRedirect || res.Header().Get("Location") != "http://"+nodes[0].Node.HttpAddr+"/cluster/transfer-leadership?id=node-3" {
+		t.Errorf("Expected a follower to redirect to the leader, got %d %v", res.Code, res.Header())
+	}
+	if res := post(leader, "?id=node-9"); res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), "not a member") {
+		t.Errorf("Expected an unknown target to be refused, got %d: %s", res.Code, res.Body)
+	}
+	res = httptest.NewRecorder()
+	leader.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/cluster/transfer-leadership", nil))
+	if res.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected a GET to be refused, got %d", res.Code)
+	}
+
+	res = post(leader, "?id="+nodes[1].Node.id)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected the transfer to succeed, got %d: %s", res.Code, res.Body)
+	}
+	var m Member
+	if err := json.Unmarshal(res.Body.Bytes(), &m); err != nil || m.ID != nodes[1].Node.id || m.HttpAddr != nodes[1].Node.HttpAddr {
+		t.Errorf("Expected the new leader in the answer, got %s", res.Body)
+	}
+	waitForNewLeader(t, nodes[0], nodes)
+
+	// The previous leader now redirects the operators to the new one.
+	if res := post(leader, ""); res.Code != http.StatusTemporaryRedirect || !strings.HasPrefix(res.Header().Get("Location"), "http://"+nodes[1].Node.HttpAddr+"/") {
+		t.Errorf("Expected the previous leader to redirect, got %d %v", res.Code, res.Header())
+	}
+}
+
+func TestSendOperatorRequest(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	leader := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.URL.Query().Get("id") != "node-2" || req.Header.Get("X-Heartbeat-Token") != "token" {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		res.Write([]byte(`{"id":"node-2","raft_addr":"10.0.0.2:9999","http_addr":"10.0.0.2:9000"}`))
+	}))
+	defer leader.Close()
+	addr := func(srv *httptest.Server) string { return strings.TrimPrefix(srv.URL, "http://") }
+
+	// The servers without a leader are skipped.
+	m, err := RequestLeadershipTransfer([]string{addr(unavailable), addr(leader)}, "node-2", "token", nil)
+	if err != nil || m.ID != "node-2" || m.HttpAddr != "10.0.0.2:9000" {
+		t.Errorf("Expected the new leader, got %+v (%v)", m, err)
+	}
+	// Any other refusal ends the attempts.
+	if _, err := RequestLeadershipTransfer([]string{addr(leader), addr(unavailable)}, "node-3", "token", nil); err == nil {
+		t.Errorf("Expected the refused transfer to fail")
+	}
+	if _, err := RequestLeadershipTransfer([]string{addr(unavailable)}, "node-2", "token", nil); err == nil {
+		t.Errorf("Expected the transfer to fail without a leader")
+	}
+}
@@ -0,0 +1,257 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// LeaseCheckpointInterval is how often the leader replicates the lease
+// renewals it has been tracking in memory.
+var LeaseCheckpointInterval = 30 * time.Second
+
+// leaseCheckpoint is the renewal of an instance's lease replicated by the
+// `LEASES` command. `AgeMs` is how long before the checkpoint the instance last
+// heartbeated, so that the replicas don't extend the lease past what the leader
+// observed, whenever they apply the command.
+type leaseCheckpoint struct {
+	Service string `json:"service"`
+	Host    string `json:"host"`
+	Port    uint16 `json:"port"`
+	AgeMs   uint64 `json:"age_ms"`
+}
+
+func leaseKey(service, host string, port uint16) string {
+	return fmt.Sprintf("%s/%s:%d", service, host, port)
+}
+
+// leaseTable holds the lease renewals received by the leader that were not
+// replicated yet, it's only valid for the leadership term that started at
+// `term`.
+type leaseTable struct {
+	term   time.Time
+	leases map[string]leaseCheckpoint
+	beats  map[string]time.Time
+}
+
+// currentLeases returns the lease table of the current leadership term,
+// discarding the one of a previous term.
+// Must be called with `ml` held.
+func (s *inMemStore) currentLeases() *leaseTable {
+	term := s.Node.LeaderSince()
+	if s.leases == nil || !s.leases.term.Equal(term) {
+		s.leases = &leaseTable{
+			term:   term,
+			leases: make(map[string]leaseCheckpoint),
+			beats:  make(map[string]time.Time),
+		}
+	}
+	return s.leases
+}
+
+// renewLeases records the heartbeats of the already registered instances in
+// the leader's memory, and returns the registrations that must go through Raft
+// because they change the registry.
+func (s *inMemStore) renewLeases(regs []InstanceRegistration) []InstanceRegistration {
+	reg := s.registry()
+	now := time.Now()
+
+	s.ml.Lock()
+	defer s.ml.Unlock()
+	table := s.currentLeases()
+	if table.term.IsZero() {
+		// Not the leader (anymore), let Raft reject the registrations.
+		return regs
+	}
+
+	changes := make([]InstanceRegistration, 0)
+	for _, r := range regs {
+		se, has := reg[r.ServiceName]
+		if !has || (r.Persistent && !se.Persistent) || !se.hasRegistration(r) {
+			changes = append(changes, r)
+			continue
+		}
+		k := leaseKey(r.ServiceName, r.Host, r.Port)
+		table.leases[k] = leaseCheckpoint{Service: r.ServiceName, Host: r.Host, Port: r.Port}
+		table.beats[k] = now
+	}
+	return changes
+}
+
+// forgetLease drops the in memory renewals of an instance that got removed
+// from the registry.
+func (s *inMemStore) forgetLease(service, host string, port uint16) {
+	s.ml.Lock()
+	defer s.ml.Unlock()
+	if s.leases == nil {
+		return
+	}
+	k := leaseKey(service, host, port)
+	delete(s.leases.leases, k)
+	delete(s.leases.beats, k)
+}
+
+// hasRegistration reports whether the instance is registered with exactly the
+// given tags and metadata, a registration changing them has to be replicated.
+func (se *ServiceEntry) hasRegistration(r InstanceRegistration) bool {
+	for _, v := range se.Instances {
+		if v.Host == r.Host && v.Port == r.Port {
+			return sameTags(v.Tags, r.Tags) && sameMeta(v.Meta, r.Meta)
+		}
+	}
+	return false
+}
+
+func sameMeta(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, has := b[k]; !has || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (se *ServiceEntry) hasInstance(host string, port uint16) bool {
+	for _, v := range se.Instances {
+		if v.Host == host && v.Port == port {
+			return true
+		}
+	}
+	return false
+}
+
+// LastBeat returns the last time the instance heartbeated in milliseconds,
+// taking into account the renewals the leader did not replicate yet.
+func (s *inMemStore) LastBeat(service string, instance *InstanceEntry) uint64 {
+	s.ml.Lock()
+	defer s.ml.Unlock()
+	last := instance.LastBeatMs
+	if s.leases == nil {
+		return last
+	}
+	if beat, has := s.leases.beats[leaseKey(service, instance.Host, instance.Port)]; has {
+		if ms := uint64(beat.UnixNano()) / uint64(1e6); ms > last {
+			last = ms
+		}
+	}
+	return last
+}
+
+// CheckpointLeases replicates the lease renewals received since the last
+// checkpoint in a single command.
+func (s *inMemStore) CheckpointLeases() error {
+	s.ml.Lock()
+	table := s.currentLeases()
+	if table.term.IsZero() || len(table.leases) == 0 {
+		s.ml.Unlock()
+		return nil
+	}
+	now := time.Now()
+	checkpoints := make([]leaseCheckpoint, 0, len(table.leases))
+	for k, l := range table.leases {
+		l.AgeMs = uint64(now.Sub(table.beats[k]).Milliseconds())
+		checkpoints = append(checkpoints, l)
+	}
+	// Renewals received while the checkpoint is replicated go into the next
+	// one, the beats are kept for the cleaner until they are superseded.
+	table.leases = make(map[string]leaseCheckpoint)
+	s.ml.Unlock()
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(checkpoints); err != nil {
+		return err
+	}
+	cmd := &Command{
+		Type:   "LEASES",
+		Value:  b.String(),
+		TimeMs: uint64(now.UnixNano()) / uint64(1e6),
+	}
+	s.logger.Debug("Checkpointing lease renewals", "renewals", len(checkpoints))
+	if err := execCommand(cmd, s.Node.raft); err != nil {
+		// Put the renewals back so they are part of the next checkpoint.
+		s.ml.Lock()
+		if s.leases == table {
+			for _, l := range checkpoints {
+				k := leaseKey(l.Service, l.Host, l.Port)
+				if _, has := table.leases[k]; !has {
+					table.leases[k] = l
+				}
+			}
+		}
+		s.ml.Unlock()
+		return err
+	}
+	return nil
+}
+
+// execLeases renews the leases of the checkpointed instances, relative to the
+// leader's clock at `timeMs` so that replaying the command after a restart or
+// a snapshot install doesn't renew them again.
+func (s *inMemStore) execLeases(value string, timeMs uint64) interface{} {
+	var checkpoints []leaseCheckpoint
+	if err := json.NewDecoder(bytes.NewReader([]byte(value))).Decode(&checkpoints); err != nil {
+		s.logger.Error("Failed executing a lease checkpoint", "value", value, "error", err)
+		return err
+	}
+
+	s.ms.Lock()
+	defer s.ms.Unlock()
+
+	cur := s.registry()
+	next := make(registry, len(cur))
+	for k, v := range cur {
+		next[k] = v
+	}
+	copied := make(map[string]bool)
+
+	for _, l := range checkpoints {
+		se, has := next[l.Service]
+		if !has {
+			continue
+		}
+		for i, v := range se.Instances {
+			if v.Host != l.Host || v.Port != l.Port {
+				continue
+			}
+			if l.AgeMs > timeMs {
+				break
+			}
+			beat := timeMs - l.AgeMs
+			if beat <= v.LastBeatMs {
+				break
+			}
+			if !copied[l.Service] {
+				instances := make([]*InstanceEntry, len(se.Instances))
+				copy(instances, se.Instances)
+				cp := *se
+				cp.Instances = instances
+				se = &cp
+				next[l.Service] = se
+				copied[l.Service] = true
+			}
+			renewed := *v
+			renewed.LastBeatMs = beat
+			se.Instances[i] = &renewed
+			break
+		}
+	}
+
+	s.services.Store(next)
+	return nil
+}
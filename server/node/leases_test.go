@@ -0,0 +1,139 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// instance returns the registered instance of the service, or nil.
+func instance(s *inMemStore, service string, port uint16) *InstanceEntry {
+	se, has := s.registry()[service]
+	if !has {
+		return nil
+	}
+	for _, v := range se.Instances {
+		if v.Port == port {
+			return v
+		}
+	}
+	return nil
+}
+
+func TestRenewLeases(t *testing.T) {
+	s := newTestNode(t, true)
+	reg := InstanceRegistration{ServiceName: "web", Host: "10.0.0.1", Port: 80, Tags: []string{"v1"}}
+	if err := s.RegisterInstance(context.Background(), reg); err != nil {
+		t.Fatalf("Could not register the instance: %s", err)
+	}
+	registered := instance(s, "web", 80).LastBeatMs
+
+	tests := []struct {
+		name       string
+		reg        InstanceRegistration
+		replicated bool
+	}{
+		{"heartbeat", reg, false},
+		{"other instance", InstanceRegistration{ServiceName: "web", Host: "10.0.0.1", Port: 81}, true},
+		{"other service", InstanceRegistration{ServiceName: "api", Host: "10.0.0.1", Port: 80}, true},
+		{"changed tags", InstanceRegistration{ServiceName: "web", Host: "10.0.0.1", Port: 80, Tags: []string{"v2"}}, true},
+		{"now persistent", InstanceRegistration{ServiceName: "web", Host: "10.0.0.1", Port: 80, Tags: []string{"v1"}, Persistent: true}, true},
+	}
+	for _, tt := range tests {
+		changes := s.renewLeases([]InstanceRegistration{tt.reg})
+		if replicated := len(changes) == 1; replicated != tt.replicated {
+			t.Errorf("%s: expected the registration to be replicated: %v, got %v", tt.name, tt.replicated, replicated)
+		}
+	}
+
+	// The heartbeat is only in the leader's memory until the next checkpoint.
+	time.Sleep(5 * time.Millisecond)
+	s.renewLeases([]InstanceRegistration{reg})
+	inst := instance(s, "web", 80)
+	if inst.LastBeatMs != registered {
+		t.Errorf("Expected the renewal not to be replicated yet")
+	}
+	if last := s.LastBeat("web", inst); last <= registered {
+		t.Errorf("Expected the last beat to include the renewal, got %d for a registration at %d", last, registered)
+	}
+}
+
+func TestCheckpointLeases(t *testing.T) {
+	s := newTestNode(t, true)
+	reg := InstanceRegistration{ServiceName: "web", Host: "10.0.0.1", Port: 80}
+	if err := s.RegisterInstance(context.Background(), reg); err != nil {
+		t.Fatalf("Could not register the instance: %s", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	s.renewLeases([]InstanceRegistration{reg})
+	beat := s.LastBeat("web", instance(s, "web", 80))
+
+	if err := s.CheckpointLeases(); err != nil {
+		t.Fatalf("Could not checkpoint the leases: %s", err)
+	}
+	// The checkpoint's time and the age of the beat are both rounded to the
+	// millisecond, the replicated beat can be a millisecond off.
+	if last := instance(s, "web", 80).LastBeatMs; last+1 < beat || last > beat+1 {
+		t.Errorf("Expected the checkpoint to replicate the beat at %d, got %d", beat, last)
+	}
+	s.ml.Lock()
+	pending := len(s.leases.leases)
+	s.ml.Unlock()
+	if pending != 0 {
+		t.Errorf("Expected the checkpointed renewals to be cleared, got %d", pending)
+	}
+}
+
+func TestLeasesReplay(t *testing.T) {
+	s := newTestStore()
+	a := &testApplier{t: t, s: s}
+	a.apply(Command{Type: "REG", Value: encode(t, InstanceRegistration{ServiceName: "web", Host: "10.0.0.1", Port: 80})})
+	registered := instance(s, "web", 80).LastBeatMs
+
+	checkpoint := Command{
+		Type:   "LEASES",
+		Value:  encode(t, []leaseCheckpoint{{Service: "web", Host: "10.0.0.1", Port: 80, AgeMs: 1000}}),
+		TimeMs: registered + 6000,
+	}
+	a.apply(checkpoint)
+	if last := instance(s, "web", 80).LastBeatMs; last != registered+5000 {
+		t.Fatalf("Expected the beat the leader saw at %d, got %d", registered+5000, last)
+	}
+
+	// Applying the checkpoint again, e.g. when replaying the log after a
+	// restart, doesn't renew the lease past what the leader saw, however late.
+	time.Sleep(5 * time.Millisecond)
+	a.apply(checkpoint)
+	if last := instance(s, "web", 80).LastBeatMs; last != registered+5000 {
+		t.Errorf("Expected the replay to keep the beat at %d, got %d", registered+5000, last)
+	}
+
+	// An older checkpoint doesn't move the beat back.
+	checkpoint.TimeMs = registered
+	a.apply(checkpoint)
+	if last := instance(s, "web", 80).LastBeatMs; last != registered+5000 {
+		t.Errorf("Expected an older checkpoint to be ignored, got %d", last)
+	}
+}
+
+func TestCanEvictGracePeriod(t *testing.T) {
+	leader := newTestNode(t, true)
+	follower := newTestNode(t, false)
+
+	tests := []struct {
+		name      string
+		node      *Node
+		threshold time.Duration
+		evict     bool
+	}{
+		{"follower", follower.Node, time.Nanosecond, false},
+		{"new leader", leader.Node, time.Hour, false},
+		{"leader after the grace period", leader.Node, time.Nanosecond, true},
+	}
+	for _, tt := range tests {
+		c := NewCleaner(time.Second, tt.threshold, 0, tt.node)
+		if evict := c.canEvict(); evict != tt.evict {
+			t.Errorf("%s: expected evictions to be allowed: %v, got %v", tt.name, tt.evict, evict)
+		}
+	}
+}
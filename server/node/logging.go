@@ -0,0 +1,74 @@
+package node
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Logger is the root logger of the process, every component derives its own
+// logger from it with `ComponentLogger`, so it must be replaced (see
+// `NewLogger`) before the components are created.
+var Logger = hclog.New(&hclog.LoggerOptions{Output: os.Stderr})
+
+// NewLogger creates a root logger writing to `out` at the given level (`trace`,
+// `debug`, `info`, `warn` or `error`), either as JSON or as text with the
+// fields as `key=value` pairs. Every line carries the node's ID.
+func NewLogger(out io.Writer, level, format, nodeID string) (hclog.Logger, error) {
+	lvl := hclog.LevelFromString(level)
+	if lvl == hclog.NoLevel {
+		return nil, fmt.Errorf("Unknown log level '%s'", level)
+	}
+	if format != "text" && format != "json" {
+		return nil, fmt.Errorf("Unknown log format '%s', expected 'text' or 'json'", format)
+	}
+	return hclog.New(&hclog.LoggerOptions{
+		Level:      lvl,
+		Output:     out,
+		JSONFormat: format == "json",
+	}).With("node_id", nodeID), nil
+}
+
+// ComponentLogger returns the logger of a component, its lines carry the name
+// of the component in the `component` field.
+func ComponentLogger(component string) hclog.Logger {
+	return Logger.With("component", component)
+}
+
+// fatal logs the error and exits, for the errors the process can't recover
+// from.
+func fatal(logger hclog.Logger, msg string, args ...interface{}) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+type requestLoggerKey struct{}
+
+// withRequestID attaches a logger carrying the request's ID to the request,
+// the ID is taken from the `X-Request-ID` header if the client set one and is
+// sent back in the response.
+func withRequestID(logger hclog.Logger, req *http.Request, res http.ResponseWriter) *http.Request {
+	id := req.Header.Get("X-Request-ID")
+	if id == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	res.Header().Set("X-Request-ID", id)
+	ctx := context.WithValue(req.Context(), requestLoggerKey{}, logger.With("request_id", id))
+	return req.WithContext(ctx)
+}
+
+// requestLogger returns the logger attached to the request by `withRequestID`.
+func requestLogger(req *http.Request, fallback hclog.Logger) hclog.Logger {
+	if logger, ok := req.Context().Value(requestLoggerKey{}).(hclog.Logger); ok {
+		return logger
+	}
+	return fallback
+}
@@ -0,0 +1,111 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		level  string
+		format string
+		valid  bool
+		// lines is the number of lines written when logging once at every
+		// level.
+		lines int
+	}{
+		{"trace", "text", true, 5},
+		{"debug", "json", true, 4},
+		{"INFO", "text", true, 3},
+		{"warn", "json", true, 2},
+		{"error", "text", true, 1},
+		{"verbose", "text", false, 0},
+		{"", "text", false, 0},
+		{"info", "logfmt", false, 0},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		logger, err := NewLogger(&out, tt.level, tt.format, "node-1")
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("%s %s: expected the configuration to be rejected", tt.level, tt.format)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: expected the configuration to be accepted, got %s", tt.level, tt.format, err)
+			continue
+		}
+		logger.Trace("trace")
+		logger.Debug("debug")
+		logger.Info("info")
+		logger.Warn("warn")
+		logger.Error("error")
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != tt.lines {
+			t.Errorf("%s %s: expected %d lines, got %q", tt.level, tt.format, tt.lines, out.String())
+			continue
+		}
+		for _, line := range lines {
+			if tt.format == "json" {
+				var fields map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &fields); err != nil || fields["node_id"] != "node-1" {
+					t.Errorf("%s %s: expected a JSON line with the node's ID, got %q", tt.level, tt.format, line)
+				}
+			} else if !strings.Contains(line, "node_id=node-1") {
+				t.Errorf("%s %s: expected the node's ID, got %q", tt.level, tt.format, line)
+			}
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var out bytes.Buffer
+	root, err := NewLogger(&out, "info", "json", "node-1")
+	if err != nil {
+		t.Fatalf("Could not create the logger: %s", err)
+	}
+	prev := Logger
+	Logger = root
+	defer func() { Logger = prev }()
+
+	s := newTestStore()
+	s.Node.ACL = ACLConfig{Enabled: true, DefaultPolicy: ACLDeny}
+	srv := NewServer("", s.Node)
+	// The refused requests are logged with their ID.
+	get := func(id string) (string, map[string]interface{}) {
+		out.Reset()
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		res := httptest.NewRecorder()
+		srv.ServeHTTP(res, req)
+		var fields map[string]interface{}
+		if err := json.Unmarshal(out.Bytes(), &fields); err != nil {
+			t.Fatalf("Expected a single JSON line, got %q", out.String())
+		}
+		return res.Header().Get("X-Request-ID"), fields
+	}
+
+	id, fields := get("abc-123")
+	if id != "abc-123" || fields["request_id"] != "abc-123" {
+		t.Errorf("Expected the client's request ID to be kept, got %s and %v", id, fields)
+	}
+	if fields["component"] != "server" || fields["node_id"] != "node-1" || fields["@level"] != "warn" {
+		t.Errorf("Expected a warning of the server component, got %v", fields)
+	}
+
+	first, fields := get("")
+	if !regexp.MustCompile("^[0-9a-f]{16}$").MatchString(first) || fields["request_id"] != first {
+		t.Errorf("Expected a generated request ID, got %s and %v", first, fields)
+	}
+	if second, _ := get(""); second == first {
+		t.Errorf("Expected each request to get its own ID, got %s twice", first)
+	}
+}
@@ -0,0 +1,108 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+func (s *inMemStore) SetMember(m Member) error {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(m); err != nil {
+		return err
+	}
+	return execCommand(&Command{Type: "MEMBER", Value: b.String()}, s.Node.raft)
+}
+
+func (s *inMemStore) GetMembers() []Member {
+	s.ma.Lock()
+	defer s.ma.Unlock()
+	members := make([]Member, 0, len(s.members))
+	for _, m := range s.members {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
+
+func (s *inMemStore) execMember(value string) interface{} {
+	var m Member
+	if err := json.NewDecoder(bytes.NewReader([]byte(value))).Decode(&m); err != nil {
+		s.logger.Error("Failed executing a member update", "value", value, "error", err)
+		return err
+	}
+
+	s.ma.Lock()
+	defer s.ma.Unlock()
+	// A node replacing another one through a forced join takes its address.
+	for id, cur := range s.members {
+		if cur.RaftAddr == m.RaftAddr {
+			delete(s.members, id)
+		}
+	}
+	s.members[m.ID] = m
+	return nil
+}
+
+// announce records the addresses of this node once it's the leader, so that
+// the followers can redirect the requests they can't serve to it.
+func (n *Node) announce() {
+	self := Member{ID: n.id, RaftAddr: n.raftAddr, HttpAddr: n.HttpAddr}
+	for _, m := range n.store.GetMembers() {
+		if m == self {
+			return
+		}
+	}
+	if err := n.store.SetMember(self); err != nil {
+		n.logger.Warn("Could not record the addresses of the leader", "error", err)
+	}
+}
+
+// LeaderHttpAddr returns the address of the leader's HTTP API, or an empty
+// string if the leader or its address are not known.
+func (n *Node) LeaderHttpAddr() string {
+	leader := string(n.raft.Leader())
+	if leader == "" {
+		return ""
+	}
+	for _, m := range n.store.GetMembers() {
+		if m.RaftAddr == leader {
+			return m.HttpAddr
+		}
+	}
+	return ""
+}
+
+// redirectToLeader answers a request that only the leader can serve with a
+// redirection to it, or with `503` if the leader's address is not known.
+func (s *HttpServer) redirectToLeader(req *http.Request, res http.ResponseWriter) {
+	addr := s.node.LeaderHttpAddr()
+	if addr == "" {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		res.Write([]byte(fmt.Sprintf("Server error occured: %s", s.node.notLeaderError())))
+		return
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	s.log(req).Info("Redirecting a request to the leader", "path", req.URL.Path, "leader", addr)
+	http.Redirect(res, req, fmt.Sprintf("%s://%s%s", scheme, addr, req.URL.RequestURI()), http.StatusTemporaryRedirect)
+}
+
+// redirectToLeaderTraced is `redirectToLeader` recording the hop to the leader
+// as an `http.redirect` span of the trace in the context.
+func (s *HttpServer) redirectToLeaderTraced(ctx context.Context, req *http.Request, res http.ResponseWriter) {
+	_, span := Tracer.Start(ctx, "http.redirect")
+	addr := s.node.LeaderHttpAddr()
+	span.SetAttribute("leader", addr)
+	s.redirectToLeader(req, res)
+	if addr == "" {
+		span.Finish(s.node.notLeaderError())
+		return
+	}
+	span.Finish(nil)
+}
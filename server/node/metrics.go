@@ -0,0 +1,153 @@
+package node
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The metrics exposed on `/metrics`, the ones describing the Raft and registry
+// state are read when scraped by the `stateCollector`.
+var (
+	applyDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "heartbeat_raft_apply_duration_seconds",
+		Help:    "Time taken to replicate and apply a command, observed by the node submitting it.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+	fsmCommands = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "heartbeat_fsm_commands_total",
+		Help: "Number of commands applied to the local state machine by type.",
+	}, []string{"type"})
+	heartbeatRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "heartbeat_heartbeat_requests_total",
+		Help: "Number of heartbeat requests received by endpoint.",
+	}, []string{"endpoint"})
+	heartbeatErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "heartbeat_heartbeat_errors_total",
+		Help: "Number of heartbeat requests that failed by endpoint.",
+	}, []string{"endpoint"})
+	cleanerDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "heartbeat_cleaner_run_duration_seconds",
+		Help:    "Time taken by a run of the cleaner.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+	cleanerEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "heartbeat_cleaner_evictions_total",
+		Help: "Number of instances evicted by the cleaner for missing their heartbeats.",
+	})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "heartbeat_http_request_duration_seconds",
+		Help:    "Latency of the HTTP API by route, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+)
+
+// RegisterMetrics exposes the state of the node (Raft state, term, indexes and
+// the size of the registry) along with the other metrics, it must be called
+// once per process.
+func RegisterMetrics(node *Node) {
+	prometheus.MustRegister(&stateCollector{node: node})
+}
+
+var (
+	raftStateDesc = prometheus.NewDesc("heartbeat_raft_state",
+		"Raft state of the node, the gauge of the current state is 1.", []string{"state"}, nil)
+	raftTermDesc = prometheus.NewDesc("heartbeat_raft_term",
+		"Current Raft term.", nil, nil)
+	raftCommitIndexDesc = prometheus.NewDesc("heartbeat_raft_commit_index",
+		"Index of the last committed log entry known to the node.", nil, nil)
+	raftAppliedIndexDesc = prometheus.NewDesc("heartbeat_raft_applied_index",
+		"Index of the last log entry applied to the state machine.", nil, nil)
+	servicesDesc = prometheus.NewDesc("heartbeat_registered_services",
+		"Number of services in the registry.", nil, nil)
+	instancesDesc = prometheus.NewDesc("heartbeat_registered_instances",
+		"Number of instances in the registry.", nil, nil)
+)
+
+// stateCollector reads the Raft and registry state of the node when scraped.
+type stateCollector struct {
+	node *Node
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- raftStateDesc
+	ch <- raftTermDesc
+	ch <- raftCommitIndexDesc
+	ch <- raftAppliedIndexDesc
+	ch <- servicesDesc
+	ch <- instancesDesc
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	if rft := c.node.raft; rft != nil {
+		cur := rft.State()
+		for _, st := range []raft.RaftState{raft.Follower, raft.Candidate, raft.Leader, raft.Shutdown} {
+			v := 0.0
+			if st == cur {
+				v = 1
+			}
+			ch <- prometheus.MustNewConstMetric(raftStateDesc, prometheus.GaugeValue, v, strings.ToLower(st.String()))
+		}
+		stats := rft.Stats()
+		for desc, key := range map[*prometheus.Desc]string{
+			raftTermDesc:         "term",
+			raftCommitIndexDesc:  "commit_index",
+			raftAppliedIndexDesc: "applied_index",
+		} {
+			if v, err := strconv.ParseUint(stats[key], 10, 64); err == nil {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(v))
+			}
+		}
+	}
+
+	services := c.node.store.GetResources()
+	instances := 0
+	for _, v := range services {
+		instances += len(v.Instances)
+	}
+	ch <- prometheus.MustNewConstMetric(servicesDesc, prometheus.GaugeValue, float64(len(services)))
+	ch <- prometheus.MustNewConstMetric(instancesDesc, prometheus.GaugeValue, float64(instances))
+}
+
+// statusRecorder keeps the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Flush is needed by the streaming endpoints.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// observeRequest records the latency of the request, the route is the path
+// with the keys and identifiers left out to bound the number of series.
+func observeRequest(req *http.Request, code int, start time.Time) {
+	route := req.URL.Path
+	for _, prefix := range []string{"/kv/", "/session/", "/watch/", "/acl/"} {
+		if strings.HasPrefix(route, prefix) {
+			route = prefix
+			break
+		}
+	}
+	switch route {
+	case "/join", "/services", "/services/events", "/heartbeat", "/heartbeat/batch",
+		"/kv/", "/session/", "/watch/", "/acl/", "/txn", "/sd/prometheus", "/metrics",
+		"/cluster/self", "/cluster/transfer-leadership", "/cluster/members", "/cluster/promote", "/cluster/demote":
+	default:
+		route = "other"
+	}
+	httpDuration.WithLabelValues(route, req.Method, strconv.Itoa(code)).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,209 @@
+package node
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// gauges returns the values of the gathered gauges by `name{label}`.
+func gauges(t *testing.T, g prometheus.Gatherer) map[string]float64 {
+	t.Helper()
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatalf("Could not gather the metrics: %s", err)
+	}
+	values := map[string]float64{}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			if m.GetGauge() == nil {
+				continue
+			}
+			name := f.GetName()
+			for _, l := range m.GetLabel() {
+				name += "{" + l.GetValue() + "}"
+			}
+			values[name] = m.GetGauge().GetValue()
+		}
+	}
+	return values
+}
+
+// requestCount returns how many requests were observed by the HTTP latency
+// histogram with the labels.
+func requestCount(t *testing.T, route, method, code string) uint64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Could not gather the metrics: %s", err)
+	}
+	labels := map[string]string{"route": route, "method": method, "code": code}
+	for _, f := range families {
+		if f.GetName() != "heartbeat_http_request_duration_seconds" {
+			continue
+		}
+	metrics:
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if labels[l.GetName()] != l.GetValue() {
+					continue metrics
+				}
+			}
+			return m.GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
+
+func TestStateCollector(t *testing.T) {
+	s := newTestNode(t, true)
+	ctx := context.Background()
+	for _, reg := range []InstanceRegistration{
+		{ServiceName: "web", Host: "10.0.0.1", Port: 80},
+		{ServiceName: "web", Host: "10.0.0.2", Port: 80},
+		{ServiceName: "api", Host: "10.0.1.1", Port: 90},
+	} {
+		if err := s.RegisterInstance(ctx, reg); err != nil {
+			t.Fatalf("Could not register the instance: %s", err)
+		}
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&stateCollector{node: s.Node})
+	term, _ := strconv.ParseFloat(s.Node.raft.Stats()["term"], 64)
+
+	values := gauges(t, registry)
+	expected := map[string]float64{
+		"heartbeat_raft_state{leader}":    1,
+		"heartbeat_raft_state{follower}":  0,
+		"heartbeat_raft_state{candidate}": 0,
+		"heartbeat_raft_state{shutdown}":  0,
+		"heartbeat_registered_services":   2,
+		"heartbeat_registered_instances":  3,
+		"heartbeat_raft_term":             term,
+		"heartbeat_raft_applied_index":    float64(s.Node.raft.AppliedIndex()),
+		"heartbeat_raft_commit_index":     float64(s.Node.raft.AppliedIndex()),
+	}
+	for name, v := range expected {
+		if got, has := values[name]; !has || got != v {
+			t.Errorf("%s: expected %v, got %v", name, v, got)
+		}
+	}
+
+	// A node without Raft only reports its registry.
+	registry = prometheus.NewRegistry()
+	registry.MustRegister(&stateCollector{node: newTestStore().Node})
+	if values := gauges(t, registry); len(values) != 2 || values["heartbeat_registered_services"] != 0 {
+		t.Errorf("Expected only the empty registry, got %v", values)
+	}
+}
+
+func TestHeartbeatMetrics(t *testing.T) {
+	s := newTestNode(t, true)
+	srv := NewServer("", s.Node)
+	post := func(path, body string) {
+		srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	}
+
+	requests := testutil.ToFloat64(heartbeatRequests.WithLabelValues("/heartbeat"))
+	errors := testutil.ToFloat64(heartbeatErrors.WithLabelValues("/heartbeat"))
+	batches := testutil.ToFloat64(heartbeatRequests.WithLabelValues("/heartbeat/batch"))
+	batchErrors := testutil.ToFloat64(heartbeatErrors.WithLabelValues("/heartbeat/batch"))
+	registrations := testutil.ToFloat64(fsmCommands.WithLabelValues("BREG"))
+	accepted := requestCount(t, "/heartbeat", http.MethodPost, "200")
+	refused := requestCount(t, "/heartbeat", http.MethodPost, "400")
+
+	post("/heartbeat", `{"service":"web","host":"10.0.0.1","port":80}`)
+	post("/heartbeat", `not json`)
+	post("/heartbeat/batch", `[{"service":"web","host":"10.0.0.2","port":80}]`)
+
+	tests := []struct {
+		name     string
+		got      float64
+		expected float64
+	}{
+		{"heartbeat requests", testutil.ToFloat64(heartbeatRequests.WithLabelValues("/heartbeat")), requests + 2},
+		{"heartbeat errors", testutil.ToFloat64(heartbeatErrors.WithLabelValues("/heartbeat")), errors + 1},
+		{"batch requests", testutil.ToFloat64(heartbeatRequests.WithLabelValues("/heartbeat/batch")), batches + 1},
+		{"batch errors", testutil.ToFloat64(heartbeatErrors.WithLabelValues("/heartbeat/batch")), batchErrors},
+		{"applied batches", testutil.ToFloat64(fsmCommands.WithLabelValues("BREG")), registrations + 1},
+		{"accepted requests", float64(requestCount(t, "/heartbeat", http.MethodPost, "200")), float64(accepted + 1)},
+		{"refused requests", float64(requestCount(t, "/heartbeat", http.MethodPost, "400")), float64(refused + 1)},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, tt.got)
+		}
+	}
+}
+
+func TestObserveRequestRoutes(t *testing.T) {
+	tests := []struct {
+		path  string
+		route string
+	}{
+		{"/heartbeat", "/heartbeat"},
+		{"/kv/config/db", "/kv/"},
+		{"/session/3f2a", "/session/"},
+		{"/acl/token/a1", "/acl/"},
+		{"/cluster/members", "/cluster/members"},
+		{"/random/path", "other"},
+		{"/kv", "other"},
+	}
+	for _, tt := range tests {
+		before := requestCount(t, tt.route, http.MethodGet, "200")
+		observeRequest(httptest.NewRequest(http.MethodGet, tt.path, nil), http.StatusOK, time.Now())
+		if requestCount(t, tt.route, http.MethodGet, "200") != before+1 {
+			t.Errorf("%s: expected the request to be observed as %s", tt.path, tt.route)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	s := newTestNode(t, true)
+	srv := NewServer("", s.Node)
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if token != "" {
+			req.Header.Set("X-Heartbeat-Token", token)
+		}
+		res := httptest.NewRecorder()
+		srv.ServeHTTP(res, req)
+		return res
+	}
+
+	res := get("")
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "heartbeat_http_request_duration_seconds") {
+		t.Errorf("Expected the metrics, got %d: %s", res.Code, res.Body)
+	}
+
+	reader, err := s.CreateACLToken(ACLToken{Policy: ACLPolicy{Operator: ACLRead}})
+	if err != nil {
+		t.Fatalf("Could not create the token: %s", err)
+	}
+	writer, err := s.CreateACLToken(ACLToken{Policy: ACLPolicy{Services: []ACLRule{{Prefix: "", Access: ACLWrite}}}})
+	if err != nil {
+		t.Fatalf("Could not create the token: %s", err)
+	}
+	s.Node.ACL = ACLConfig{Enabled: true, DefaultPolicy: ACLDeny}
+	tests := []struct {
+		name  string
+		token string
+		code  int
+	}{
+		{"no token", "", http.StatusForbidden},
+		{"services token", writer.SecretID, http.StatusForbidden},
+		{"operator token", reader.SecretID, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if res := get(tt.token); res.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.code, res.Code)
+		}
+	}
+}
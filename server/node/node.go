@@ -2,11 +2,11 @@ package node
 
 import (
 	"fmt"
-	"log"
 	"net"
-	"os"
+	"sync"
 	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/raft"
 )
 
@@ -17,7 +17,98 @@ type Node struct {
 
 	store  StorageEngine
 	raft   *raft.Raft
-	logger *log.Logger
+	logger hclog.Logger
+
+	// RaftTLS encrypts the Raft traffic with mutual TLS when set, it must be
+	// set before `Bootstrap`.
+	RaftTLS *Certificates
+
+	// ACL configures the enforcement of the ACL tokens by the APIs.
+	ACL ACLConfig
+
+	// JoinSecret is the secret shared by the members of the cluster, the join
+	// requests must be signed with it when it's set.
+	JoinSecret string
+
+	// HttpAddr is the address the other nodes reach this node's HTTP API at.
+	HttpAddr string
+
+	// RaftConfig tunes the Raft protocol, it must be set before `Bootstrap`.
+	RaftConfig RaftConfig
+
+	// RaftBindAddr is the address the Raft transport listens on, when it
+	// differs from the address the other nodes reach it at (e.g. `0.0.0.0`
+	// behind a NAT). The Raft address is used when it's empty.
+	RaftBindAddr string
+
+	// leaderSince is when this node last became the leader, it's zero while
+	// the node is not the leader. transferring is set while the leader hands
+	// the leadership over. bootstrapPeers are the nodes found while forming
+	// the cluster with `BootstrapExpect`.
+	lmu            sync.Mutex
+	leaderSince    time.Time
+	transferring   bool
+	bootstrapPeers []string
+}
+
+// RaftConfig holds the tunables of the Raft protocol, the zero fields keep
+// raft's defaults, and the defaults of the transport: a pool of 5 connections
+// per peer and a 20s timeout for the RPCs.
+type RaftConfig struct {
+	HeartbeatTimeout   time.Duration
+	ElectionTimeout    time.Duration
+	CommitTimeout      time.Duration
+	LeaderLeaseTimeout time.Duration
+	SnapshotInterval   time.Duration
+	SnapshotThreshold  uint64
+	TrailingLogs       uint64
+	MaxAppendEntries   int
+
+	MaxPool          int
+	TransportTimeout time.Duration
+}
+
+// apply sets the non-zero tunables on raft's configuration.
+func (c RaftConfig) apply(conf *raft.Config) {
+	if c.HeartbeatTimeout != 0 {
+		conf.HeartbeatTimeout = c.HeartbeatTimeout
+	}
+	if c.ElectionTimeout != 0 {
+		conf.ElectionTimeout = c.ElectionTimeout
+	}
+	if c.CommitTimeout != 0 {
+		conf.CommitTimeout = c.CommitTimeout
+	}
+	if c.LeaderLeaseTimeout != 0 {
+		conf.LeaderLeaseTimeout = c.LeaderLeaseTimeout
+	}
+	if c.SnapshotInterval != 0 {
+		conf.SnapshotInterval = c.SnapshotInterval
+	}
+	if c.SnapshotThreshold != 0 {
+		conf.SnapshotThreshold = c.SnapshotThreshold
+	}
+	if c.TrailingLogs != 0 {
+		conf.TrailingLogs = c.TrailingLogs
+	}
+	if c.MaxAppendEntries != 0 {
+		conf.MaxAppendEntries = c.MaxAppendEntries
+	}
+}
+
+// Validate checks the tunables against the constraints of the Raft protocol,
+// e.g. the election timeout can't be shorter than the heartbeat timeout.
+func (c RaftConfig) Validate() error {
+	conf := raft.DefaultConfig()
+	conf.LocalID = "validate"
+	c.apply(conf)
+	if c.MaxPool < 0 {
+		return fmt.Errorf("The transport's connection pool can't be negative")
+	}
+	if c.TransportTimeout < 0 {
+		return fmt.Errorf("The transport's timeout can't be negative")
+	}
+	return raft.ValidateConfig(conf)
 }
 
 func NewNode(id, dataDir, raftAddr string, store StorageEngine) *Node {
@@ -26,9 +117,9 @@ func NewNode(id, dataDir, raftAddr string, store StorageEngine) *Node {
 		raftAddr: raftAddr,
 		store:    store,
 		id:       id,
-		// Adding a prefix to the logger will help trace which calls came in from
-		// withing a node method, and which from other parts of the code.
-		logger: log.New(os.Stderr, "(Node) ", log.LstdFlags),
+		// The component field will help trace which calls came in from withing a
+		// node method, and which from other parts of the code.
+		logger: ComponentLogger("node"),
 	}
 }
 
@@ -38,9 +129,13 @@ func NewNode(id, dataDir, raftAddr string, store StorageEngine) *Node {
 // If the `isLeader` param is set, it will initiate a cluster with size `1` with
 // the current node as the leader.
 func (n *Node) Bootstrap(isLeader bool) error {
-	n.logger.Printf("Bootsrapping the cluster with the default configuration...")
+	n.logger.Info("Bootsrapping the cluster with the default configuration...")
 	conf := raft.DefaultConfig()
 	conf.LocalID = raft.ServerID(n.id)
+	n.RaftConfig.apply(conf)
+	// Raft's own output goes through the same sink as the rest of the node.
+	raftLogger := ComponentLogger("raft")
+	conf.Logger = raftLogger
 
 	addr, err := net.ResolveTCPAddr("tcp", n.raftAddr)
 	if err != nil {
@@ -48,24 +143,48 @@ func (n *Node) Bootstrap(isLeader bool) error {
 	}
 
 	// Create the transport for the Raft RPCs
-	transport, err := raft.NewTCPTransport(n.raftAddr, addr, 5, 20*time.Second, os.Stderr)
-	if err != nil {
-		return err
+	bind, maxPool, timeout := n.raftAddr, 5, 20*time.Second
+	if n.RaftBindAddr != "" {
+		bind = n.RaftBindAddr
+	}
+	if n.RaftConfig.MaxPool != 0 {
+		maxPool = n.RaftConfig.MaxPool
+	}
+	if n.RaftConfig.TransportTimeout != 0 {
+		timeout = n.RaftConfig.TransportTimeout
+	}
+	var transport *raft.NetworkTransport
+	if n.RaftTLS != nil {
+		stream, err := newTLSStreamLayer(bind, addr, n.RaftTLS)
+		if err != nil {
+			return err
+		}
+		transport = raft.NewNetworkTransportWithConfig(&raft.NetworkTransportConfig{
+			Stream:  stream,
+			MaxPool: maxPool,
+			Timeout: timeout,
+			Logger:  raftLogger,
+		})
+	} else {
+		transport, err = raft.NewTCPTransportWithLogger(bind, addr, maxPool, timeout, raftLogger)
+		if err != nil {
+			return err
+		}
 	}
 
-	n.logger.Printf("Created transport at '%s'", transport.LocalAddr())
+	n.logger.Info("Created transport", "bind", bind, "addr", transport.LocalAddr())
 
 	// Create a snapshoter to truncate the logs.
-	snapshots, err := raft.NewFileSnapshotStore(n.dataDir, 3, os.Stderr)
+	snapshots, err := raft.NewFileSnapshotStoreWithLogger(n.dataDir, 3, raftLogger)
 	if err != nil {
 		return err
 	}
-	n.logger.Printf("Created snapshotter in '%s'", n.dataDir)
+	n.logger.Info("Created snapshotter", "dir", n.dataDir)
 
-	n.logger.Printf("Creating the log store")
+	n.logger.Debug("Creating the log store")
 	logStore := raft.NewInmemStore()
 
-	n.logger.Printf("Creating the stable store")
+	n.logger.Debug("Creating the stable store")
 	stableStore := raft.NewInmemStore()
 
 	rft, err := raft.NewRaft(conf, n.store, logStore, stableStore, snapshots, transport)
@@ -73,11 +192,12 @@ func (n *Node) Bootstrap(isLeader bool) error {
 		return err
 	}
 
-	n.logger.Printf("Initiliazed the Raft node %v", isLeader)
+	n.logger.Info("Initiliazed the Raft node", "leader", isLeader)
 	n.raft = rft
+	go n.observeLeadership()
 
 	if isLeader {
-		n.logger.Printf("This node is supposed to be a leader, bootstrapping a single node cluster")
+		n.logger.Info("This node is supposed to be a leader, bootstrapping a single node cluster")
 		// Bootstrapping the leader to create a single node cluster.
 		// Later on, we will add voters to the same node's cluster to populate the
 		// Raft cluster.
@@ -90,43 +210,106 @@ func (n *Node) Bootstrap(isLeader bool) error {
 			},
 		})
 		if err = ft.Error(); err != nil {
-			n.logger.Printf("Bootrapping the cluster finished with error '%v", err)
+			n.logger.Error("Bootrapping the cluster finished with error", "error", err)
 		}
 	}
 	return nil
 }
 
-func (n *Node) AddPeer(id, addr string) error {
-	n.logger.Printf("Adding a peer to the Raft cluster '%s' at '%s'", id, addr)
+// observeLeadership keeps track of when this node acquires or loses the
+// leadership.
+func (n *Node) observeLeadership() {
+	for leader := range n.raft.LeaderCh() {
+		n.lmu.Lock()
+		if leader {
+			n.logger.Info("This node is now the leader of the cluster")
+			n.leaderSince = time.Now()
+			go n.announce()
+		} else {
+			n.logger.Info("This node lost the leadership of the cluster")
+			n.leaderSince = time.Time{}
+		}
+		n.lmu.Unlock()
+	}
+}
+
+// LeaderSince returns when this node became the leader, or the zero time if
+// it's not the leader or is handing the leadership over.
+func (n *Node) LeaderSince() time.Time {
+	n.lmu.Lock()
+	defer n.lmu.Unlock()
+	if !n.IsLeader() || n.transferring {
+		return time.Time{}
+	}
+	return n.leaderSince
+}
+
+// IsLeader reports whether this node is currently the leader of the Raft
+// cluster.
+func (n *Node) IsLeader() bool {
+	return n.raft != nil && n.raft.State() == raft.Leader
+}
+
+// AddPeer adds the node as a voter, or as a non-voter if `nonVoter` is set. A
+// member that already uses the ID or the address is only replaced if `force`
+// is set, otherwise a `*MemberConflictError` is returned.
+func (n *Node) AddPeer(id, addr string, force, nonVoter bool) error {
+	n.logger.Info("Adding a peer to the Raft cluster", "peer", id, "addr", addr, "force", force, "non_voter", nonVoter)
 
 	confFt := n.raft.GetConfiguration()
 	if err := confFt.Error(); err != nil {
-		n.logger.Printf("Failed to get the raft configuration: %s", err)
+		n.logger.Error("Failed to get the raft configuration", "error", err)
 		return err
 	}
 
 	conf := confFt.Configuration()
-	return n.addVoter(conf, id, addr)
+	return n.addMember(conf, id, addr, force, nonVoter)
+}
+
+// MemberConflictError is returned when a node asks to join with the ID or the
+// address of another member of the cluster.
+type MemberConflictError struct {
+	ID         string
+	Addr       string
+	MemberID   string
+	MemberAddr string
+}
+
+func (e *MemberConflictError) Error() string {
+	return fmt.Sprintf("Node '%s' at '%s' conflicts with member '%s' at '%s', the join must be forced to replace it", e.ID, e.Addr, e.MemberID, e.MemberAddr)
 }
 
-func (n *Node) addVoter(conf raft.Configuration, id, addr string) error {
+func (n *Node) addMember(conf raft.Configuration, id, addr string, force, nonVoter bool) error {
+	for _, srv := range conf.Servers {
+		if srv.ID == raft.ServerID(id) && srv.Address == raft.ServerAddress(addr) {
+			n.logger.Info("Node is already a member in the cluster, AddPeer request ignored", "peer", id, "voter", srv.Suffrage == raft.Voter)
+			return nil
+		}
+	}
 	for _, srv := range conf.Servers {
 		if srv.ID == raft.ServerID(id) || srv.Address == raft.ServerAddress(addr) {
-			if srv.ID == raft.ServerID(id) && srv.Address == raft.ServerAddress(addr) {
-				n.logger.Printf("Node '%s' is already a member in the cluster,  AddPeer request ignored", id)
-				return nil
+			if !force {
+				return &MemberConflictError{ID: id, Addr: addr, MemberID: string(srv.ID), MemberAddr: string(srv.Address)}
 			}
+			n.logger.Warn("Evicting a member replaced by a forced join", "member", srv.ID, "addr", srv.Address, "peer", id)
 			ft := n.raft.RemoveServer(srv.ID, 0, 0)
 			if err := ft.Error(); err != nil {
 				return fmt.Errorf("Error removing node '%s' from the Raft cluster: %s", id, err)
 			}
 		}
 	}
-	ft := n.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(addr), 0, 0)
-	if err := ft.Error(); err != nil {
-		return fmt.Errorf("Error adding node '%s' as a voter in the Raft cluster: %s", id, err)
+	if nonVoter {
+		ft := n.raft.AddNonvoter(raft.ServerID(id), raft.ServerAddress(addr), 0, 0)
+		if err := ft.Error(); err != nil {
+			return fmt.Errorf("Error adding node '%s' as a non-voter in the Raft cluster: %s", id, err)
+		}
+	} else {
+		ft := n.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(addr), 0, 0)
+		if err := ft.Error(); err != nil {
+			return fmt.Errorf("Error adding node '%s' as a voter in the Raft cluster: %s", id, err)
+		}
 	}
 
-	n.logger.Printf("Node '%s' at '%s' joined the cluster successfully", id, addr)
+	n.logger.Info("Node joined the cluster successfully", "peer", id, "addr", addr)
 	return nil
 }
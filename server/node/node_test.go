@@ -0,0 +1,85 @@
+package node
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestRaftConfig(t *testing.T) {
+	conf := raft.DefaultConfig()
+	defaults := *conf
+	RaftConfig{ElectionTimeout: 3 * time.Second, TrailingLogs: 100, MaxPool: 2}.apply(conf)
+	if conf.ElectionTimeout != 3*time.Second || conf.TrailingLogs != 100 {
+		t.Errorf("Expected the tunables to be set, got %+v", conf)
+	}
+	if conf.HeartbeatTimeout != defaults.HeartbeatTimeout || conf.SnapshotThreshold != defaults.SnapshotThreshold {
+		t.Errorf("Expected the zero tunables to keep raft's defaults, got %+v", conf)
+	}
+
+	tests := []struct {
+		name   string
+		config RaftConfig
+		valid  bool
+	}{
+		{"defaults", RaftConfig{}, true},
+		{"tuned", RaftConfig{HeartbeatTimeout: 2 * time.Second, ElectionTimeout: 2 * time.Second, LeaderLeaseTimeout: time.Second, MaxPool: 10, TransportTimeout: time.Minute}, true},
+		{"election shorter than the heartbeat", RaftConfig{HeartbeatTimeout: 2 * time.Second, ElectionTimeout: time.Second}, false},
+		{"lease longer than the heartbeat", RaftConfig{LeaderLeaseTimeout: 2 * time.Second}, false},
+		{"too many entries per append", RaftConfig{MaxAppendEntries: 2048}, false},
+		{"negative pool", RaftConfig{MaxPool: -1}, false},
+		{"negative transport timeout", RaftConfig{TransportTimeout: -time.Second}, false},
+	}
+	for _, tt := range tests {
+		err := tt.config.Validate()
+		if tt.valid && err != nil {
+			t.Errorf("%s: expected the config to be accepted, got %s", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: expected the config to be rejected", tt.name)
+		}
+	}
+}
+
+func TestBootstrapAdvertise(t *testing.T) {
+	dir, err := ioutil.TempDir("", "heartbeat-raft")
+	if err != nil {
+		t.Fatalf("Could not create the data directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	bind := l.Addr().String()
+	l.Close()
+
+	// The node listens on the bind address, and is known by the advertised
+	// one which isn't local.
+	s := NewInMemStore()
+	s.Node = NewNode("node-1", dir, "10.255.0.1:9999", s)
+	s.Node.RaftBindAddr = bind
+	s.Node.RaftConfig = RaftConfig{HeartbeatTimeout: 100 * time.Millisecond, ElectionTimeout: 100 * time.Millisecond, LeaderLeaseTimeout: 100 * time.Millisecond, MaxPool: 1}
+	if err := s.Node.Bootstrap(true); err != nil {
+		t.Fatalf("Could not bootstrap the node: %s", err)
+	}
+	defer s.Node.raft.Shutdown()
+
+	future := s.Node.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		t.Fatalf("Could not read the configuration: %s", err)
+	}
+	if servers := future.Configuration().Servers; len(servers) != 1 || servers[0].Address != "10.255.0.1:9999" {
+		t.Errorf("Expected the node to be recorded with its advertised address, got %+v", servers)
+	}
+	conn, err := net.DialTimeout("tcp", bind, time.Second)
+	if err != nil {
+		t.Fatalf("Expected the transport to listen on %s, got %s", bind, err)
+	}
+	conn.Close()
+	waitForLeader(t, s)
+}
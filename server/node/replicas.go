@@ -0,0 +1,158 @@
+package node
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/hashicorp/raft"
+)
+
+// Members returns the members of the cluster as known by this node, with
+// their suffrage. The HTTP address of a member is only known if it joined, or
+// led the cluster at some point.
+func (n *Node) Members() ([]MemberStatus, error) {
+	confFt := n.raft.GetConfiguration()
+	if err := confFt.Error(); err != nil {
+		return nil, err
+	}
+	httpAddrs := make(map[string]string)
+	for _, m := range n.store.GetMembers() {
+		httpAddrs[m.RaftAddr] = m.HttpAddr
+	}
+	leader := string(n.raft.Leader())
+
+	servers := confFt.Configuration().Servers
+	members := make([]MemberStatus, 0, len(servers))
+	for _, srv := range servers {
+		addr := string(srv.Address)
+		members = append(members, MemberStatus{
+			Member: Member{ID: string(srv.ID), RaftAddr: addr, HttpAddr: httpAddrs[addr]},
+			Voter:  srv.Suffrage == raft.Voter,
+			Leader: addr == leader,
+		})
+	}
+	return members, nil
+}
+
+// SetVoter promotes the member to a voter, or demotes it to a non-voter that
+// keeps receiving the replicated state without being part of the quorum. The
+// leader can't be demoted, its leadership must be transferred first.
+func (n *Node) SetVoter(id string, voter bool) error {
+	if !n.IsLeader() {
+		return n.notLeaderError()
+	}
+	action := "promote"
+	if !voter {
+		action = "demote"
+	}
+	confFt := n.raft.GetConfiguration()
+	if err := confFt.Error(); err != nil {
+		return err
+	}
+	var server *raft.Server
+	for _, srv := range confFt.Configuration().Servers {
+		if srv.ID == raft.ServerID(id) {
+			srv := srv
+			server = &srv
+		}
+	}
+	if server == nil {
+		return &MemberChangeError{ID: id, Action: action, Reason: "not a member of the cluster"}
+	}
+	if (server.Suffrage == raft.Voter) == voter {
+		n.logger.Info("The member already has the requested suffrage", "peer", id, "voter", voter)
+		return nil
+	}
+
+	if voter {
+		n.logger.Info("Promoting a member to voter", "peer", id)
+		if err := n.raft.AddVoter(server.ID, server.Address, 0, 0).Error(); err != nil {
+			return fmt.Errorf("Error promoting node '%s' to voter: %s", id, err)
+		}
+		return nil
+	}
+	if id == n.id {
+		return &MemberChangeError{ID: id, Action: action, Reason: "it's the leader, transfer the leadership first"}
+	}
+	n.logger.Info("Demoting a member to non-voter", "peer", id)
+	if err := n.raft.DemoteVoter(server.ID, 0, 0).Error(); err != nil {
+		return fmt.Errorf("Error demoting node '%s' to non-voter: %s", id, err)
+	}
+	return nil
+}
+
+// handleMembers serves `GET /cluster/members` from the local configuration,
+// any member can answer it.
+func (s *HttpServer) handleMembers(req *http.Request, res http.ResponseWriter) {
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if authz := s.authorize(req, res); authz == nil {
+		return
+	} else if !authz.OperatorRead() {
+		s.forbidden(req, res)
+		return
+	}
+	members, err := s.node.Members()
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		res.Write([]byte(fmt.Sprintf("Server error occured: %s", err)))
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(members)
+}
+
+// handleSuffrage serves `POST /cluster/promote` and `POST /cluster/demote`,
+// with the ID of the member in the `id` parameter.
+func (s *HttpServer) handleSuffrage(req *http.Request, res http.ResponseWriter) {
+	if req.Method != http.MethodPost {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if authz := s.authorize(req, res); authz == nil {
+		return
+	} else if !authz.OperatorWrite() {
+		s.forbidden(req, res)
+		return
+	}
+	if !s.node.IsLeader() {
+		s.redirectToLeader(req, res)
+		return
+	}
+	id := req.URL.Query().Get("id")
+	if id == "" {
+		s.badRequest(res)
+		return
+	}
+
+	voter := req.URL.Path == "/cluster/promote"
+	s.log(req).Info("Suffrage change requested", "peer", id, "voter", voter)
+	if err := s.node.SetVoter(id, voter); err != nil {
+		s.log(req).Error("Could not change the suffrage of a member", "peer", id, "voter", voter, "error", err)
+		if _, ok := err.(*MemberChangeError); ok {
+			res.WriteHeader(http.StatusBadRequest)
+			res.Write([]byte(err.Error()))
+			return
+		}
+		s.writeError(req, res, err)
+		return
+	}
+	res.WriteHeader(http.StatusOK)
+}
+
+// RequestSuffrageChange asks the servers in turn to promote the member to a
+// voter, or to demote it to a non-voter, the followers redirect the request
+// to the leader.
+func RequestSuffrageChange(servers []string, id string, voter bool, token string, config *tls.Config) error {
+	path := "/cluster/demote?id="
+	if voter {
+		path = "/cluster/promote?id="
+	}
+	_, err := sendOperatorRequest(servers, path+url.QueryEscape(id), token, config)
+	return err
+}
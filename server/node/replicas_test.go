@@ -0,0 +1,113 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// suffrages returns whether each member is a voter as known by the node.
+func suffrages(t *testing.T, s *inMemStore) map[string]bool {
+	t.Helper()
+	members, err := s.Node.Members()
+	if err != nil {
+		t.Fatalf("Could not list the members: %s", err)
+	}
+	voters := make(map[string]bool, len(members))
+	for _, m := range members {
+		voters[m.ID] = m.Voter
+	}
+	return voters
+}
+
+func TestSetVoter(t *testing.T) {
+	nodes := newTestCluster(t, 3)
+	leader, follower := nodes[0], nodes[1]
+	id := nodes[2].Node.id
+
+	if err := follower.Node.SetVoter(id, false); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("Expected a follower to refuse the change, got %v", err)
+	}
+	for _, tt := range []struct {
+		id    string
+		voter bool
+	}{{"node-9", true}, {"node-9", false}, {leader.Node.id, false}} {
+		if _, ok := leader.Node.SetVoter(tt.id, tt.voter).(*MemberChangeError); !ok {
+			t.Errorf("%s voter=%v: expected a member change error", tt.id, tt.voter)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		voter bool
+	}{
+		{"demote", false},
+		{"demote again", false},
+		{"promote", true},
+		{"promote again", true},
+	}
+	for _, tt := range tests {
+		if err := leader.Node.SetVoter(id, tt.voter); err != nil {
+			t.Fatalf("%s: could not change the suffrage: %s", tt.name, err)
+		}
+		voters := suffrages(t, leader)
+		if len(voters) != 3 || voters[id] != tt.voter || !voters[leader.Node.id] || !voters[follower.Node.id] {
+			t.Errorf("%s: unexpected members %v", tt.name, voters)
+		}
+	}
+}
+
+func TestSuffrageEndpoints(t *testing.T) {
+	nodes := newTestCluster(t, 3)
+	leader, follower := NewServer("", nodes[0].Node), NewServer("", nodes[1].Node)
+	id := nodes[2].Node.id
+	post := func(srv *HttpServer, target string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		srv.ServeHTTP(res, httptest.NewRequest(http.MethodPost, target, nil))
+		return res
+	}
+
+	tests := []struct {
+		srv    *HttpServer
+		target string
+		code   int
+		voter  bool
+	}{
+		{follower, "/cluster/demote?id=" + id, http.StatusTemporaryRedirect, true},
+		{leader, "/cluster/demote", http.StatusBadRequest, true},
+		{leader, "/cluster/demote?id=node-9", http.StatusBadRequest, true},
+		{leader, "/cluster/demote?id=" + nodes[0].Node.id, http.StatusBadRequest, true},
+		{leader, "/cluster/demote?id=" + id, http.StatusOK, false},
+		{leader, "/cluster/promote?id=" + id, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		if res := post(tt.srv, tt.target); res.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d: %s", tt.target, tt.code, res.Code, res.Body)
+		}
+		if voters := suffrages(t, nodes[0]); voters[id] != tt.voter {
+			t.Errorf("%s: expected %s to be a voter: %v, got %v", tt.target, id, tt.voter, voters)
+		}
+	}
+
+	// Any member lists the members, the demoted one as a non-voter.
+	post(leader, "/cluster/demote?id="+id)
+	for deadline := time.Now().Add(5 * time.Second); suffrages(t, nodes[1])[id]; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("The demotion was not replicated to the follower")
+		}
+	}
+	res := httptest.NewRecorder()
+	follower.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/cluster/members", nil))
+	var members []MemberStatus
+	if err := json.Unmarshal(res.Body.Bytes(), &members); err != nil || res.Code != http.StatusOK {
+		t.Fatalf("Could not list the members, got %d: %s", res.Code, res.Body)
+	}
+	for _, m := range members {
+		if m.Voter != (m.ID != id) || m.Leader != (m.ID == nodes[0].Node.id) || m.HttpAddr != m.ID+":9000" {
+			t.Errorf("Unexpected member %+v", m)
+		}
+	}
+}
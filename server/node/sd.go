@@ -0,0 +1,85 @@
+package node
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PrometheusTargetGroup is a target group in the format of Prometheus' HTTP
+// service discovery.
+type PrometheusTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// PrometheusTargets renders the services as Prometheus target groups, one per
+// instance as their tags and metadata differ. An empty `service` or `tag`
+// doesn't filter on it.
+//
+// The labels follow the ones of Prometheus' Consul discovery:
+//   - `__meta_heartbeat_service` is the name of the service.
+//   - `__meta_heartbeat_tags` is the list of tags wrapped and separated by
+//     commas (e.g. `,primary,v2,`), so that a regex can match a single tag.
+//   - `__meta_heartbeat_metadata_<key>` for each metadata key, with the
+//     characters that are not allowed in label names replaced by `_`.
+func PrometheusTargets(services []Service, service, tag string) []PrometheusTargetGroup {
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+
+	groups := make([]PrometheusTargetGroup, 0)
+	for _, svc := range services {
+		if service != "" && svc.Name != service {
+			continue
+		}
+		for _, inst := range svc.Instances {
+			if tag != "" && !hasTag(inst.Tags, tag) {
+				continue
+			}
+			labels := map[string]string{
+				"__meta_heartbeat_service": svc.Name,
+				"__meta_heartbeat_tags":    "," + strings.Join(inst.Tags, ",") + ",",
+			}
+			for k, v := range inst.Meta {
+				labels["__meta_heartbeat_metadata_"+sanitizeLabel(k)] = v
+			}
+			groups = append(groups, PrometheusTargetGroup{
+				Targets: []string{net.JoinHostPort(inst.Host, strconv.Itoa(int(inst.Port)))},
+				Labels:  labels,
+			})
+		}
+	}
+	return groups
+}
+
+// handlePrometheusSD serves the registry to Prometheus' `http_sd_configs`, the
+// optional `service` and `tag` query parameters narrow down the targets.
+func (s *HttpServer) handlePrometheusSD(req *http.Request, res http.ResponseWriter) {
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	authz := s.authorize(req, res)
+	if authz == nil || !s.verifyRead(req, res) {
+		return
+	}
+	query := req.URL.Query()
+	groups := PrometheusTargets(authz.FilterServices(s.node.store.GetServices().Services), query.Get("service"), query.Get("tag"))
+
+	res.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(groups); err != nil {
+		s.log(req).Error("Could not write the Prometheus targets", "error", err)
+	}
+}
+
+// sanitizeLabel maps a metadata key to a valid Prometheus label name suffix.
+func sanitizeLabel(key string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, key)
+}
@@ -0,0 +1,132 @@
+package node
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestPrometheusTargets(t *testing.T) {
+	services := []Service{
+		{Name: "web", Instances: []Instance{
+			{Host: "10.0.0.1", Port: 80, Tags: []string{"primary", "v2"}, Meta: map[string]string{"version": "1.2", "rack-id": "r1"}},
+			{Host: "fd00::1", Port: 81},
+		}},
+		{Name: "api", Instances: []Instance{{Host: "10.0.1.1", Port: 90, Tags: []string{"v2"}}}},
+	}
+
+	tests := []struct {
+		service string
+		tag     string
+		groups  []PrometheusTargetGroup
+	}{
+		{"", "", []PrometheusTargetGroup{
+			{Targets: []string{"10.0.1.1:90"}, Labels: map[string]string{"__meta_heartbeat_service": "api", "__meta_heartbeat_tags": ",v2,"}},
+			{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{
+				"__meta_heartbeat_service":          "web",
+				"__meta_heartbeat_tags":             ",primary,v2,",
+				"__meta_heartbeat_metadata_version": "1.2",
+				"__meta_heartbeat_metadata_rack_id": "r1",
+			}},
+			{Targets: []string{"[fd00::1]:81"}, Labels: map[string]string{"__meta_heartbeat_service": "web", "__meta_heartbeat_tags": ",,"}},
+		}},
+		{"api", "", []PrometheusTargetGroup{
+			{Targets: []string{"10.0.1.1:90"}, Labels: map[string]string{"__meta_heartbeat_service": "api", "__meta_heartbeat_tags": ",v2,"}},
+		}},
+		{"", "primary", []PrometheusTargetGroup{
+			{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{
+				"__meta_heartbeat_service":          "web",
+				"__meta_heartbeat_tags":             ",primary,v2,",
+				"__meta_heartbeat_metadata_version": "1.2",
+				"__meta_heartbeat_metadata_rack_id": "r1",
+			}},
+		}},
+		{"api", "primary", []PrometheusTargetGroup{}},
+		{"db", "", []PrometheusTargetGroup{}},
+	}
+	for _, tt := range tests {
+		groups := PrometheusTargets(services, tt.service, tt.tag)
+		if !reflect.DeepEqual(groups, tt.groups) {
+			t.Errorf("service=%q tag=%q: expected %+v, got %+v", tt.service, tt.tag, tt.groups, groups)
+		}
+	}
+}
+
+func TestSanitizeLabel(t *testing.T) {
+	tests := map[string]string{
+		"version":        "version",
+		"rack-id":        "rack_id",
+		"app.kubernetes": "app_kubernetes",
+		"Zone_1":         "Zone_1",
+		"café":           "caf_",
+	}
+	for key, expected := range tests {
+		if label := sanitizeLabel(key); label != expected {
+			t.Errorf("%s: expected %s, got %s", key, expected, label)
+		}
+	}
+}
+
+func TestPrometheusSDEndpoint(t *testing.T) {
+	s := newTestNode(t, false)
+	a := &testApplier{t: t, s: s}
+	a.apply(Command{Type: "REG", Value: encode(t, InstanceRegistration{ServiceName: "web", Host: "10.0.0.1", Port: 80, Tags: []string{"primary"}})})
+	a.apply(Command{Type: "REG", Value: encode(t, InstanceRegistration{ServiceName: "api", Host: "10.0.1.1", Port: 90})})
+	srv := NewServer("", s.Node)
+	get := func(url string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		srv.ServeHTTP(res, httptest.NewRequest(http.MethodGet, url, nil))
+		return res
+	}
+
+	tests := []struct {
+		url     string
+		targets []string
+	}{
+		{"/sd/prometheus?stale", []string{"10.0.1.1:90", "10.0.0.1:80"}},
+		{"/sd/prometheus?stale&service=web", []string{"10.0.0.1:80"}},
+		{"/sd/prometheus?stale&tag=primary", []string{"10.0.0.1:80"}},
+		{"/sd/prometheus?stale&service=db", []string{}},
+	}
+	for _, tt := range tests {
+		res := get(tt.url)
+		if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: expected a JSON answer, got %d %v", tt.url, res.Code, res.Header())
+			continue
+		}
+		var groups []PrometheusTargetGroup
+		if err := json.Unmarshal(res.Body.Bytes(), &groups); err != nil {
+			t.Errorf("%s: could not parse %s: %s", tt.url, res.Body, err)
+			continue
+		}
+		// Prometheus refuses `null`, no target must still be a list.
+		targets := make([]string, 0, len(groups))
+		for _, g := range groups {
+			targets = append(targets, g.Targets...)
+		}
+		if !reflect.DeepEqual(targets, tt.targets) {
+			t.Errorf("%s: expected %v, got %v", tt.url, tt.targets, targets)
+		}
+	}
+	if body := get("/sd/prometheus?stale&service=db").Body.String(); body != "[]\n" {
+		t.Errorf("Expected an empty list, got %q", body)
+	}
+
+	// Only the leader serves default reads.
+	if res := get("/sd/prometheus"); res.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a follower without a leader to refuse a default read, got %d", res.Code)
+	}
+	res := httptest.NewRecorder()
+	srv.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/sd/prometheus", nil))
+	if res.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected a POST to be refused, got %d", res.Code)
+	}
+
+	// The targets are filtered by the token's policy.
+	s.Node.ACL = ACLConfig{Enabled: true, DefaultPolicy: ACLDeny}
+	if res := get("/sd/prometheus?stale"); res.Code != http.StatusOK || res.Body.String() != "[]\n" {
+		t.Errorf("Expected no target without a token, got %d: %s", res.Code, res.Body)
+	}
+}
@@ -0,0 +1,274 @@
+package node
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+func (s *inMemStore) CreateSession(req SessionRequest) (*Session, error) {
+	if !s.Node.IsLeader() {
+		return nil, s.Node.notLeaderError()
+	}
+
+	sess := Session{
+		Service: req.Service,
+		Host:    req.Host,
+		Port:    req.Port,
+	}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("Invalid session TTL '%s'", req.TTL)
+		}
+		sess.TTLMs = uint64(ttl.Milliseconds())
+	}
+	if !sess.bound() && sess.TTLMs == 0 {
+		return nil, fmt.Errorf("A session must either be bound to an instance or have a TTL")
+	}
+
+	// The identifier is chosen by the leader, so that every replica applies the
+	// exact same session.
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	sess.ID = id
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(sess); err != nil {
+		return nil, err
+	}
+	cmd := &Command{
+		Type:  "SCREATE",
+		Value: b.String(),
+	}
+
+	resp, err := applyCommand(cmd, s.Node.raft)
+	if err != nil {
+		return nil, err
+	}
+	switch r := resp.(type) {
+	case *Session:
+		return r, nil
+	case error:
+		return nil, r
+	default:
+		return nil, fmt.Errorf("Unexpected session response %v", resp)
+	}
+}
+
+func (s *inMemStore) RenewSession(id string) error {
+	return s.applySessionCommand(&Command{
+		Type: "SRENEW",
+		Key:  id,
+	})
+}
+
+func (s *inMemStore) DestroySession(id string) error {
+	return s.applySessionCommand(&Command{
+		Type: "SDESTROY",
+		Key:  id,
+	})
+}
+
+func (s *inMemStore) applySessionCommand(cmd *Command) error {
+	resp, err := applyCommand(cmd, s.Node.raft)
+	if err != nil {
+		return err
+	}
+	if err, ok := resp.(error); ok {
+		return err
+	}
+	return nil
+}
+
+func (s *inMemStore) GetSessions() []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, *sess)
+	}
+	return sessions
+}
+
+func (s *inMemStore) ExpiredSessions(now time.Time) []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expired := make([]Session, 0)
+	for id, deadline := range s.sessionExpiry {
+		if now.After(deadline) {
+			expired = append(expired, *s.sessions[id])
+		}
+	}
+	return expired
+}
+
+func (s *inMemStore) Acquire(key, value, session string) (bool, error) {
+	return s.applyLockCommand(&Command{
+		Type:    "LOCK",
+		Key:     key,
+		Value:   value,
+		Session: session,
+	})
+}
+
+func (s *inMemStore) Release(key, session string) (bool, error) {
+	return s.applyLockCommand(&Command{
+		Type:    "UNLOCK",
+		Key:     key,
+		Session: session,
+	})
+}
+
+func (s *inMemStore) applyLockCommand(cmd *Command) (bool, error) {
+	if !s.Node.IsLeader() {
+		return false, s.Node.notLeaderError()
+	}
+	resp, err := applyCommand(cmd, s.Node.raft)
+	if err != nil {
+		return false, err
+	}
+	switch r := resp.(type) {
+	case bool:
+		return r, nil
+	case error:
+		return false, r
+	default:
+		return false, fmt.Errorf("Unexpected lock response %v", resp)
+	}
+}
+
+func (s *inMemStore) execSessionCreate(index uint64, value string) interface{} {
+	var sess Session
+	if err := json.NewDecoder(bytes.NewReader([]byte(value))).Decode(&sess); err != nil {
+		s.logger.Error("Failed executing a session create request", "value", value, "error", err)
+		return err
+	}
+
+	if sess.bound() && !s.hasInstance(sess.Service, sess.Host, sess.Port) {
+		return fmt.Errorf("No instance '%s:%d' is registered for service '%s'", sess.Host, sess.Port, sess.Service)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess.CreateIndex = index
+	s.sessions[sess.ID] = &sess
+	s.trackSessionExpiry(&sess)
+	s.logger.Info("Created session", "session", sess.ID)
+
+	cp := sess
+	return &cp
+}
+
+func (s *inMemStore) execSessionRenew(id string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, has := s.sessions[id]
+	if !has {
+		return fmt.Errorf("Session '%s' does not exist", id)
+	}
+	s.trackSessionExpiry(sess)
+	return nil
+}
+
+func (s *inMemStore) execSessionDestroy(index uint64, id string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.destroySession(index, id)
+	return nil
+}
+
+// destroySession removes the session and releases the locks it holds, the
+// values of the released keys are kept.
+// Must be called with `mu` held.
+func (s *inMemStore) destroySession(index uint64, id string) {
+	if _, has := s.sessions[id]; !has {
+		return
+	}
+	delete(s.sessions, id)
+	delete(s.sessionExpiry, id)
+
+	for k, e := range s.m {
+		if e.Session == id {
+			released := *e
+			released.Session = ""
+			released.ModifyIndex = index
+			s.m[k] = &released
+			s.recordChange(index, k)
+		}
+	}
+	s.logger.Info("Destroyed session", "session", id)
+}
+
+// invalidateInstanceSessions destroys every session bound to the given
+// instance, it's called when the instance gets removed from the registry.
+func (s *inMemStore) invalidateInstanceSessions(index uint64, service, host string, port uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.sessions {
+		if sess.Service == service && sess.Host == host && sess.Port == port {
+			s.destroySession(index, id)
+		}
+	}
+}
+
+func (s *inMemStore) execLock(index uint64, key, value, session string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, has := s.sessions[session]; !has {
+		return fmt.Errorf("Session '%s' does not exist", session)
+	}
+
+	cur := s.m[key]
+	if cur != nil && cur.Session != "" && cur.Session != session {
+		return false
+	}
+
+	e := newKVEntry(cur, index, key, value, 0)
+	if cur == nil || cur.Session != session {
+		e.LockIndex++
+	}
+	e.Session = session
+	s.m[key] = e
+	s.trackExpiry(e)
+	s.recordChange(index, key)
+	return true
+}
+
+func (s *inMemStore) execUnlock(index uint64, key, session string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur := s.m[key]
+	if cur == nil || cur.Session != session {
+		return false
+	}
+
+	released := *cur
+	released.Session = ""
+	released.ModifyIndex = index
+	s.m[key] = &released
+	s.recordChange(index, key)
+	return true
+}
+
+// trackSessionExpiry starts the local countdown of the session's TTL.
+// Must be called with `mu` held.
+func (s *inMemStore) trackSessionExpiry(sess *Session) {
+	if sess.TTLMs == 0 {
+		return
+	}
+	s.sessionExpiry[sess.ID] = time.Now().Add(time.Duration(sess.TTLMs) * time.Millisecond)
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
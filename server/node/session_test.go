@@ -0,0 +1,93 @@
+package node
+
+import "testing"
+
+func TestDestroySessionReleasesLocks(t *testing.T) {
+	tests := []struct {
+		name    string
+		destroy func(t *testing.T) Command
+	}{
+		{
+			name:    "destroyed",
+			destroy: func(t *testing.T) Command { return Command{Type: "SDESTROY", Key: "s1"} },
+		},
+		{
+			name: "instance removed",
+			destroy: func(t *testing.T) Command {
+				return Command{Type: "ENDEL", Value: encode(t, DelRequest{Name: "web", Instance: InstanceEntry{Host: "10.0.0.1", Port: 80}})}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore()
+			a := &testApplier{t: t, s: s}
+			a.apply(Command{Type: "REG", Value: encode(t, InstanceRegistration{ServiceName: "web", Host: "10.0.0.1", Port: 80})})
+			a.apply(Command{Type: "SCREATE", Value: encode(t, Session{ID: "s1", Service: "web", Host: "10.0.0.1", Port: 80})})
+			a.apply(Command{Type: "SCREATE", Value: encode(t, Session{ID: "s2", TTLMs: 60000})})
+			a.apply(Command{Type: "LOCK", Key: "a", Value: "1", Session: "s1"})
+			a.apply(Command{Type: "LOCK", Key: "b", Value: "1", Session: "s1"})
+			a.apply(Command{Type: "LOCK", Key: "c", Value: "1", Session: "s2"})
+
+			a.apply(tt.destroy(t))
+			if _, has := s.sessions["s1"]; has {
+				t.Errorf("Expected the session to be destroyed")
+			}
+			for _, k := range []string{"a", "b"} {
+				e := s.m[k]
+				if e.Session != "" || e.Value != "1" || e.ModifyIndex != a.index {
+					t.Errorf("Expected '%s' to be released at %d and keep its value, got %+v", k, a.index, e)
+				}
+			}
+			if e := s.m["c"]; e.Session != "s2" {
+				t.Errorf("Expected 'c' to stay locked by s2, got '%s'", e.Session)
+			}
+
+			// The released keys can be locked by another session.
+			if ok := a.apply(Command{Type: "LOCK", Key: "a", Value: "2", Session: "s2"}); ok != true {
+				t.Errorf("Expected s2 to acquire the released lock, got %v", ok)
+			}
+			if e := s.m["a"]; e.LockIndex != 2 {
+				t.Errorf("Expected the lock index to be 2, got %d", e.LockIndex)
+			}
+		})
+	}
+}
+
+func TestLockContention(t *testing.T) {
+	s := newTestStore()
+	a := &testApplier{t: t, s: s}
+	a.apply(Command{Type: "SCREATE", Value: encode(t, Session{ID: "s1", TTLMs: 60000})})
+	a.apply(Command{Type: "SCREATE", Value: encode(t, Session{ID: "s2", TTLMs: 60000})})
+
+	steps := []struct {
+		cmd       Command
+		expected  interface{}
+		session   string
+		value     string
+		lockIndex uint64
+	}{
+		{Command{Type: "LOCK", Key: "k", Value: "1", Session: "s1"}, true, "s1", "1", 1},
+		// The lock is held, another session can neither take nor release it.
+		{Command{Type: "LOCK", Key: "k", Value: "2", Session: "s2"}, false, "s1", "1", 1},
+		{Command{Type: "UNLOCK", Key: "k", Session: "s2"}, false, "s1", "1", 1},
+		// Acquiring it again updates the value without a new lock index.
+		{Command{Type: "LOCK", Key: "k", Value: "3", Session: "s1"}, true, "s1", "3", 1},
+		{Command{Type: "UNLOCK", Key: "k", Session: "s1"}, true, "", "3", 1},
+		{Command{Type: "UNLOCK", Key: "k", Session: "s1"}, false, "", "3", 1},
+		{Command{Type: "LOCK", Key: "k", Value: "4", Session: "s2"}, true, "s2", "4", 2},
+	}
+	for i, step := range steps {
+		if res := a.apply(step.cmd); res != step.expected {
+			t.Errorf("Step %d: expected %s by %s to return %v, got %v", i, step.cmd.Type, step.cmd.Session, step.expected, res)
+		}
+		e := s.m["k"]
+		if e.Session != step.session || e.Value != step.value || e.LockIndex != step.lockIndex {
+			t.Errorf("Step %d: expected '%s' held by '%s' with lock index %d, got %+v", i, step.value, step.session, step.lockIndex, e)
+		}
+	}
+
+	if _, ok := a.apply(Command{Type: "LOCK", Key: "k", Value: "5", Session: "unknown"}).(error); !ok {
+		t.Errorf("Expected a lock by an unknown session to fail")
+	}
+}
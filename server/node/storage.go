@@ -2,59 +2,151 @@ package node
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
-	"os"
+	"io/ioutil"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/raft"
 )
 
 type inMemStore struct {
 	mu sync.Mutex
-	m  map[string]string
-
+	m  map[string]*KVEntry
+	// expiry holds the local deadline of every key written with a TTL, it's not
+	// part of the replicated state, only the leader acts on it by replicating a
+	// `KEXP` command.
+	expiry map[string]time.Time
+
+	// kvIndex is the Raft log index of the last command that changed a key,
+	// `changes` is a ring of the most recent changes starting at
+	// `changesHead`, anything at or below `changesFloor` has been forgotten.
+	// They back the blocking queries of the `watches`.
+	kvIndex      uint64
+	changes      []kvChange
+	changesHead  int
+	changesFloor uint64
+	watches      []*kvWatch
+
+	// sessions are guarded by `mu` as well, since invalidating a session
+	// releases the locks it holds on keys.
+	sessions      map[string]*Session
+	sessionExpiry map[string]time.Time
+
+	// services holds the current `registry`, it's replaced as a whole on every
+	// change so that readers never need to take a lock, `ms` only serializes
+	// the writers.
 	ms       sync.Mutex
-	services map[string]*ServiceEntry
+	services atomic.Value
+
+	// leases are the renewals received by the leader that were not replicated
+	// yet, guarded by `ml`.
+	ml     sync.Mutex
+	leases *leaseTable
+
+	// Recent registry changes, a ring starting at `eventsHead`, guarded by
+	// `ms`.
+	events       []ServiceEvent
+	eventsHead   int
+	eventWaiters []chan struct{}
+
+	// acl holds the ACL tokens by secret ID, guarded by `ma`.
+	ma              sync.Mutex
+	acl             map[string]*ACLToken
+	aclBootstrapped bool
+
+	// members holds the addresses of the nodes by ID, guarded by `ma`.
+	members map[string]Member
 
 	Node   *Node
-	logger *log.Logger
+	logger hclog.Logger
 }
 
 func NewInMemStore() *inMemStore {
-	return &inMemStore{
-		mu: sync.Mutex{},
-		m:  make(map[string]string),
+	s := &inMemStore{
+		mu:     sync.Mutex{},
+		m:      make(map[string]*KVEntry),
+		expiry: make(map[string]time.Time),
+
+		sessions:      make(map[string]*Session),
+		sessionExpiry: make(map[string]time.Time),
 
-		ms:       sync.Mutex{},
-		services: make(map[string]*ServiceEntry),
+		ms: sync.Mutex{},
 
-		logger: log.New(os.Stderr, "(Store) ", log.LstdFlags),
+		acl:     make(map[string]*ACLToken),
+		members: make(map[string]Member),
+
+		logger: ComponentLogger("store"),
 	}
+	s.services.Store(registry{})
+	return s
 }
 
-func (s *inMemStore) GetResources() map[string]*ServiceEntry {
-	// copy over the local map
-	services := make(map[string]*ServiceEntry)
-	for k, v := range s.services {
-		services[k] = v
+// registry is an immutable view of the registered services.
+//
+// Neither the map, the `ServiceEntry` values nor their `InstanceEntry` values
+// are ever modified once the registry is published, a change publishes a new
+// registry sharing the untouched entries with the previous one.
+type registry map[string]*ServiceEntry
+
+// registry returns the current view of the registered services, which stays
+// consistent for as long as the caller holds it.
+func (s *inMemStore) registry() registry {
+	return s.services.Load().(registry)
+}
+
+// publishService replaces the entry of the service in a new registry, a nil
+// entry removes the service.
+// Must be called with `ms` held.
+func (s *inMemStore) publishService(name string, se *ServiceEntry) {
+	cur := s.registry()
+	next := make(registry, len(cur)+1)
+	for k, v := range cur {
+		next[k] = v
+	}
+	if se == nil {
+		delete(next, name)
+	} else {
+		next[name] = se
 	}
-	return services
+	s.services.Store(next)
+}
+
+// GetResources returns the current registry, the returned map and entries must
+// not be modified.
+func (s *inMemStore) GetResources() map[string]*ServiceEntry {
+	return s.registry()
 }
 
 func (s *inMemStore) Put(key string, value string) error {
-	if s.Node.raft.State() != raft.Leader {
-		// TODO: add request forwarding
-		return fmt.Errorf("Cannot execute a put operation on a none-leader node")
+	return s.PutTTL(key, value, 0)
+}
+
+func (s *inMemStore) PutTTL(key string, value string, ttl time.Duration) error {
+	if !s.Node.IsLeader() {
+		return s.Node.notLeaderError()
 	}
 
 	cmd := &Command{
 		Type:  "PUT",
 		Key:   key,
 		Value: value,
+		TTLMs: uint64(ttl.Milliseconds()),
+	}
+
+	return execCommand(cmd, s.Node.raft)
+}
+
+func (s *inMemStore) ExpireKey(key string, index uint64) error {
+	cmd := &Command{
+		Type:  "KEXP",
+		Key:   key,
+		Index: index,
 	}
 
 	return execCommand(cmd, s.Node.raft)
@@ -65,15 +157,15 @@ type DelRequest struct {
 	Instance InstanceEntry
 }
 
-func (s *inMemStore) DeleteInstance(name string, instance InstanceEntry) {
+func (s *inMemStore) DeleteInstance(name string, instance InstanceEntry) error {
 	var b bytes.Buffer
 	req := DelRequest{
 		Name:     name,
 		Instance: instance,
 	}
 	if err := json.NewEncoder(&b).Encode(req); err != nil {
-		s.logger.Printf("Could not serialize the entry delete request (%v): %s", req, err)
-		return
+		s.logger.Error("Could not serialize the entry delete request", "request", req, "error", err)
+		return err
 	}
 
 	cmd := &Command{
@@ -81,27 +173,96 @@ func (s *inMemStore) DeleteInstance(name string, instance InstanceEntry) {
 		Value: b.String(),
 	}
 
-	execCommand(cmd, s.Node.raft)
+	return execCommand(cmd, s.Node.raft)
 }
 
 func (s *inMemStore) Get(key string) (string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.m[key], nil
+	if e, has := s.m[key]; has {
+		return e.Value, nil
+	}
+	return "", nil
 }
 
-func (s *inMemStore) GetServices() *ServicesResponse {
-	s.ms.Lock()
-	defer s.ms.Unlock()
+func (s *inMemStore) GetEntry(key string) (*KVEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, has := s.m[key]
+	if !has {
+		return nil, false
+	}
+	cp := s.readEntry(e)
+	return &cp, true
+}
+
+// readEntry returns the copy of the entry handed out to readers.
+// Must be called with `mu` held.
+func (s *inMemStore) readEntry(e *KVEntry) KVEntry {
+	cp := *e
+	if deadline, has := s.expiry[e.Key]; has {
+		if left := time.Until(deadline); left > 0 {
+			cp.RemainingTTLMs = uint64(left.Milliseconds())
+		}
+	}
+	return cp
+}
 
+func (s *inMemStore) ExpiredKeys(now time.Time) []KVEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expired := make([]KVEntry, 0)
+	for k, deadline := range s.expiry {
+		if now.After(deadline) {
+			expired = append(expired, *s.m[k])
+		}
+	}
+	return expired
+}
+
+func (s *inMemStore) Txn(ops []TxnOp) (*TxnResponse, error) {
+	if !s.Node.IsLeader() {
+		return nil, s.Node.notLeaderError()
+	}
+	for i, op := range ops {
+		if err := op.validate(); err != nil {
+			return nil, fmt.Errorf("Invalid operation at index %d: %s", i, err)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(ops); err != nil {
+		return nil, err
+	}
+	cmd := &Command{
+		Type:  "TXN",
+		Value: b.String(),
+	}
+
+	resp, err := applyCommand(cmd, s.Node.raft)
+	if err != nil {
+		return nil, err
+	}
+	switch r := resp.(type) {
+	case *TxnResponse:
+		return r, nil
+	case error:
+		return nil, r
+	default:
+		return nil, fmt.Errorf("Unexpected transaction response %v", resp)
+	}
+}
+
+func (s *inMemStore) GetServices() *ServicesResponse {
 	res := &ServicesResponse{
 		Services: make([]Service, 0),
 	}
 
-	for k, v := range s.services {
+	for k, v := range s.registry() {
 		service := Service{
-			Name:      k,
-			Instances: make([]Instance, 0),
+			Name:       k,
+			Persistent: v.Persistent,
+			Instances:  make([]Instance, 0),
 		}
 		for _, inst := range v.Instances {
 			// Devide by a `1000` as the `Sub` call will return a `Duration` which is
@@ -112,6 +273,8 @@ func (s *inMemStore) GetServices() *ServicesResponse {
 				Port:   inst.Port,
 				Host:   inst.Host,
 				Uptime: uptime,
+				Tags:   inst.Tags,
+				Meta:   inst.Meta,
 			})
 		}
 		res.Services = append(res.Services, service)
@@ -120,18 +283,53 @@ func (s *inMemStore) GetServices() *ServicesResponse {
 	return res
 }
 
-func (s *inMemStore) RegisterInstance(reg InstanceRegistration) {
+// RegisterInstance replicates the registration if it adds an instance to the
+// registry, lease renewals of registered instances are only recorded in the
+// leader's memory and replicated by the next checkpoint.
+func (s *inMemStore) RegisterInstance(ctx context.Context, reg InstanceRegistration) (err error) {
+	ctx, span := Tracer.Start(ctx, "store.RegisterInstance")
+	defer func() { span.Finish(err) }()
+
+	if len(s.renewLeases([]InstanceRegistration{reg})) == 0 {
+		span.SetAttribute("replicated", false)
+		return nil
+	}
+	span.SetAttribute("replicated", true)
+
 	var b bytes.Buffer
 	if err := json.NewEncoder(&b).Encode(reg); err != nil {
-		s.logger.Printf("Could not serialize the registration request (%v): %s", reg, err)
-		return
+		s.logger.Error("Could not serialize the registration request", "request", reg, "error", err)
+		return err
 	}
 	cmd := &Command{
 		Type:  "REG",
 		Value: b.String(),
 	}
 
-	execCommand(cmd, s.Node.raft)
+	return execCommandContext(ctx, cmd, s.Node.raft)
+}
+
+func (s *inMemStore) RegisterInstances(ctx context.Context, regs []InstanceRegistration) (err error) {
+	ctx, span := Tracer.Start(ctx, "store.RegisterInstances")
+	defer func() { span.Finish(err) }()
+	span.SetAttribute("instances", len(regs))
+
+	regs = s.renewLeases(regs)
+	span.SetAttribute("replicated", len(regs))
+	if len(regs) == 0 {
+		return nil
+	}
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(regs); err != nil {
+		return err
+	}
+	cmd := &Command{
+		Type:  "BREG",
+		Value: b.String(),
+	}
+
+	return execCommandContext(ctx, cmd, s.Node.raft)
 }
 
 func (s *inMemStore) Delete(key string) (string, error) {
@@ -147,94 +345,260 @@ func (s *inMemStore) Delete(key string) (string, error) {
 }
 
 func execCommand(cmd *Command, rft *raft.Raft) error {
+	return execCommandContext(context.Background(), cmd, rft)
+}
+
+func execCommandContext(ctx context.Context, cmd *Command, rft *raft.Raft) error {
+	_, err := applyCommandContext(ctx, cmd, rft)
+	return err
+}
+
+// applyCommand replicates the command and returns the value returned by the
+// state machine's `Apply` once the command is committed.
+func applyCommand(cmd *Command, rft *raft.Raft) (interface{}, error) {
+	return applyCommandContext(context.Background(), cmd, rft)
+}
+
+// applyCommandContext is `applyCommand` recording the replication as a span of
+// the trace in the context, if any.
+func applyCommandContext(ctx context.Context, cmd *Command, rft *raft.Raft) (res interface{}, err error) {
+	_, span := Tracer.Start(ctx, "raft.Apply")
+	defer func() { span.Finish(err) }()
+	span.SetAttribute("command", cmd.Type)
+	cmd.Trace = span.TraceParent()
+
 	bytes, err := json.Marshal(cmd)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	start := time.Now()
 	ft := rft.Apply(bytes, Timeout)
-	return ft.Error()
+	if err := ft.Error(); err != nil {
+		return nil, err
+	}
+	applyDuration.Observe(time.Since(start).Seconds())
+	span.SetAttribute("index", ft.Index())
+	return ft.Response(), nil
 }
 
 func (s *inMemStore) Apply(l *raft.Log) interface{} {
 	var cmd Command
 
 	if err := json.Unmarshal(l.Data, &cmd); err != nil {
-		s.logger.Fatalf("Cannot unmarchall command")
+		fatal(s.logger, "Cannot unmarchall command", "index", l.Index, "error", err)
 	}
+	fsmCommands.WithLabelValues(cmd.Type).Inc()
 
+	if cmd.Trace == "" {
+		return s.dispatch(l, &cmd)
+	}
+	_, span := Tracer.Start(ContextWithTraceParent(context.Background(), cmd.Trace), "fsm.Apply")
+	span.SetAttribute("command", cmd.Type)
+	span.SetAttribute("index", l.Index)
+	span.SetAttribute("node_id", s.Node.id)
+	res := s.dispatch(l, &cmd)
+	err, _ := res.(error)
+	span.Finish(err)
+	return res
+}
+
+// dispatch applies the command to the state machine.
+func (s *inMemStore) dispatch(l *raft.Log, cmd *Command) interface{} {
 	switch cmd.Type {
 	case "PUT":
-		return s.execPut(cmd.Key, cmd.Value)
+		return s.execPut(l.Index, cmd.Key, cmd.Value, cmd.TTLMs)
 	case "DEL":
-		return s.execDel(cmd.Key, cmd.Value)
+		return s.execDel(l.Index, cmd.Key)
 	case "REG":
-		return s.execReg(cmd.Value)
+		return s.execReg(l.Index, cmd.Value)
+	case "BREG":
+		return s.execBatchReg(l.Index, cmd.Value)
 	case "ENDEL":
-		return s.execEntryDel(cmd.Value)
+		return s.execEntryDel(l.Index, cmd.Value)
+	case "LEASES":
+		return s.execLeases(cmd.Value, cmd.TimeMs)
+	case "SVCDEL":
+		return s.execServiceDel(l.Index, cmd.Key)
+	case "KEXP":
+		return s.execExpire(l.Index, cmd.Key, cmd.Index)
+	case "SCREATE":
+		return s.execSessionCreate(l.Index, cmd.Value)
+	case "SRENEW":
+		return s.execSessionRenew(cmd.Key)
+	case "SDESTROY":
+		return s.execSessionDestroy(l.Index, cmd.Key)
+	case "LOCK":
+		return s.execLock(l.Index, cmd.Key, cmd.Value, cmd.Session)
+	case "UNLOCK":
+		return s.execUnlock(l.Index, cmd.Key, cmd.Session)
+	case "TXN":
+		return s.execTxn(l.Index, cmd.Value)
+	case "ABOOT":
+		return s.execACLCreate(l.Index, cmd.Value, true)
+	case "ACREATE":
+		return s.execACLCreate(l.Index, cmd.Value, false)
+	case "ADELETE":
+		return s.execACLDelete(cmd.Key)
+	case "MEMBER":
+		return s.execMember(cmd.Value)
 	default:
-		s.logger.Fatalf("Cannot unmarchall command")
+		fatal(s.logger, "Cannot unmarchall command", "index", l.Index, "type", cmd.Type)
 		return nil
 	}
 }
 
-func (s *inMemStore) execReg(value string) interface{} {
+func (s *inMemStore) execReg(index uint64, value string) interface{} {
 	var reg InstanceRegistration
 	if err := json.NewDecoder(bytes.NewReader([]byte(value))).Decode(&reg); err != nil {
-		s.logger.Printf("Failed executing a registration request (%s): %s", value, err)
+		s.logger.Error("Failed executing a registration request", "value", value, "error", err)
+		return err
+	}
+	s.applyRegistrations(index, []InstanceRegistration{reg})
+	return nil
+}
+
+func (s *inMemStore) execBatchReg(index uint64, value string) interface{} {
+	var regs []InstanceRegistration
+	if err := json.NewDecoder(bytes.NewReader([]byte(value))).Decode(&regs); err != nil {
+		s.logger.Error("Failed executing a batch registration request", "value", value, "error", err)
 		return err
 	}
+	s.applyRegistrations(index, regs)
+	return nil
+}
+
+// applyRegistrations registers the instances or renews their lease, and
+// publishes all the changes as a single new registry.
+func (s *inMemStore) applyRegistrations(index uint64, regs []InstanceRegistration) {
 	s.ms.Lock()
 	defer s.ms.Unlock()
-	se, has := s.services[reg.ServiceName]
-	if !has {
-		s.logger.Printf("Registering the service '%s' for the first time", reg.ServiceName)
-		se = &ServiceEntry{
-			Name:      reg.ServiceName,
-			Instances: make([]*InstanceEntry, 0),
-		}
+
+	cur := s.registry()
+	next := make(registry, len(cur)+1)
+	for k, v := range cur {
+		next[k] = v
 	}
+	// The published entries are shared with readers, so a service entry and
+	// its instance list are copied the first time they are changed.
+	copied := make(map[string]bool)
 
 	curTime := time.Now()
-	// If an entry already exists with the same host:port pair
-	// act as a lease renewal, updating the last time it got updated to prevent
-	// the cleaner from removing it later on.
-	for _, v := range se.Instances {
-		if v.Host == reg.Host && v.Port == reg.Port {
-			v.LastBeatMs = uint64(curTime.UnixNano()) / uint64(1e6)
-			return nil
+	for _, reg := range regs {
+		se, has := next[reg.ServiceName]
+		if !has {
+			s.logger.Info("Registering the service for the first time", "service", reg.ServiceName)
+			se = &ServiceEntry{
+				Name:      reg.ServiceName,
+				Instances: make([]*InstanceEntry, 0),
+			}
+			s.recordEvent(ServiceEvent{Index: index, Type: EventServiceRegistered, Service: reg.ServiceName})
+		}
+		if !copied[reg.ServiceName] {
+			instances := make([]*InstanceEntry, len(se.Instances), len(se.Instances)+1)
+			copy(instances, se.Instances)
+			se = &ServiceEntry{
+				Name:       se.Name,
+				Instances:  instances,
+				Persistent: se.Persistent,
+			}
+			copied[reg.ServiceName] = true
+		}
+		se.Persistent = se.Persistent || reg.Persistent
+		se.EmptySinceMs = 0
+		next[reg.ServiceName] = se
+
+		// If an entry already exists with the same host:port pair
+		// act as a lease renewal, updating the last time it got updated to prevent
+		// the cleaner from removing it later on.
+		renewed := false
+		for i, v := range se.Instances {
+			if v.Host == reg.Host && v.Port == reg.Port {
+				inst := *v
+				inst.LastBeatMs = uint64(curTime.UnixNano()) / uint64(1e6)
+				inst.Tags = reg.Tags
+				inst.Meta = reg.Meta
+				se.Instances[i] = &inst
+				renewed = true
+				break
+			}
 		}
+		if renewed {
+			continue
+		}
+
+		se.Instances = append(se.Instances, &InstanceEntry{
+			Host:       reg.Host,
+			Port:       reg.Port,
+			Created:    curTime,
+			LastBeatMs: uint64(curTime.UnixNano()) / uint64(1e6),
+			Tags:       reg.Tags,
+			Meta:       reg.Meta,
+		})
+		s.recordEvent(ServiceEvent{Index: index, Type: EventInstanceRegistered, Service: reg.ServiceName, Host: reg.Host, Port: reg.Port})
 	}
 
-	se.Instances = append(se.Instances, &InstanceEntry{
-		Host:       reg.Host,
-		Port:       reg.Port,
-		Created:    curTime,
-		LastBeatMs: uint64(curTime.UnixNano()) / uint64(1e6),
-	})
+	s.services.Store(next)
+}
 
-	s.services[reg.ServiceName] = se
+func (s *inMemStore) execPut(index uint64, key, value string, ttlMs uint64) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := newKVEntry(s.m[key], index, key, value, ttlMs)
+	s.m[key] = e
+	s.trackExpiry(e)
+	s.recordChange(index, key)
 	return nil
 }
 
-func (s *inMemStore) execPut(key, value string) interface{} {
+func (s *inMemStore) execDel(index uint64, key string) interface{} {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.m[key] = value
+	if _, has := s.m[key]; !has {
+		return nil
+	}
+	delete(s.m, key)
+	delete(s.expiry, key)
+	s.recordChange(index, key)
 	return nil
 }
 
-func (s *inMemStore) execDel(key, value string) interface{} {
+// execExpire removes the key only if it still has the given modify index, a
+// key that got written again after the leader decided to expire it is kept.
+func (s *inMemStore) execExpire(index uint64, key string, modifyIndex uint64) interface{} {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	e, has := s.m[key]
+	if !has || e.ModifyIndex != modifyIndex {
+		return nil
+	}
+	s.logger.Debug("Key expired", "key", key, "ttl_ms", e.TTLMs)
 	delete(s.m, key)
+	delete(s.expiry, key)
+	s.recordChange(index, key)
 	return nil
 }
 
-func (s *inMemStore) execEntryDel(value string) interface{} {
+// trackExpiry starts the local countdown for the entry that was just written.
+// Must be called with `mu` held.
+func (s *inMemStore) trackExpiry(e *KVEntry) {
+	if e.TTLMs == 0 {
+		delete(s.expiry, e.Key)
+		return
+	}
+	s.expiry[e.Key] = time.Now().Add(time.Duration(e.TTLMs) * time.Millisecond)
+}
+
+// hasInstance reports whether the given instance is currently registered.
+func (s *inMemStore) hasInstance(service, host string, port uint16) bool {
+	se, has := s.registry()[service]
+	return has && se.hasInstance(host, port)
+}
+
+func (s *inMemStore) execEntryDel(index uint64, value string) interface{} {
 	var req DelRequest
 	if err := json.NewDecoder(bytes.NewReader([]byte(value))).Decode(&req); err != nil {
-		s.logger.Printf("Failed to execute entry delete request for %s: %s", value, err)
+		s.logger.Error("Failed to execute entry delete request", "value", value, "error", err)
 		return err
 	}
 
@@ -242,21 +606,38 @@ func (s *inMemStore) execEntryDel(value string) interface{} {
 	defer s.ms.Unlock()
 
 	newEntries := make([]*InstanceEntry, 0)
-	se, has := s.services[req.Name]
+	se, has := s.registry()[req.Name]
 	if !has {
-		s.logger.Printf("Trying to remove an already removed instance entry '%s:%d'", req.Instance.Host, req.Instance.Port)
+		s.logger.Debug("Trying to remove an already removed instance entry", "service", req.Name, "host", req.Instance.Host, "port", req.Instance.Port)
 		return nil
 	}
 	// Remove any entry for the given service that has the same host:port
 	// configuration by not including it in the newEntries list.
 	for _, v := range se.Instances {
 		if v.Host == req.Instance.Host && v.Port == req.Instance.Port {
-			s.logger.Printf("Found an instance to remove from the registery")
+			s.logger.Info("Removing instance from the registry", "service", req.Name, "host", v.Host, "port", v.Port)
 		} else {
 			newEntries = append(newEntries, v)
 		}
 	}
-	se.Instances = newEntries
+	if len(newEntries) == len(se.Instances) {
+		return nil
+	}
+	updated := &ServiceEntry{
+		Name:         se.Name,
+		Instances:    newEntries,
+		Persistent:   se.Persistent,
+		EmptySinceMs: se.EmptySinceMs,
+	}
+	if len(newEntries) == 0 {
+		updated.EmptySinceMs = uint64(time.Now().UnixNano()) / uint64(1e6)
+	}
+	s.publishService(req.Name, updated)
+	s.forgetLease(req.Name, req.Instance.Host, req.Instance.Port)
+	s.recordEvent(ServiceEvent{Index: index, Type: EventInstanceRemoved, Service: req.Name, Host: req.Instance.Host, Port: req.Instance.Port})
+
+	// Sessions bound to the instance die with it, releasing their locks.
+	s.invalidateInstanceSessions(index, req.Name, req.Instance.Host, req.Instance.Port)
 	return nil
 }
 
@@ -264,30 +645,155 @@ func (s *inMemStore) Snapshot() (raft.FSMSnapshot, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	cp := make(map[string]string)
+	cp := make(map[string]*KVEntry)
 	for k, v := range s.m {
 		cp[k] = v
 	}
-	return &storeSnapshot{store: cp}, nil
+	sessions := make(map[string]*Session)
+	for k, v := range s.sessions {
+		sessions[k] = v
+	}
+	s.ma.Lock()
+	defer s.ma.Unlock()
+	tokens := make(map[string]*ACLToken)
+	for k, v := range s.acl {
+		tokens[k] = v
+	}
+	members := make(map[string]Member)
+	for k, v := range s.members {
+		members[k] = v
+	}
+	// The registry is immutable, it can be persisted without being copied.
+	return &storeSnapshot{state: snapshotState{
+		Version:         snapshotVersion,
+		KV:              cp,
+		Sessions:        sessions,
+		Services:        s.registry(),
+		ACLTokens:       tokens,
+		ACLBootstrapped: s.aclBootstrapped,
+		Members:         members,
+	}}, nil
 }
 
 func (s *inMemStore) Restore(rc io.ReadCloser) error {
-	m := make(map[string]string)
-	if err := json.NewDecoder(rc).Decode(&m); err != nil {
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
 		return err
 	}
+	state, err := decodeSnapshot(data)
+	if err != nil {
+		return err
+	}
+
+	s.ms.Lock()
+	if state.Services == nil {
+		state.Services = registry{}
+	}
+	s.services.Store(state.Services)
+	s.resetEvents()
+	s.ms.Unlock()
+	s.ma.Lock()
+	s.acl = state.ACLTokens
+	if s.acl == nil {
+		s.acl = make(map[string]*ACLToken)
+	}
+	s.aclBootstrapped = state.ACLBootstrapped
+	s.members = state.Members
+	if s.members == nil {
+		s.members = make(map[string]Member)
+	}
+	s.ma.Unlock()
 
+	m := state.KV
+	if m == nil {
+		m = make(map[string]*KVEntry)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.m = m
+	// The time spent since the keys were written is not known, so they get
+	// their full TTL again.
+	s.expiry = make(map[string]time.Time)
+	for _, e := range m {
+		s.trackExpiry(e)
+	}
+	s.sessions = state.Sessions
+	if s.sessions == nil {
+		s.sessions = make(map[string]*Session)
+	}
+	s.sessionExpiry = make(map[string]time.Time)
+	for _, sess := range s.sessions {
+		s.trackSessionExpiry(sess)
+	}
+	s.resetChanges()
 	return nil
 }
 
+// snapshotVersion is the version of the layout of `snapshotState`, it must be
+// bumped whenever the layout changes in a way the previous code can't read.
+const snapshotVersion = 1
+
+// snapshotState is the part of the store's state persisted in snapshots.
+type snapshotState struct {
+	Version int `json:"version"`
+
+	KV       map[string]*KVEntry `json:"kv"`
+	Sessions map[string]*Session `json:"sessions"`
+	Services registry            `json:"services"`
+
+	ACLTokens       map[string]*ACLToken `json:"acl_tokens,omitempty"`
+	ACLBootstrapped bool                 `json:"acl_bootstrapped,omitempty"`
+	Members         map[string]Member    `json:"members,omitempty"`
+}
+
+// decodeSnapshot reads the state persisted by any version of the store. The
+// snapshots taken before the layout was versioned are either the same layout
+// without a version, or a flat map of the keys to their values, from before
+// the keys had indexes and anything else was persisted.
+func decodeSnapshot(data []byte) (snapshotState, error) {
+	var state snapshotState
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return state, err
+	}
+	flat := true
+	for _, v := range fields {
+		if len(v) == 0 || v[0] != '"' {
+			flat = false
+			break
+		}
+	}
+	if !flat {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return state, err
+		}
+		if state.Version > snapshotVersion {
+			return state, fmt.Errorf("Unsupported snapshot version %d, this node reads up to version %d", state.Version, snapshotVersion)
+		}
+		return state, nil
+	}
+
+	var values map[string]string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return state, err
+	}
+	// The keys get the index `1`, so that check-and-set operations can tell
+	// them apart from absent keys.
+	state.KV = make(map[string]*KVEntry, len(values))
+	for k, v := range values {
+		state.KV[k] = &KVEntry{Key: k, Value: v, CreateIndex: 1, ModifyIndex: 1}
+	}
+	return state, nil
+}
+
 type storeSnapshot struct {
-	store map[string]string
+	state snapshotState
 }
 
 func (f *storeSnapshot) Persist(sink raft.SnapshotSink) error {
 	perFn := func() error {
-		bytes, err := json.Marshal(f.store)
+		bytes, err := json.Marshal(f.state)
 		if err != nil {
 			return err
 		}
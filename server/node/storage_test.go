@@ -0,0 +1,341 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// newTestStore returns a store whose node is not part of a cluster, the
+// commands are fed to the state machine with a `testApplier`.
+func newTestStore() *inMemStore {
+	s := NewInMemStore()
+	s.Node = NewNode("test", "", "127.0.0.1:0", s)
+	return s
+}
+
+// newTestNode returns a store whose node runs Raft over an in-memory
+// transport. With `leader` set, the node bootstraps a single node cluster and
+// is its leader, otherwise it's a follower that doesn't know any leader.
+func newTestNode(t *testing.T, leader bool) *inMemStore {
+	t.Helper()
+	s := newTestStore()
+	addr, _ := startTestRaft(t, s)
+	if !leader {
+		return s
+	}
+
+	servers := []raft.Server{{ID: raft.ServerID(s.Node.id), Address: addr}}
+	if err := s.Node.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+		t.Fatalf("Could not bootstrap the cluster: %s", err)
+	}
+	waitForLeader(t, s)
+	return s
+}
+
+// newTestCluster returns the stores of a cluster of `size` voters connected by
+// in-memory transports, the leader first. The members are recorded with the
+// `<id>:9999` Raft and `<id>:9000` HTTP addresses.
+func newTestCluster(t *testing.T, size int) []*inMemStore {
+	t.Helper()
+	nodes := make([]*inMemStore, size)
+	transports := make([]*raft.InmemTransport, size)
+	servers := make([]raft.Server, size)
+	for i := range nodes {
+		s := NewInMemStore()
+		id := fmt.Sprintf("node-%d", i+1)
+		s.Node = NewNode(id, "", id+":9999", s)
+		s.Node.HttpAddr = id + ":9000"
+		addr, transport := startTestRaft(t, s)
+		nodes[i], transports[i] = s, transport
+		servers[i] = raft.Server{ID: raft.ServerID(s.Node.id), Address: addr}
+	}
+	for i, a := range transports {
+		for j, b := range transports {
+			if i != j {
+				a.Connect(b.LocalAddr(), b)
+			}
+		}
+	}
+	for _, s := range nodes {
+		if err := s.Node.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+			t.Fatalf("Could not bootstrap the cluster: %s", err)
+		}
+	}
+
+	leader := waitForLeader(t, nodes...)
+	for i, s := range nodes {
+		if s == leader {
+			nodes[0], nodes[i] = nodes[i], nodes[0]
+		}
+	}
+	for _, srv := range servers {
+		m := Member{ID: string(srv.ID), RaftAddr: string(srv.Address), HttpAddr: string(srv.ID) + ":9000"}
+		if err := leader.SetMember(m); err != nil {
+			t.Fatalf("Could not record the member %s: %s", m.ID, err)
+		}
+	}
+	for _, s := range nodes {
+		for deadline := time.Now().Add(5 * time.Second); len(s.GetMembers()) != size; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("The members were not replicated to %s", s.Node.id)
+			}
+		}
+	}
+	return nodes
+}
+
+// startTestRaft starts the Raft node of the store over an in-memory transport
+// at the node's Raft address, shut down at the end of the test.
+func startTestRaft(t *testing.T, s *inMemStore) (raft.ServerAddress, *raft.InmemTransport) {
+	t.Helper()
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(s.Node.id)
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	conf.Logger = ComponentLogger("raft")
+
+	addr, transport := raft.NewInmemTransport(raft.ServerAddress(s.Node.raftAddr))
+	rft, err := raft.NewRaft(conf, s, raft.NewInmemStore(), raft.NewInmemStore(), raft.NewInmemSnapshotStore(), transport)
+	if err != nil {
+		t.Fatalf("Could not create the Raft node: %s", err)
+	}
+	t.Cleanup(func() { rft.Shutdown() })
+	s.Node.raft = rft
+	go s.Node.observeLeadership()
+	return addr, transport
+}
+
+// waitForLeader waits for one of the nodes to be the leader, and to have
+// observed it, and returns it.
+func waitForLeader(t *testing.T, nodes ...*inMemStore) *inMemStore {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, s := range nodes {
+			if !s.Node.LeaderSince().IsZero() {
+				return s
+			}
+		}
+	}
+	t.Fatalf("No node became the leader")
+	return nil
+}
+
+// testApplier applies commands to the store the way Raft does, one at a time
+// and with increasing log indexes.
+type testApplier struct {
+	t     *testing.T
+	s     *inMemStore
+	index uint64
+}
+
+func (a *testApplier) apply(cmd Command) interface{} {
+	a.t.Helper()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		a.t.Fatalf("Could not encode the %s command: %s", cmd.Type, err)
+	}
+	a.index++
+	return a.s.Apply(&raft.Log{Index: a.index, Data: data})
+}
+
+// encode returns the JSON value of a command.
+func encode(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Could not encode %v: %s", v, err)
+	}
+	return string(b)
+}
+
+func TestRegistryConcurrentAccess(t *testing.T) {
+	s := newTestStore()
+	a := &testApplier{t: t, s: s}
+
+	// The cleaner of a node that is not the leader only reads the registry.
+	cleaner := NewCleaner(time.Millisecond, time.Minute, 0, s.Node)
+	stopped := make(chan struct{})
+	go func() {
+		cleaner.Start()
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		cleaner.Stop()
+		<-stopped
+	})
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	readers := []func(){
+		func() {
+			// A published registry never changes, even while new ones are
+			// published.
+			reg := s.GetResources()
+			counts := make(map[string]int, len(reg))
+			for name, se := range reg {
+				counts[name] = len(se.Instances)
+				for _, inst := range se.Instances {
+					_ = inst.Host
+					_ = inst.LastBeatMs
+					_ = len(inst.Tags)
+				}
+			}
+			for name, se := range reg {
+				if len(se.Instances) != counts[name] {
+					t.Errorf("The instances of %s changed from %d to %d in a published registry", name, counts[name], len(se.Instances))
+				}
+			}
+		},
+		func() {
+			for _, svc := range s.GetServices().Services {
+				for _, inst := range svc.Instances {
+					_ = inst.Meta["version"]
+				}
+			}
+		},
+		func() {
+			s.ServiceEvents(0)
+			s.hasInstance("svc-0", "10.0.0.1", 8000)
+		},
+	}
+	for _, read := range readers {
+		wg.Add(1)
+		go func(read func()) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					read()
+				}
+			}
+		}(read)
+	}
+
+	const rounds = 200
+	for i := 0; i < rounds; i++ {
+		svc := fmt.Sprintf("svc-%d", i%5)
+		reg := InstanceRegistration{ServiceName: svc, Host: "10.0.0.1", Port: uint16(8000 + i%3), Meta: map[string]string{"version": fmt.Sprint(i)}}
+		a.apply(Command{Type: "REG", Value: encode(t, reg)})
+		batch := []InstanceRegistration{
+			{ServiceName: svc, Host: "10.0.0.2", Port: 8000, Tags: []string{"primary"}},
+			{ServiceName: fmt.Sprintf("svc-%d", (i+1)%5), Host: "10.0.0.3", Port: uint16(8000 + i%2)},
+		}
+		a.apply(Command{Type: "BREG", Value: encode(t, batch)})
+		if i%2 == 1 {
+			for _, inst := range []InstanceEntry{{Host: "10.0.0.1", Port: reg.Port}, {Host: "10.0.0.2", Port: 8000}, {Host: "10.0.0.3", Port: 8000}, {Host: "10.0.0.3", Port: 8001}} {
+				a.apply(Command{Type: "ENDEL", Value: encode(t, DelRequest{Name: svc, Instance: inst})})
+			}
+			a.apply(Command{Type: "SVCDEL", Key: svc})
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	// Every instance left gets removed, and so do the services.
+	for name, se := range s.GetResources() {
+		for _, inst := range se.Instances {
+			a.apply(Command{Type: "ENDEL", Value: encode(t, DelRequest{Name: name, Instance: *inst})})
+		}
+		a.apply(Command{Type: "SVCDEL", Key: name})
+	}
+	if reg := s.GetResources(); len(reg) != 0 {
+		t.Errorf("Expected an empty registry, got %d services", len(reg))
+	}
+}
+
+func TestExpireKeys(t *testing.T) {
+	s := newTestNode(t, true)
+	if err := s.PutTTL("a", "1", 20*time.Millisecond); err != nil {
+		t.Fatalf("Could not put the key: %s", err)
+	}
+	if err := s.PutTTL("b", "1", 0); err != nil {
+		t.Fatalf("Could not put the key: %s", err)
+	}
+
+	c := NewCleaner(time.Second, time.Minute, 0, s.Node)
+	c.expireKeys()
+	if _, has := s.GetEntry("a"); !has {
+		t.Fatalf("Expected the key to be kept until its TTL elapsed")
+	}
+	time.Sleep(30 * time.Millisecond)
+	c.expireKeys()
+	if _, has := s.GetEntry("a"); has {
+		t.Errorf("Expected the key to be expired")
+	}
+	if _, has := s.GetEntry("b"); !has {
+		t.Errorf("Expected the key without a TTL to be kept")
+	}
+}
+
+// testSink keeps a snapshot in memory.
+type testSink struct {
+	bytes.Buffer
+}
+
+func (s *testSink) ID() string    { return "test" }
+func (s *testSink) Cancel() error { return nil }
+func (s *testSink) Close() error  { return nil }
+
+func TestRestoreSnapshot(t *testing.T) {
+	s := newTestStore()
+	a := &testApplier{t: t, s: s}
+	a.apply(Command{Type: "PUT", Key: "a", Value: "1"})
+	a.apply(Command{Type: "REG", Value: encode(t, InstanceRegistration{ServiceName: "web", Host: "10.0.0.1", Port: 80})})
+	snap, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("Could not snapshot the store: %s", err)
+	}
+	var current testSink
+	if err := snap.Persist(&current); err != nil {
+		t.Fatalf("Could not persist the snapshot: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		data     string
+		kv       map[string]string
+		index    uint64
+		services int
+		fails    bool
+	}{
+		{name: "current", data: current.String(), kv: map[string]string{"a": "1"}, index: 1, services: 1},
+		{name: "unversioned", data: `{"kv":{"a":{"key":"a","value":"1","create_index":3,"modify_index":5}},"sessions":{},"services":{}}`, kv: map[string]string{"a": "1"}, index: 5},
+		{name: "flat", data: `{"a":"1","kv":"2"}`, kv: map[string]string{"a": "1", "kv": "2"}, index: 1},
+		{name: "empty flat", data: `{}`, kv: map[string]string{}},
+		{name: "newer version", data: `{"version":99,"kv":{}}`, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestStore()
+			err := r.Restore(ioutil.NopCloser(strings.NewReader(tt.data)))
+			if tt.fails {
+				if err == nil {
+					t.Errorf("Expected the snapshot to be refused")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Could not restore the snapshot: %s", err)
+			}
+			expectKV(t, r, tt.kv)
+			if r.kvIndex != tt.index {
+				t.Errorf("Expected the index to be %d, got %d", tt.index, r.kvIndex)
+			}
+			if n := len(r.GetResources()); n != tt.services {
+				t.Errorf("Expected %d services, got %d", tt.services, n)
+			}
+		})
+	}
+}
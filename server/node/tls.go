@@ -0,0 +1,238 @@
+package node
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// TLSConfig points to the PEM files of a node's certificate, its private key,
+// and the CA that signed the certificates of the clients and peers.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// VerifyClients requires the clients of the HTTP API to present a
+	// certificate signed by the CA. The peers of the Raft stream layer always
+	// have to.
+	VerifyClients bool
+}
+
+// Certificates holds the certificate and CA loaded from a `TLSConfig`, the
+// TLS configurations it hands out pick up the files read by the last `Reload`
+// for every new connection, so the certificates can be rotated without a
+// restart.
+type Certificates struct {
+	config TLSConfig
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+
+	logger hclog.Logger
+}
+
+// NewCertificates loads the files of the configuration.
+func NewCertificates(config TLSConfig) (*Certificates, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, fmt.Errorf("A certificate and a private key are needed to enable TLS")
+	}
+	c := &Certificates{config: config, logger: ComponentLogger("tls")}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the certificate, private key and CA files again, the current
+// ones are kept if any of them is invalid.
+func (c *Certificates) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.config.CertFile, c.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Could not load the key pair '%s': %s", c.config.CertFile, err)
+	}
+	var pool *x509.CertPool
+	if c.config.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.config.CAFile)
+		if err != nil {
+			return fmt.Errorf("Could not read the CA file '%s': %s", c.config.CAFile, err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificate found in the CA file '%s'", c.config.CAFile)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.pool = pool
+	return nil
+}
+
+// ReloadOnSignal reads the certificates again whenever the process receives
+// the signal (e.g. SIGHUP), the new ones are used by the connections opened
+// afterwards. The returned function stops watching for the signal.
+func (c *Certificates) ReloadOnSignal(sig os.Signal) func() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ch:
+			}
+			if err := c.Reload(); err != nil {
+				c.logger.Error("Could not reload the TLS certificates, keeping the current ones", "error", err)
+				continue
+			}
+			c.logger.Info("Reloaded the TLS certificates")
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
+
+func (c *Certificates) current() (*tls.Certificate, *x509.CertPool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, c.pool
+}
+
+// ServerTLS returns the configuration of the HTTP and gRPC listeners, offering
+// the given application protocols (e.g. `h2` for gRPC).
+func (c *Certificates) ServerTLS(protos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: protos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := c.current()
+			conf := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   protos,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if c.config.VerifyClients {
+				conf.ClientAuth = tls.RequireAndVerifyClientCert
+				conf.ClientCAs = pool
+			}
+			return conf, nil
+		},
+	}
+}
+
+// ClientTLS returns the configuration used to call the HTTP API of another
+// node, it presents the node's certificate and trusts the CA loaded at the time
+// of the call (or the system's roots if there's none).
+func (c *Certificates) ClientTLS() *tls.Config {
+	_, pool := c.current()
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    pool,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := c.current()
+			return cert, nil
+		},
+	}
+}
+
+// peerTLS returns the configuration of both ends of the Raft connections. The
+// peers are addressed by their Raft address, which doesn't have to be part of
+// their certificate, they are authenticated by having a certificate signed by
+// the cluster's CA instead.
+func (c *Certificates) peerTLS(server bool) *tls.Config {
+	cert, _ := c.current()
+	conf := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*cert},
+		// The chain is checked by verifyPeer against the CA, without the host
+		// name.
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: c.verifyPeer,
+	}
+	if server {
+		conf.ClientAuth = tls.RequireAnyClientCert
+	}
+	return conf
+}
+
+func (c *Certificates) verifyPeer(raw [][]byte, _ [][]*x509.Certificate) error {
+	_, pool := c.current()
+	if len(raw) == 0 {
+		return fmt.Errorf("The peer didn't present a certificate")
+	}
+	certs := make([]*x509.Certificate, 0, len(raw))
+	for _, b := range raw {
+		cert, err := x509.ParseCertificate(b)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// tlsStreamLayer is a `raft.StreamLayer` encrypting the Raft connections with
+// mutual TLS.
+type tlsStreamLayer struct {
+	listener  net.Listener
+	advertise net.Addr
+	certs     *Certificates
+}
+
+func newTLSStreamLayer(bind string, advertise net.Addr, certs *Certificates) (*tlsStreamLayer, error) {
+	if _, pool := certs.current(); pool == nil {
+		return nil, fmt.Errorf("A CA is needed to authenticate the Raft peers")
+	}
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+	if advertise == nil {
+		advertise = listener.Addr()
+	}
+	return &tlsStreamLayer{listener: listener, advertise: advertise, certs: certs}, nil
+}
+
+func (l *tlsStreamLayer) Accept() (net.Conn, error) {
+	conn, err := l.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(conn, l.certs.peerTLS(true)), nil
+}
+
+func (l *tlsStreamLayer) Close() error {
+	return l.listener.Close()
+}
+
+func (l *tlsStreamLayer) Addr() net.Addr {
+	return l.advertise
+}
+
+func (l *tlsStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, "tcp", string(address), l.certs.peerTLS(false))
+}
@@ -0,0 +1,242 @@
+package node
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// testCA signs the certificates of a test.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate the CA key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create the CA: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of a node signed by the CA.
+func (ca *testCA) issue(t *testing.T, name string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate the key: %s", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Could not create the certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Could not encode the key: %s", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// writeCerts writes the certificate of a node signed by the CA, its key and
+// the CA to the directory, and returns the configuration pointing to them.
+func writeCerts(t *testing.T, dir, name string, ca *testCA) TLSConfig {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, name)
+	config := TLSConfig{
+		CertFile: filepath.Join(dir, name+".pem"),
+		KeyFile:  filepath.Join(dir, name+"-key.pem"),
+		CAFile:   filepath.Join(dir, name+"-ca.pem"),
+	}
+	for path, content := range map[string][]byte{config.CertFile: certPEM, config.KeyFile: keyPEM, config.CAFile: ca.pem} {
+		if err := ioutil.WriteFile(path, content, 0600); err != nil {
+			t.Fatalf("Could not write %s: %s", path, err)
+		}
+	}
+	return config
+}
+
+func testCertsDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "heartbeat-tls")
+	if err != nil {
+		t.Fatalf("Could not create the certificates directory: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func newTestCertificates(t *testing.T, config TLSConfig) *Certificates {
+	t.Helper()
+	certs, err := NewCertificates(config)
+	if err != nil {
+		t.Fatalf("Could not load the certificates: %s", err)
+	}
+	return certs
+}
+
+// peerHandshake connects a Raft peer using the client certificates to a
+// stream layer using the server ones, and returns the errors of both ends.
+func peerHandshake(t *testing.T, server, client *Certificates) (error, error) {
+	t.Helper()
+	layer, err := newTLSStreamLayer("127.0.0.1:0", nil, server)
+	if err != nil {
+		t.Fatalf("Could not create the stream layer: %s", err)
+	}
+	defer layer.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := layer.Accept()
+		if err == nil {
+			err = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+		accepted <- err
+	}()
+
+	dialer := &tlsStreamLayer{certs: client}
+	conn, err := dialer.Dial(raft.ServerAddress(layer.Addr().String()), time.Second)
+	if err == nil {
+		conn.Close()
+	}
+	return <-accepted, err
+}
+
+func TestVerifyPeer(t *testing.T) {
+	dir := testCertsDir(t)
+	ca, foreign := newTestCA(t, "cluster"), newTestCA(t, "foreign")
+	node1 := newTestCertificates(t, writeCerts(t, dir, "node-1", ca))
+	node2 := newTestCertificates(t, writeCerts(t, dir, "node-2", ca))
+	intruder := newTestCertificates(t, writeCerts(t, dir, "intruder", foreign))
+
+	certPEM, _ := ca.issue(t, "node-3")
+	block, _ := pem.Decode(certPEM)
+	foreignPEM, _ := foreign.issue(t, "node-3")
+	foreignBlock, _ := pem.Decode(foreignPEM)
+	tests := []struct {
+		name  string
+		raw   [][]byte
+		valid bool
+	}{
+		{"signed by the CA", [][]byte{block.Bytes}, true},
+		{"signed by a foreign CA", [][]byte{foreignBlock.Bytes}, false},
+		{"no certificate", nil, false},
+		{"not a certificate", [][]byte{[]byte("garbage")}, false},
+	}
+	for _, tt := range tests {
+		err := node1.verifyPeer(tt.raw, nil)
+		if tt.valid && err != nil {
+			t.Errorf("%s: expected the peer to be accepted, got %s", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: expected the peer to be rejected", tt.name)
+		}
+	}
+
+	// The host name isn't checked, only the chain: both ends refuse a peer
+	// whose certificate was signed by another CA.
+	if serr, cerr := peerHandshake(t, node1, node2); serr != nil || cerr != nil {
+		t.Errorf("Expected the peers of the cluster to connect, got %v and %v", serr, cerr)
+	}
+	if serr, _ := peerHandshake(t, node1, intruder); serr == nil {
+		t.Errorf("Expected the node to refuse a peer with a foreign certificate")
+	}
+	if _, cerr := peerHandshake(t, intruder, node1); cerr == nil {
+		t.Errorf("Expected the node to refuse to talk to a peer with a foreign certificate")
+	}
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	dir := testCertsDir(t)
+	old, rotated := newTestCA(t, "old"), newTestCA(t, "rotated")
+	config := writeCerts(t, dir, "node-1", old)
+	certs := newTestCertificates(t, config)
+	stop := certs.ReloadOnSignal(syscall.SIGHUP)
+	defer stop()
+
+	// A client of the rotated CA doesn't trust the current certificate.
+	peer := newTestCertificates(t, writeCerts(t, dir, "node-2", rotated))
+	if _, cerr := peerHandshake(t, certs, peer); cerr == nil {
+		t.Fatalf("Expected the certificate of the old CA to be refused")
+	}
+
+	// Rotate the files in place, then ask the process to reload them.
+	rotatedConfig := writeCerts(t, dir, "rotated", rotated)
+	for _, f := range [][2]string{{rotatedConfig.CertFile, config.CertFile}, {rotatedConfig.KeyFile, config.KeyFile}, {rotatedConfig.CAFile, config.CAFile}} {
+		if err := os.Rename(f[0], f[1]); err != nil {
+			t.Fatalf("Could not rotate %s: %s", f[1], err)
+		}
+	}
+	before, _ := certs.current()
+	p, err := os.FindProcess(os.Getpid())
+	if err == nil {
+		err = p.Signal(syscall.SIGHUP)
+	}
+	if err != nil {
+		t.Fatalf("Could not send SIGHUP: %s", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if cert, _ := certs.current(); cert != before {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The certificates were not reloaded")
+		}
+	}
+	if serr, cerr := peerHandshake(t, certs, peer); serr != nil || cerr != nil {
+		t.Errorf("Expected the rotated certificate to be accepted, got %v and %v", serr, cerr)
+	}
+
+	// Invalid files are refused, the current certificates are kept.
+	if err := ioutil.WriteFile(config.CertFile, []byte("garbage"), 0600); err != nil {
+		t.Fatalf("Could not write the certificate: %s", err)
+	}
+	if err := certs.Reload(); err == nil {
+		t.Errorf("Expected an invalid certificate to be refused")
+	}
+	if serr, cerr := peerHandshake(t, certs, peer); serr != nil || cerr != nil {
+		t.Errorf("Expected the rotated certificate to be kept, got %v and %v", serr, cerr)
+	}
+}
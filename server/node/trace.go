@@ -0,0 +1,353 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Tracer records the spans of the write paths, it's a no-op until replaced by
+// one created with `NewTracer`.
+var Tracer = NewTracer(nil, 0)
+
+// TraceExportInterval is how often the buffered spans are handed to the
+// exporter, and MaxQueuedSpans bounds the spans buffered in the meantime, the
+// ones that don't fit are dropped.
+var (
+	TraceExportInterval = 5 * time.Second
+	MaxQueuedSpans      = 2048
+)
+
+// SpanExporter sends finished spans to a tracing backend.
+type SpanExporter interface {
+	Export([]*Span) error
+}
+
+// Span is a timed operation of a trace, identified as in the W3C trace
+// context.
+type Span struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_id,omitempty"`
+	Name       string                 `json:"name"`
+	Server     bool                   `json:"server,omitempty"`
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+
+	tracer *tracer
+}
+
+type spanKey struct{}
+
+// remoteParent is a span context received from another process.
+type remoteParent struct {
+	traceID string
+	spanID  string
+	sampled bool
+}
+
+type tracer struct {
+	exporter SpanExporter
+	sample   float64
+
+	mu     sync.Mutex
+	queue  []*Span
+	logger hclog.Logger
+}
+
+// NewTracer creates a tracer exporting its spans with the exporter. Traces
+// started by this node are sampled with the given probability, the ones
+// continuing a trace follow the sampling decision of the caller.
+func NewTracer(exporter SpanExporter, sample float64) *tracer {
+	t := &tracer{
+		exporter: exporter,
+		sample:   sample,
+		logger:   ComponentLogger("tracer"),
+	}
+	if exporter != nil {
+		go t.loop()
+	}
+	return t
+}
+
+// Start starts a span as a child of the span in the context, or of the remote
+// parent attached with `ContextWithTraceParent`, or as the root of a new trace.
+// The returned span is nil if the trace isn't sampled, its methods can still be
+// called.
+func (t *tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t.exporter == nil {
+		return ctx, nil
+	}
+	span := &Span{Name: name, Start: time.Now(), SpanID: randomHex(8), tracer: t}
+	switch parent := ctx.Value(spanKey{}).(type) {
+	case *Span:
+		span.TraceID, span.ParentID = parent.TraceID, parent.SpanID
+	case remoteParent:
+		if !parent.sampled {
+			return ctx, nil
+		}
+		span.TraceID, span.ParentID, span.Server = parent.traceID, parent.spanID, true
+	default:
+		if !sampled(t.sample) {
+			return ctx, nil
+		}
+		span.TraceID = randomHex(16)
+		span.Server = true
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// ContextWithTraceParent attaches the span context of a W3C `traceparent`
+// header to the context, spans started from it continue the caller's trace.
+func ContextWithTraceParent(ctx context.Context, traceparent string) context.Context {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx
+	}
+	if !isHex(parts[1]) || !isHex(parts[2]) || parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return ctx
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, remoteParent{
+		traceID: parts[1],
+		spanID:  parts[2],
+		sampled: flags&1 == 1,
+	})
+}
+
+// TraceParent returns the W3C `traceparent` of the span, to propagate it to
+// another process, or an empty string for an unsampled span.
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID)
+}
+
+// SetAttribute records a key/value pair describing the operation.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]interface{})
+	}
+	s.Attributes[key] = value
+}
+
+// Finish ends the span, marking it as failed if `err` isn't nil, and queues it
+// for the exporter.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	s.tracer.enqueue(s)
+}
+
+func (t *tracer) enqueue(s *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queue) >= MaxQueuedSpans {
+		return
+	}
+	t.queue = append(t.queue, s)
+}
+
+func (t *tracer) loop() {
+	for {
+		time.Sleep(TraceExportInterval)
+		t.mu.Lock()
+		spans := t.queue
+		t.queue = nil
+		t.mu.Unlock()
+		if len(spans) == 0 {
+			continue
+		}
+		if err := t.exporter.Export(spans); err != nil {
+			t.logger.Warn("Could not export spans", "spans", len(spans), "error", err)
+		}
+	}
+}
+
+// fileExporter appends the spans to a file, one JSON object per line.
+type fileExporter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// NewFileExporter creates an exporter appending the spans to the file at path.
+func NewFileExporter(path string) (SpanExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileExporter{out: f}, nil
+}
+
+func (e *fileExporter) Export(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	enc := json.NewEncoder(e.out)
+	for _, s := range spans {
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// otlpExporter sends the spans to an OpenTelemetry collector with OTLP over
+// HTTP, using its JSON encoding.
+type otlpExporter struct {
+	endpoint string
+	resource []otlpAttribute
+	client   *http.Client
+}
+
+// NewOTLPExporter creates an exporter posting the spans to the collector's
+// traces endpoint (e.g. `http://127.0.0.1:4318/v1/traces`).
+func NewOTLPExporter(endpoint, nodeID string) SpanExporter {
+	return &otlpExporter{
+		endpoint: endpoint,
+		resource: []otlpAttribute{
+			otlpAttr("service.name", "heartbeat"),
+			otlpAttr("service.instance.id", nodeID),
+		},
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func (e *otlpExporter) Export(spans []*Span) error {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              1, // internal
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.Server {
+			o.Kind = 2
+		}
+		for k, v := range s.Attributes {
+			o.Attributes = append(o.Attributes, otlpAttr(k, v))
+		}
+		if s.Error != "" {
+			o.Status.Code = 2
+			o.Status.Message = s.Error
+		}
+		out = append(out, o)
+	}
+
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": e.resource},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "heartbeat"},
+				"spans": out,
+			}},
+		}},
+	}
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(body); err != nil {
+		return err
+	}
+	res, err := e.client.Post(e.endpoint, "application/json", &b)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("The collector answered with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func otlpAttr(key string, value interface{}) otlpAttribute {
+	var v map[string]interface{}
+	switch x := value.(type) {
+	case bool:
+		v = map[string]interface{}{"boolValue": x}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(int64(x), 10)}
+	case uint16:
+		v = map[string]interface{}{"intValue": strconv.FormatUint(uint64(x), 10)}
+	case uint64:
+		v = map[string]interface{}{"intValue": strconv.FormatUint(x, 10)}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(x)}
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func sampled(ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	var x uint64
+	for _, c := range b {
+		x = x<<8 | uint64(c)
+	}
+	return float64(x)/math.MaxUint64 < ratio
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
@@ -0,0 +1,230 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestTracer returns a tracer sampling every trace whose spans are only
+// queued, the test reads them with `finished`.
+func newTestTracer() *tracer {
+	return &tracer{exporter: &fileExporter{out: &strings.Builder{}}, sample: 1, logger: ComponentLogger("tracer")}
+}
+
+func (t *tracer) finished() []*Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.queue
+}
+
+func TestContextWithTraceParent(t *testing.T) {
+	const traceID, spanID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	tests := []struct {
+		name        string
+		traceparent string
+		// continued is whether the span continues the trace, sampled whether
+		// it's recorded at all.
+		continued bool
+		sampled   bool
+	}{
+		{"sampled", "00-" + traceID + "-" + spanID + "-01", true, true},
+		{"not sampled", "00-" + traceID + "-" + spanID + "-00", true, false},
+		{"other flags", "00-" + traceID + "-" + spanID + "-03", true, true},
+		{"padded", " 00-" + traceID + "-" + spanID + "-01 ", true, true},
+		{"empty", "", false, true},
+		{"unknown version", "01-" + traceID + "-" + spanID + "-01", false, true},
+		{"short trace id", "00-" + traceID[1:] + "-" + spanID + "-01", false, true},
+		{"short span id", "00-" + traceID + "-" + spanID[1:] + "-01", false, true},
+		{"upper case", "00-" + strings.ToUpper(traceID) + "-" + spanID + "-01", false, true},
+		{"zero trace id", "00-" + strings.Repeat("0", 32) + "-" + spanID + "-01", false, true},
+		{"zero span id", "00-" + traceID + "-" + strings.Repeat("0", 16) + "-01", false, true},
+		{"bad flags", "00-" + traceID + "-" + spanID + "-zz", false, true},
+		{"extra part", "00-" + traceID + "-" + spanID + "-01-01", false, true},
+	}
+	tr := newTestTracer()
+	for _, tt := range tests {
+		_, span := tr.Start(ContextWithTraceParent(context.Background(), tt.traceparent), "test")
+		if !tt.sampled {
+			if span != nil {
+				t.Errorf("%s: expected the span not to be recorded", tt.name)
+			}
+			continue
+		}
+		if span == nil {
+			t.Errorf("%s: expected the span to be recorded", tt.name)
+			continue
+		}
+		continued := span.TraceID == traceID && span.ParentID == spanID
+		if continued != tt.continued {
+			t.Errorf("%s: expected the trace to be continued: %v, got %+v", tt.name, tt.continued, span)
+		}
+		if !continued && (len(span.TraceID) != 32 || span.ParentID != "") {
+			t.Errorf("%s: expected a new trace, got %+v", tt.name, span)
+		}
+		if !span.Server {
+			t.Errorf("%s: expected the first span of the node to be a server span", tt.name)
+		}
+	}
+}
+
+func TestSpanParents(t *testing.T) {
+	tr := newTestTracer()
+	ctx, root := tr.Start(context.Background(), "root")
+	_, child := tr.Start(ctx, "child")
+	child.SetAttribute("port", uint16(80))
+	child.Finish(errors.New("Failed"))
+	root.Finish(nil)
+
+	spans := tr.finished()
+	if len(spans) != 2 || spans[0] != child || spans[1] != root {
+		t.Fatalf("Expected the child then the root to be queued, got %+v", spans)
+	}
+	if child.TraceID != root.TraceID || child.ParentID != root.SpanID || child.Server {
+		t.Errorf("Expected the child of the root, got %+v", child)
+	}
+	if child.Error != "Failed" || child.End.Before(child.Start) {
+		t.Errorf("Expected a failed finished span, got %+v", child)
+	}
+	if tp := child.TraceParent(); tp != "00-"+child.TraceID+"-"+child.SpanID+"-01" {
+		t.Errorf("Unexpected traceparent %s", tp)
+	}
+
+	// Spans past the queue's capacity are dropped.
+	prev := MaxQueuedSpans
+	MaxQueuedSpans = 2
+	defer func() { MaxQueuedSpans = prev }()
+	_, dropped := tr.Start(context.Background(), "dropped")
+	dropped.Finish(nil)
+	if len(tr.finished()) != 2 {
+		t.Errorf("Expected the span to be dropped")
+	}
+
+	// A disabled tracer records nothing, the nil spans can still be used.
+	_, span := NewTracer(nil, 1).Start(context.Background(), "disabled")
+	span.SetAttribute("k", "v")
+	span.Finish(nil)
+	if span != nil || span.TraceParent() != "" {
+		t.Errorf("Expected a disabled tracer not to record spans")
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	tr := newTestTracer()
+	ctx, root := tr.Start(context.Background(), "root")
+	_, child := tr.Start(ctx, "child")
+	child.Finish(nil)
+	root.Finish(nil)
+
+	var out strings.Builder
+	if err := (&fileExporter{out: &out}).Export(tr.finished()); err != nil {
+		t.Fatalf("Could not export the spans: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected a line per span, got %q", out.String())
+	}
+	var exported Span
+	if err := json.Unmarshal([]byte(lines[0]), &exported); err != nil {
+		t.Fatalf("Could not parse the exported span: %s", err)
+	}
+	if exported.Name != "child" || exported.ParentID != root.SpanID || exported.TraceID != root.TraceID {
+		t.Errorf("Unexpected exported span %+v", exported)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttribute `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/traces" || req.Header.Get("Content-Type") != "application/json" {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			res.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	tr := newTestTracer()
+	ctx, root := tr.Start(context.Background(), "http.heartbeat")
+	root.SetAttribute("port", uint16(80))
+	_, child := tr.Start(ctx, "raft.Apply")
+	child.Finish(errors.New("Failed"))
+	root.Finish(nil)
+	if err := NewOTLPExporter(srv.URL+"/v1/traces", "node-1").Export(tr.finished()); err != nil {
+		t.Fatalf("Could not export the spans: %s", err)
+	}
+
+	if len(body.ResourceSpans) != 1 || len(body.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("Unexpected export %+v", body)
+	}
+	if attrs := body.ResourceSpans[0].Resource.Attributes; len(attrs) != 2 || attrs[1].Value["stringValue"] != "node-1" {
+		t.Errorf("Expected the node in the resource, got %+v", attrs)
+	}
+	spans := body.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %+v", spans)
+	}
+	c, r := spans[0], spans[1]
+	if c.ParentSpanID != r.SpanID || c.TraceID != r.TraceID || c.Kind != 1 || c.Status.Code != 2 || c.Status.Message != "Failed" {
+		t.Errorf("Unexpected child span %+v", c)
+	}
+	if r.Kind != 2 || r.Status.Code != 0 || len(r.Attributes) != 1 || r.Attributes[0].Value["intValue"] != "80" {
+		t.Errorf("Unexpected root span %+v", r)
+	}
+
+	if err := NewOTLPExporter(srv.URL+"/other", "node-1").Export(tr.finished()); err == nil {
+		t.Errorf("Expected the export to fail when the collector refuses it")
+	}
+}
+
+func TestHeartbeatRedirectSpan(t *testing.T) {
+	tr := newTestTracer()
+	prev := Tracer
+	Tracer = tr
+	t.Cleanup(func() { Tracer = prev })
+	nodes := newTestCluster(t, 2)
+	follower := NewServer("", nodes[1].Node)
+
+	const traceID, spanID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req := httptest.NewRequest(http.MethodPost, "/heartbeat", strings.NewReader(`{"service":"web","host":"10.0.0.1","port":80}`))
+	req.Header.Set("traceparent", "00-"+traceID+"-"+spanID+"-01")
+	res := httptest.NewRecorder()
+	follower.ServeHTTP(res, req)
+	if res.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("Expected the heartbeat to be redirected, got %d: %s", res.Code, res.Body)
+	}
+
+	var heartbeat, redirect *Span
+	for _, s := range tr.finished() {
+		switch s.Name {
+		case "http.heartbeat":
+			heartbeat = s
+		case "http.redirect":
+			redirect = s
+		}
+	}
+	if heartbeat == nil || redirect == nil {
+		t.Fatalf("Expected the heartbeat and redirect spans, got %+v", tr.finished())
+	}
+	if heartbeat.TraceID != traceID || heartbeat.ParentID != spanID {
+		t.Errorf("Expected the heartbeat to continue the caller's trace, got %+v", heartbeat)
+	}
+	if redirect.ParentID != heartbeat.SpanID || redirect.Error != "" || redirect.Attributes["leader"] != nodes[0].Node.HttpAddr {
+		t.Errorf("Expected the redirect to the leader under the heartbeat, got %+v", redirect)
+	}
+}
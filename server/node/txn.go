@@ -0,0 +1,160 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// newKVEntry creates the entry that replaces `prev` (which can be nil) after a
+// write at the given Raft log index.
+func newKVEntry(prev *KVEntry, index uint64, key, value string, ttlMs uint64) *KVEntry {
+	createIndex := index
+	if prev != nil {
+		createIndex = prev.CreateIndex
+	}
+	e := &KVEntry{
+		Key:         key,
+		Value:       value,
+		CreateIndex: createIndex,
+		ModifyIndex: index,
+		TTLMs:       ttlMs,
+	}
+	// Writing to a locked key keeps the lock, only the session holding it or
+	// the session's invalidation can release it.
+	if prev != nil {
+		e.Session = prev.Session
+		e.LockIndex = prev.LockIndex
+	}
+	return e
+}
+
+func (op TxnOp) validate() error {
+	switch op.Verb {
+	case TxnGet, TxnSet, TxnCAS, TxnDelete, TxnCheckIndex:
+		if op.Key == "" {
+			return fmt.Errorf("verb '%s' requires a key", op.Verb)
+		}
+	case TxnDeletePrefix:
+		// An empty prefix is allowed and clears the whole store.
+	default:
+		return fmt.Errorf("unknown verb '%s'", op.Verb)
+	}
+	return nil
+}
+
+// execTxn runs all the operations against an overlay of the keys they touch,
+// and only writes the overlay to the live map if every operation succeeded.
+//
+// Entries are immutable, so the overlay only holds the entries written by the
+// transaction, a nil entry marks a deleted key.
+func (s *inMemStore) execTxn(index uint64, value string) interface{} {
+	var ops []TxnOp
+	if err := json.NewDecoder(bytes.NewReader([]byte(value))).Decode(&ops); err != nil {
+		s.logger.Error("Failed executing a transaction", "value", value, "error", err)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	overlay := make(map[string]*KVEntry)
+	lookup := func(key string) *KVEntry {
+		if e, has := overlay[key]; has {
+			return e
+		}
+		return s.m[key]
+	}
+
+	res := &TxnResponse{
+		Results: make([]*KVEntry, 0, len(ops)),
+	}
+	for i, op := range ops {
+		cur := lookup(op.Key)
+		var out *KVEntry
+		switch op.Verb {
+		case TxnGet:
+			out = cur
+		case TxnSet:
+			out = newKVEntry(cur, index, op.Key, op.Value, op.TTLMs)
+			overlay[op.Key] = out
+		case TxnCAS:
+			if err := checkIndex(cur, op.Index); err != nil {
+				res.Errors = append(res.Errors, TxnError{OpIndex: i, What: err.Error()})
+				continue
+			}
+			out = newKVEntry(cur, index, op.Key, op.Value, op.TTLMs)
+			overlay[op.Key] = out
+		case TxnDelete:
+			overlay[op.Key] = nil
+		case TxnDeletePrefix:
+			for k := range s.m {
+				if strings.HasPrefix(k, op.Key) {
+					overlay[k] = nil
+				}
+			}
+			for k := range overlay {
+				if strings.HasPrefix(k, op.Key) {
+					overlay[k] = nil
+				}
+			}
+		case TxnCheckIndex:
+			if err := checkIndex(cur, op.Index); err != nil {
+				res.Errors = append(res.Errors, TxnError{OpIndex: i, What: err.Error()})
+				continue
+			}
+			out = cur
+		default:
+			res.Errors = append(res.Errors, TxnError{OpIndex: i, What: fmt.Sprintf("unknown verb '%s'", op.Verb)})
+			continue
+		}
+		res.Results = append(res.Results, out)
+	}
+
+	if len(res.Errors) > 0 {
+		s.logger.Info("Rolling back transaction", "index", index, "failed_ops", len(res.Errors))
+		res.Results = nil
+		return res
+	}
+
+	// Keys that are gone must not be expired anymore, deleting a key that
+	// didn't exist is not a change.
+	keys := make([]string, 0, len(overlay))
+	for k := range overlay {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if e := overlay[k]; e != nil {
+			s.m[k] = e
+			s.trackExpiry(e)
+		} else if _, has := s.m[k]; has {
+			delete(s.m, k)
+			delete(s.expiry, k)
+		} else {
+			continue
+		}
+		s.recordChange(index, k)
+	}
+	return res
+}
+
+// checkIndex verifies that the entry was last modified at `index`, an index of
+// `0` requires the entry to be absent.
+func checkIndex(e *KVEntry, index uint64) error {
+	if index == 0 {
+		if e != nil {
+			return fmt.Errorf("key '%s' already exists", e.Key)
+		}
+		return nil
+	}
+	if e == nil {
+		return fmt.Errorf("key does not exist, expected modify index %d", index)
+	}
+	if e.ModifyIndex != index {
+		return fmt.Errorf("key '%s' has modify index %d, expected %d", e.Key, e.ModifyIndex, index)
+	}
+	return nil
+}
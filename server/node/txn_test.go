@@ -0,0 +1,150 @@
+package node
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApplyKV(t *testing.T) {
+	tests := []struct {
+		name  string
+		cmds  func(t *testing.T) []Command
+		check func(t *testing.T, s *inMemStore, last interface{})
+	}{
+		{
+			name: "a failed cas rolls the whole transaction back",
+			cmds: func(t *testing.T) []Command {
+				return []Command{
+					{Type: "PUT", Key: "a", Value: "1"},
+					{Type: "PUT", Key: "b", Value: "1"},
+					{Type: "TXN", Value: encode(t, []TxnOp{
+						{Verb: TxnSet, Key: "c", Value: "2"},
+						{Verb: TxnDelete, Key: "b"},
+						{Verb: TxnDeletePrefix, Key: "a"},
+						{Verb: TxnCAS, Key: "a", Value: "2", Index: 42},
+					})},
+				}
+			},
+			check: func(t *testing.T, s *inMemStore, last interface{}) {
+				res := last.(*TxnResponse)
+				if len(res.Errors) != 1 || res.Errors[0].OpIndex != 3 || res.Results != nil {
+					t.Errorf("Expected the cas at index 3 to fail alone, got %+v", res)
+				}
+				expectKV(t, s, map[string]string{"a": "1", "b": "1"})
+				if s.kvIndex != 2 {
+					t.Errorf("Expected the rolled back transaction not to change the index, got %d", s.kvIndex)
+				}
+			},
+		},
+		{
+			name: "a transaction applies every operation",
+			cmds: func(t *testing.T) []Command {
+				return []Command{
+					{Type: "PUT", Key: "a", Value: "1"},
+					{Type: "PUT", Key: "dir/x", Value: "1"},
+					{Type: "PUT", Key: "dir/y", Value: "1"},
+					{Type: "TXN", Value: encode(t, []TxnOp{
+						{Verb: TxnCAS, Key: "a", Value: "2", Index: 1},
+						{Verb: TxnSet, Key: "dir/z", Value: "1"},
+						{Verb: TxnDeletePrefix, Key: "dir/"},
+						{Verb: TxnCAS, Key: "b", Value: "1"},
+						{Verb: TxnDelete, Key: "missing"},
+					})},
+				}
+			},
+			check: func(t *testing.T, s *inMemStore, last interface{}) {
+				if res := last.(*TxnResponse); len(res.Errors) != 0 {
+					t.Errorf("Expected the transaction to succeed, got %+v", res.Errors)
+				}
+				expectKV(t, s, map[string]string{"a": "2", "b": "1"})
+				if e := s.m["a"]; e.CreateIndex != 1 || e.ModifyIndex != 4 {
+					t.Errorf("Expected 'a' to be created at 1 and modified at 4, got %d and %d", e.CreateIndex, e.ModifyIndex)
+				}
+				// Neither the key written then deleted by the transaction nor
+				// the key that didn't exist changed.
+				changed := map[string]bool{}
+				for _, c := range s.changes {
+					if c.index == 4 {
+						changed[c.key] = true
+					}
+				}
+				if len(changed) != 4 || changed["dir/z"] || changed["missing"] {
+					t.Errorf("Expected a, b, dir/x and dir/y to change, got %v", changed)
+				}
+			},
+		},
+		{
+			name: "an expiry replicated through KEXP removes the key",
+			cmds: func(t *testing.T) []Command {
+				return []Command{
+					{Type: "PUT", Key: "a", Value: "1", TTLMs: 1},
+					{Type: "KEXP", Key: "a", Index: 1},
+				}
+			},
+			check: func(t *testing.T, s *inMemStore, last interface{}) {
+				expectKV(t, s, map[string]string{})
+				if len(s.expiry) != 0 {
+					t.Errorf("Expected the expired key not to be tracked anymore, got %v", s.expiry)
+				}
+			},
+		},
+		{
+			name: "an expiry of a key written again is ignored",
+			cmds: func(t *testing.T) []Command {
+				return []Command{
+					{Type: "PUT", Key: "a", Value: "1", TTLMs: 1},
+					{Type: "PUT", Key: "a", Value: "2", TTLMs: 60000},
+					{Type: "KEXP", Key: "a", Index: 1},
+				}
+			},
+			check: func(t *testing.T, s *inMemStore, last interface{}) {
+				expectKV(t, s, map[string]string{"a": "2"})
+				if expired := s.ExpiredKeys(time.Now()); len(expired) != 0 {
+					t.Errorf("Expected no expired key, got %v", expired)
+				}
+			},
+		},
+		{
+			name: "writes keep the lock of the key",
+			cmds: func(t *testing.T) []Command {
+				return []Command{
+					{Type: "SCREATE", Value: encode(t, Session{ID: "s1", TTLMs: 60000})},
+					{Type: "LOCK", Key: "a", Value: "1", Session: "s1"},
+					{Type: "PUT", Key: "a", Value: "2"},
+					{Type: "TXN", Value: encode(t, []TxnOp{{Verb: TxnCAS, Key: "a", Value: "3", Index: 3}})},
+				}
+			},
+			check: func(t *testing.T, s *inMemStore, last interface{}) {
+				expectKV(t, s, map[string]string{"a": "3"})
+				if e := s.m["a"]; e.Session != "s1" || e.LockIndex != 1 {
+					t.Errorf("Expected 'a' to stay locked by s1 with lock index 1, got '%s' and %d", e.Session, e.LockIndex)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore()
+			a := &testApplier{t: t, s: s}
+			var last interface{}
+			for _, cmd := range tt.cmds(t) {
+				last = a.apply(cmd)
+			}
+			tt.check(t, s, last)
+		})
+	}
+}
+
+// expectKV checks the values of every key of the store.
+func expectKV(t *testing.T, s *inMemStore, expected map[string]string) {
+	t.Helper()
+	if len(s.m) != len(expected) {
+		t.Errorf("Expected %d keys, got %d", len(expected), len(s.m))
+	}
+	for k, v := range expected {
+		if e, has := s.m[k]; !has || e.Value != v {
+			t.Errorf("Expected '%s' to be '%s', got %+v", k, v, e)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package node
+
+import (
+	"sort"
+	"strings"
+)
+
+// MaxTrackedChanges is the number of recent key changes kept in memory to
+// answer blocking queries, a watcher that's further behind is woken up right
+// away and has to read the current state again.
+var MaxTrackedChanges = 4096
+
+// kvChange records that `key` was modified (or deleted) by the command at the
+// given Raft log index.
+type kvChange struct {
+	index uint64
+	key   string
+}
+
+// kvWatch is a pending blocking query, `ch` is closed when a matching key
+// changes.
+type kvWatch struct {
+	key    string
+	prefix bool
+	ch     chan struct{}
+}
+
+func (w *kvWatch) matches(key string) bool {
+	if w.prefix {
+		return strings.HasPrefix(key, w.key)
+	}
+	return w.key == key
+}
+
+// recordChange appends the change to the recent changes and wakes up the
+// watchers interested in the key. Once `MaxTrackedChanges` are tracked, the
+// change replaces the oldest one.
+// Must be called with `mu` held.
+func (s *inMemStore) recordChange(index uint64, key string) {
+	if index > s.kvIndex {
+		s.kvIndex = index
+	}
+	change := kvChange{index: index, key: key}
+	if len(s.changes) < MaxTrackedChanges {
+		s.changes = append(s.changes, change)
+	} else {
+		s.changesFloor = s.changes[s.changesHead].index
+		s.changes[s.changesHead] = change
+		s.changesHead = (s.changesHead + 1) % len(s.changes)
+	}
+
+	remaining := s.watches[:0]
+	for _, w := range s.watches {
+		if w.matches(key) {
+			close(w.ch)
+		} else {
+			remaining = append(remaining, w)
+		}
+	}
+	s.watches = remaining
+}
+
+// resetChanges forgets the recent changes and wakes up every watcher, it's
+// used when the whole state is replaced by a snapshot.
+// Must be called with `mu` held.
+func (s *inMemStore) resetChanges() {
+	s.kvIndex = 0
+	for _, e := range s.m {
+		if e.ModifyIndex > s.kvIndex {
+			s.kvIndex = e.ModifyIndex
+		}
+	}
+	s.changes = s.changes[:0]
+	s.changesHead = 0
+	s.changesFloor = s.kvIndex
+	for _, w := range s.watches {
+		close(w.ch)
+	}
+	s.watches = nil
+}
+
+func (s *inMemStore) WatchKV(key string, prefix bool, index uint64) (<-chan struct{}, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w := &kvWatch{key: key, prefix: prefix, ch: make(chan struct{})}
+	if index < s.changesFloor {
+		close(w.ch)
+		return w.ch, func() {}
+	}
+	// The changes are scanned from the most recent one.
+	for i := len(s.changes) - 1; i >= 0; i-- {
+		change := s.changes[(s.changesHead+i)%len(s.changes)]
+		if change.index <= index {
+			break
+		}
+		if w.matches(change.key) {
+			close(w.ch)
+			return w.ch, func() {}
+		}
+	}
+
+	s.watches = append(s.watches, w)
+	cancel := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, other := range s.watches {
+			if other == w {
+				s.watches = append(s.watches[:i], s.watches[i+1:]...)
+				return
+			}
+		}
+	}
+	return w.ch, cancel
+}
+
+func (s *inMemStore) QueryKV(key string, prefix bool) ([]KVEntry, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]KVEntry, 0)
+	if !prefix {
+		if e, has := s.m[key]; has {
+			entries = append(entries, s.readEntry(e))
+		}
+		return entries, s.kvIndex
+	}
+	for k, e := range s.m {
+		if strings.HasPrefix(k, key) {
+			entries = append(entries, s.readEntry(e))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, s.kvIndex
+}
@@ -0,0 +1,80 @@
+package node
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWatchKVTrackedChanges(t *testing.T) {
+	prev := MaxTrackedChanges
+	MaxTrackedChanges = 4
+	defer func() { MaxTrackedChanges = prev }()
+
+	s := newTestStore()
+	a := &testApplier{t: t, s: s}
+	// The ring wraps around a few times, keeping the changes at 7 to 10.
+	for i := 1; i <= 10; i++ {
+		a.apply(Command{Type: "PUT", Key: fmt.Sprintf("k%d", i), Value: "v"})
+	}
+	if len(s.changes) != 4 || s.changesFloor != 6 {
+		t.Fatalf("Expected 4 changes above 6, got %d above %d", len(s.changes), s.changesFloor)
+	}
+
+	tests := []struct {
+		key    string
+		prefix bool
+		index  uint64
+		fired  bool
+	}{
+		// Too far behind, the watcher must read the state again.
+		{"k1", false, 5, true},
+		{"k9", false, 8, true},
+		{"k10", false, 9, true},
+		{"k8", false, 8, false},
+		{"k7", false, 7, false},
+		{"k1", true, 6, true},
+		{"k", true, 10, false},
+	}
+	for _, tt := range tests {
+		ch, cancel := s.WatchKV(tt.key, tt.prefix, tt.index)
+		fired := false
+		select {
+		case <-ch:
+			fired = true
+		default:
+		}
+		cancel()
+		if fired != tt.fired {
+			t.Errorf("Expected a watch of '%s' (prefix %v) at %d to fire: %v, got %v", tt.key, tt.prefix, tt.index, tt.fired, fired)
+		}
+	}
+
+	// A pending watch fires on the next change of its key.
+	ch, cancel := s.WatchKV("k8", false, 10)
+	defer cancel()
+	a.apply(Command{Type: "PUT", Key: "k8", Value: "w"})
+	select {
+	case <-ch:
+	default:
+		t.Errorf("Expected the watch to fire on the change of its key")
+	}
+}
+
+func TestBlockingReadOnFollower(t *testing.T) {
+	s := newTestNode(t, false)
+	srv := NewServer("", s.Node)
+
+	// A follower can't answer, it must not wait for a change before saying so.
+	start := time.Now()
+	res := httptest.NewRecorder()
+	srv.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/kv/k?index=1&wait=5s", nil))
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the read to be refused without a known leader, got %d: %s", res.Code, res.Body)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the read to be refused right away, it took %s", elapsed)
+	}
+}
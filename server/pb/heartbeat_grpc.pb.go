@@ -0,0 +1,466 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion7
+
+// HeartbeatClient is the client API for Heartbeat service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type HeartbeatClient interface {
+	// Register registers the instances, or renews their leases if they are
+	// already registered, like `/heartbeat` and `/heartbeat/batch`.
+	Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error)
+	// Deregister removes an instance from the registry without waiting for its
+	// lease to expire.
+	Deregister(ctx context.Context, in *DeregisterRequest, opts ...grpc.CallOption) (*DeregisterResponse, error)
+	// ListServices returns the registry, like `/services`.
+	ListServices(ctx context.Context, in *ListServicesRequest, opts ...grpc.CallOption) (*ListServicesResponse, error)
+	// WatchServices streams the registry events applied after the given index,
+	// like `/services/events`.
+	WatchServices(ctx context.Context, in *WatchServicesRequest, opts ...grpc.CallOption) (Heartbeat_WatchServicesClient, error)
+	// Get returns the entry of a key, or the entries under a prefix.
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	// Put writes a key, optionally with a TTL.
+	Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error)
+	// Delete removes a key.
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// Watch streams the state of a key, or of the keys under a prefix, every
+	// time it changes, like `/watch/`.
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Heartbeat_WatchClient, error)
+	// ClusterInfo describes the Raft cluster as seen by the serving node.
+	ClusterInfo(ctx context.Context, in *ClusterInfoRequest, opts ...grpc.CallOption) (*ClusterInfoResponse, error)
+}
+
+type heartbeatClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewHeartbeatClient(cc grpc.ClientConnInterface) HeartbeatClient {
+	return &heartbeatClient{cc}
+}
+
+func (c *heartbeatClient) Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error) {
+	out := new(RegisterResponse)
+	err := c.cc.Invoke(ctx, "/heartbeat.Heartbeat/Register", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *heartbeatClient) Deregister(ctx context.Context, in *DeregisterRequest, opts ...grpc.CallOption) (*DeregisterResponse, error) {
+	out := new(DeregisterResponse)
+	err := c.cc.Invoke(ctx, "/heartbeat.Heartbeat/Deregister", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *heartbeatClient) ListServices(ctx context.Context, in *ListServicesRequest, opts ...grpc.CallOption) (*ListServicesResponse, error) {
+	out := new(ListServicesResponse)
+	err := c.cc.Invoke(ctx, "/heartbeat.Heartbeat/ListServices", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *heartbeatClient) WatchServices(ctx context.Context, in *WatchServicesRequest, opts ...grpc.CallOption) (Heartbeat_WatchServicesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Heartbeat_serviceDesc.Streams[0], "/heartbeat.Heartbeat/WatchServices", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &heartbeatWatchServicesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Heartbeat_WatchServicesClient interface {
+	Recv() (*ServiceEvent, error)
+	grpc.ClientStream
+}
+
+type heartbeatWatchServicesClient struct {
+	grpc.ClientStream
+}
+
+func (x *heartbeatWatchServicesClient) Recv() (*ServiceEvent, error) {
+	m := new(ServiceEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *heartbeatClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
+	out := new(GetResponse)
+	err := c.cc.Invoke(ctx, "/heartbeat.Heartbeat/Get", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *heartbeatClient) Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error) {
+	out := new(PutResponse)
+	err := c.cc.Invoke(ctx, "/heartbeat.Heartbeat/Put", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *heartbeatClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, "/heartbeat.Heartbeat/Delete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *heartbeatClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Heartbeat_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Heartbeat_serviceDesc.Streams[1], "/heartbeat.Heartbeat/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &heartbeatWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Heartbeat_WatchClient interface {
+	Recv() (*WatchResponse, error)
+	grpc.ClientStream
+}
+
+type heartbeatWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *heartbeatWatchClient) Recv() (*WatchResponse, error) {
+	m := new(WatchResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *heartbeatClient) ClusterInfo(ctx context.Context, in *ClusterInfoRequest, opts ...grpc.CallOption) (*ClusterInfoResponse, error) {
+	out := new(ClusterInfoResponse)
+	err := c.cc.Invoke(ctx, "/heartbeat.Heartbeat/ClusterInfo", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// HeartbeatServer is the server API for Heartbeat service.
+// All implementations must embed UnimplementedHeartbeatServer
+// for forward compatibility
+type HeartbeatServer interface {
+	// Register registers the instances, or renews their leases if they are
+	// already registered, like `/heartbeat` and `/heartbeat/batch`.
+	Register(context.Context, *RegisterRequest) (*RegisterResponse, error)
+	// Deregister removes an instance from the registry without waiting for its
+	// lease to expire.
+	Deregister(context.Context, *DeregisterRequest) (*DeregisterResponse, error)
+	// ListServices returns the registry, like `/services`.
+	ListServices(context.Context, *ListServicesRequest) (*ListServicesResponse, error)
+	// WatchServices streams the registry events applied after the given index,
+	// like `/services/events`.
+	WatchServices(*WatchServicesRequest, Heartbeat_WatchServicesServer) error
+	// Get returns the entry of a key, or the entries under a prefix.
+	Get(context.Context, *GetRequest) (*GetResponse, error)
+	// Put writes a key, optionally with a TTL.
+	Put(context.Context, *PutRequest) (*PutResponse, error)
+	// Delete removes a key.
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// Watch streams the state of a key, or of the keys under a prefix, every
+	// time it changes, like `/watch/`.
+	Watch(*WatchRequest, Heartbeat_WatchServer) error
+	// ClusterInfo describes the Raft cluster as seen by the serving node.
+	ClusterInfo(context.Context, *ClusterInfoRequest) (*ClusterInfoResponse, error)
+	mustEmbedUnimplementedHeartbeatServer()
+}
+
+// UnimplementedHeartbeatServer must be embedded to have forward compatible implementations.
+type UnimplementedHeartbeatServer struct {
+}
+
+func (UnimplementedHeartbeatServer) Register(context.Context, *RegisterRequest) (*RegisterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Register not implemented")
+}
+func (UnimplementedHeartbeatServer) Deregister(context.Context, *DeregisterRequest) (*DeregisterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Deregister not implemented")
+}
+func (UnimplementedHeartbeatServer) ListServices(context.Context, *ListServicesRequest) (*ListServicesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListServices not implemented")
+}
+func (UnimplementedHeartbeatServer) WatchServices(*WatchServicesRequest, Heartbeat_WatchServicesServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchServices not implemented")
+}
+func (UnimplementedHeartbeatServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedHeartbeatServer) Put(context.Context, *PutRequest) (*PutResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Put not implemented")
+}
+func (UnimplementedHeartbeatServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedHeartbeatServer) Watch(*WatchRequest, Heartbeat_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedHeartbeatServer) ClusterInfo(context.Context, *ClusterInfoRequest) (*ClusterInfoResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ClusterInfo not implemented")
+}
+func (UnimplementedHeartbeatServer) mustEmbedUnimplementedHeartbeatServer() {}
+
+// UnsafeHeartbeatServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to HeartbeatServer will
+// result in compilation errors.
+type UnsafeHeartbeatServer interface {
+	mustEmbedUnimplementedHeartbeatServer()
+}
+
+func RegisterHeartbeatServer(s grpc.ServiceRegistrar, srv HeartbeatServer) {
+	s.RegisterService(&_Heartbeat_serviceDesc, srv)
+}
+
+func _Heartbeat_Register_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeartbeatServer).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/heartbeat.Heartbeat/Register",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeartbeatServer).Register(ctx, req.(*RegisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Heartbeat_Deregister_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeregisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeartbeatServer).Deregister(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/heartbeat.Heartbeat/Deregister",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeartbeatServer).Deregister(ctx, req.(*DeregisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Heartbeat_ListServices_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListServicesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeartbeatServer).ListServices(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/heartbeat.Heartbeat/ListServices",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeartbeatServer).ListServices(ctx, req.(*ListServicesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Heartbeat_WatchServices_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchServicesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(HeartbeatServer).WatchServices(m, &heartbeatWatchServicesServer{stream})
+}
+
+type Heartbeat_WatchServicesServer interface {
+	Send(*ServiceEvent) error
+	grpc.ServerStream
+}
+
+type heartbeatWatchServicesServer struct {
+	grpc.ServerStream
+}
+
+func (x *heartbeatWatchServicesServer) Send(m *ServiceEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Heartbeat_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeartbeatServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/heartbeat.Heartbeat/Get",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeartbeatServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Heartbeat_Put_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PutRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeartbeatServer).Put(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/heartbeat.Heartbeat/Put",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeartbeatServer).Put(ctx, req.(*PutRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Heartbeat_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeartbeatServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/heartbeat.Heartbeat/Delete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeartbeatServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Heartbeat_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(HeartbeatServer).Watch(m, &heartbeatWatchServer{stream})
+}
+
+type Heartbeat_WatchServer interface {
+	Send(*WatchResponse) error
+	grpc.ServerStream
+}
+
+type heartbeatWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *heartbeatWatchServer) Send(m *WatchResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Heartbeat_ClusterInfo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClusterInfoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeartbeatServer).ClusterInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/heartbeat.Heartbeat/ClusterInfo",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeartbeatServer).ClusterInfo(ctx, req.(*ClusterInfoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Heartbeat_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "heartbeat.Heartbeat",
+	HandlerType: (*HeartbeatServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Register",
+			Handler:    _Heartbeat_Register_Handler,
+		},
+		{
+			MethodName: "Deregister",
+			Handler:    _Heartbeat_Deregister_Handler,
+		},
+		{
+			MethodName: "ListServices",
+			Handler:    _Heartbeat_ListServices_Handler,
+		},
+		{
+			MethodName: "Get",
+			Handler:    _Heartbeat_Get_Handler,
+		},
+		{
+			MethodName: "Put",
+			Handler:    _Heartbeat_Put_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _Heartbeat_Delete_Handler,
+		},
+		{
+			MethodName: "ClusterInfo",
+			Handler:    _Heartbeat_ClusterInfo_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchServices",
+			Handler:       _Heartbeat_WatchServices_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _Heartbeat_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "heartbeat.proto",
+}